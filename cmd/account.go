@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/x/term"
+	"github.com/osmancadc/go-encrypted-chat/config"
+)
+
+const accountUsage = `Usage: go run main.go account export (-user <username> | -profile <name>) [-with-history] <file>
+       go run main.go account import (-user <username> | -profile <name>) [-with-history] [-force] <file>`
+
+func runAccountCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(accountUsage)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("account "+args[0], flag.ExitOnError)
+	username := fs.String("user", "", "Username of the account")
+	profileName := fs.String("profile", "", "Client profile of the account")
+	configPath := fs.String("config", "", "Path to the configuration file")
+	withHistory := fs.Bool("with-history", false, "Include the message history")
+	force := fs.Bool("force", false, "Replace an existing identity on import")
+	config.RegisterFlags(fs)
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		fmt.Println(accountUsage)
+		os.Exit(1)
+	}
+
+	settings, err := config.LoadSettings(*configPath, os.Environ(), fs)
+	if err != nil {
+		fmt.Printf("Error: invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	keystoreDir, err := resolveClient(settings, *profileName, username)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	historyPath := ""
+	if *withHistory {
+		if settings.Client.History == "" {
+			fmt.Println("Error: no history file is configured for this account")
+			os.Exit(1)
+		}
+		historyPath = settings.Client.History
+	}
+
+	switch args[0] {
+	case "export":
+		err = exportAccount(*username, keystoreDir, historyPath, fs.Arg(0))
+	case "import":
+		err = importAccount(*username, keystoreDir, historyPath, fs.Arg(0), *force)
+	default:
+		fmt.Println(accountUsage)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func exportAccount(username, keystoreDir, historyPath, path string) error {
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	if term.IsTerminal(os.Stdin.Fd()) {
+		confirmation, err := readPassphrase("Repeat the passphrase: ")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(passphrase, confirmation) {
+			return fmt.Errorf("the passphrases do not match")
+		}
+	}
+
+	data, err := config.ExportBundle(username, keystoreDir, historyPath, passphrase)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Account exported to %s\n", path)
+	return nil
+}
+
+func importAccount(username, keystoreDir, historyPath, path string, force bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	err = config.ImportBundle(data, passphrase, username, keystoreDir, historyPath, force)
+	if errors.Is(err, config.ErrIdentityExists) {
+		return fmt.Errorf("%w in %s, use -force to replace it", err, keystoreDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Account imported into %s\n", keystoreDir)
+	return nil
+}
+
+// readPassphrase reads without echo from a terminal, or the first line of
+// standard input otherwise.
+func readPassphrase(prompt string) ([]byte, error) {
+	if !term.IsTerminal(os.Stdin.Fd()) {
+		line, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			return nil, fmt.Errorf("error reading the passphrase: %w", err)
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(os.Stdin.Fd())
+	fmt.Fprintln(os.Stderr)
+
+	return passphrase, err
+}
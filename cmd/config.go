@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+)
+
+func runConfigCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Println("Usage: go run main.go config print [-config <file>] [flags]")
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("config print", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to the configuration file")
+	config.RegisterFlags(fs)
+	fs.Parse(args[1:])
+
+	settings, err := config.LoadSettings(*configPath, os.Environ(), fs)
+	if settings != nil {
+		settings.Print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Printf("\nError: invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+}
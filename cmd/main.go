@@ -1,22 +1,51 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 
 	"github.com/google/uuid"
+	"github.com/osmancadc/go-encrypted-chat/config"
 	"github.com/osmancadc/go-encrypted-chat/internal/model"
 	"github.com/osmancadc/go-encrypted-chat/internal/websocket"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
 	"github.com/osmancadc/go-encrypted-chat/pkg/logger"
 )
 
 var log = logger.NewLogger("INFO")
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfigCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "account" {
+		runAccountCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "revoke" {
+		runRevokeCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "wipe" {
+		runWipeCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		runProfileCommand(os.Args[2:])
+		return
+	}
+
 	serverMode := flag.Bool("server", false, "Run in server mode")
 	clientMode := flag.Bool("client", false, "Run in client mode")
 	username := flag.String("user", "", "Username for client")
+	profileName := flag.String("profile", "", "Client profile to use (see the profile command)")
+	linkCode := flag.String("link", "", "Link this new device to the account with the code shown by /link on another device")
+	configPath := flag.String("config", "", "Path to the configuration file (default $XDG_CONFIG_HOME/go-encrypted-chat/config.toml)")
+	config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *serverMode && *clientMode {
@@ -24,24 +53,90 @@ func main() {
 		os.Exit(1)
 	}
 
+	settings, err := config.LoadSettings(*configPath, os.Environ(), flag.CommandLine)
+	if err != nil {
+		fmt.Printf("Error: invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	log.SetLevel(settings.Log.Level)
+	websocket.SetLogLevel(settings.Log.Level)
+
 	if *serverMode {
 		log.Info("Starting WebSocket server...")
-		websocket.ServeWs()
+		websocket.ServeWs(settings, func() (*config.Settings, error) {
+			return config.LoadSettings(*configPath, os.Environ(), flag.CommandLine)
+		})
 	} else if *clientMode {
-		if *username == "" {
-			log.Fatal("Username is required in client mode. Use -user <username>")
+		// Keys are only generated when the keystore has no identity yet or the
+		// identity is rotated.
+		keys := crypto.NewKeyPool(settings.Crypto.RSABits, 1)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		keystoreDir, err := resolveClient(settings, *profileName, username)
+		if err != nil {
+			log.Fatal(err.Error())
 		}
+		cfg, err := config.New(ctx, keystoreDir, keys)
+		if err != nil {
+			log.Fatalf("Error opening keystore %s: %v", keystoreDir, err)
+		}
+
 		log.Infof("Starting WebSocket client for user %s...\n", *username)
+		if *linkCode != "" && (cfg.GetCertificate() != nil || len(cfg.GetContacts()) > 0) {
+			log.Fatalf("The keystore %s is already in use, link a device with a new keystore", keystoreDir)
+		}
+
 		user := model.User{
 			ID:       uuid.NewString(),
 			Username: *username,
+			DeviceID: cfg.GetDeviceID(),
 		}
 		conn := websocket.NewConnection(user)
-		handler := websocket.NewClientHandler(conn)
+		handler := websocket.NewClientHandler(conn, cfg, keys, settings.Client)
+		if *linkCode != "" {
+			handler.LinkWith(*linkCode)
+		}
 		handler.Run()
 	} else {
-		fmt.Println("Usage: go run main.go [-server | -client -user <username>]")
+		fmt.Println("Usage: go run main.go [-server | -client (-user <username> | -profile <name>) [-link <code>]] [flags]")
+		fmt.Println("       go run main.go config print [-config <file>] [flags]")
+		fmt.Println("       go run main.go revoke <generate | publish> ...")
+		fmt.Println("       go run main.go account <export | import> ...")
+		fmt.Println("       go run main.go wipe (-user <username> | -profile <name>) [-yes] [-offline]")
+		fmt.Println("       go run main.go profile <list | create | clone | delete> ...")
 		os.Exit(1)
 	}
 	select {}
 }
+
+// resolveClient applies the profile to settings and returns the keystore of
+// the user, filling in username from the profile when it is empty.
+func resolveClient(settings *config.Settings, profileName string, username *string) (string, error) {
+	if profileName != "" {
+		profile, err := config.LoadProfile(profileName)
+		if err != nil {
+			return "", fmt.Errorf("error loading profile: %w", err)
+		}
+		if *username != "" && *username != profile.Username {
+			return "", fmt.Errorf("profile %s belongs to user %s, not %s", profile.Name, profile.Username, *username)
+		}
+		*username = profile.Username
+		if err := settings.ApplyProfile(profile); err != nil {
+			return "", fmt.Errorf("error applying profile %s: %w", profile.Name, err)
+		}
+	}
+	if *username == "" {
+		return "", fmt.Errorf("username is required in client mode. Use -user <username>")
+	}
+
+	if settings.Client.Keystore != "" {
+		return settings.Client.Keystore, nil
+	}
+	keystoreDir, err := config.DefaultKeystoreDir(*username)
+	if err != nil {
+		return "", fmt.Errorf("error locating keystore: %w", err)
+	}
+
+	return keystoreDir, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+)
+
+const profileUsage = `Usage: go run main.go profile list
+       go run main.go profile create -user <username> [-url <server url>] <name>
+       go run main.go profile clone [-user <username>] <source> <name>
+       go run main.go profile delete <name>`
+
+func runProfileCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(profileUsage)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("profile "+args[0], flag.ExitOnError)
+	username := fs.String("user", "", "Username of the profile")
+	serverURL := fs.String("url", "", "WebSocket URL the profile connects to")
+	fs.Parse(args[1:])
+
+	var err error
+	switch {
+	case args[0] == "list" && fs.NArg() == 0:
+		err = listProfiles()
+	case args[0] == "create" && fs.NArg() == 1:
+		_, err = config.CreateProfile(fs.Arg(0), *username, *serverURL)
+	case args[0] == "clone" && fs.NArg() == 2:
+		_, err = config.CloneProfile(fs.Arg(0), fs.Arg(1), *username)
+	case args[0] == "delete" && fs.NArg() == 1:
+		err = config.DeleteProfile(fs.Arg(0))
+	default:
+		fmt.Println(profileUsage)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func listProfiles() error {
+	profiles, err := config.ListProfiles()
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tUSERNAME\tSERVER")
+	for _, profile := range profiles {
+		serverURL := profile.ServerURL
+		if serverURL == "" {
+			serverURL = "(default)"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", profile.Name, profile.Username, serverURL)
+	}
+
+	return writer.Flush()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+	"github.com/osmancadc/go-encrypted-chat/internal/websocket"
+)
+
+const revokeUsage = `Usage: go run main.go revoke generate (-user <username> | -profile <name>) [-reason <text>] [-now] <file>
+       go run main.go revoke publish [-profile <name>] [-url <server url>] <file>`
+
+func runRevokeCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(revokeUsage)
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("revoke "+args[0], flag.ExitOnError)
+	username := fs.String("user", "", "Username whose key is revoked")
+	profileName := fs.String("profile", "", "Client profile to use")
+	configPath := fs.String("config", "", "Path to the configuration file")
+	reason := fs.String("reason", "", "Reason shown to contacts")
+	now := fs.Bool("now", false, "Revoke from now instead of from when the certificate is published")
+	config.RegisterFlags(fs)
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		fmt.Println(revokeUsage)
+		os.Exit(1)
+	}
+
+	settings, err := config.LoadSettings(*configPath, os.Environ(), fs)
+	if err != nil {
+		fmt.Printf("Error: invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "generate":
+		err = generateRevocation(settings, *profileName, username, *reason, *now, fs.Arg(0))
+	case "publish":
+		err = publishRevocation(settings, *profileName, fs.Arg(0))
+	default:
+		fmt.Println(revokeUsage)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func generateRevocation(settings *config.Settings, profileName string, username *string, reason string, now bool, path string) error {
+	keystoreDir, err := resolveClient(settings, profileName, username)
+	if err != nil {
+		return err
+	}
+
+	keystore, err := config.OpenKeystore(keystoreDir)
+	if err != nil {
+		return err
+	}
+	identity, err := keystore.LoadIdentity()
+	if err != nil {
+		return fmt.Errorf("error loading identity: %w", err)
+	}
+
+	revocation := model.KeyRevocationPayload{UserID: *username, Reason: reason}
+	if now {
+		revocation.Time = time.Now().UTC()
+	}
+	if err := model.SignKeyRevocation(&revocation, *identity); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(revocation, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Anyone holding the certificate can revoke the key, keep it private.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Revocation certificate for %s written to %s, store it offline\n", *username, path)
+	return nil
+}
+
+func publishRevocation(settings *config.Settings, profileName, path string) error {
+	if profileName != "" {
+		profile, err := config.LoadProfile(profileName)
+		if err != nil {
+			return err
+		}
+		if err := settings.ApplyProfile(profile); err != nil {
+			return err
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var revocation model.KeyRevocationPayload
+	if err := revocation.Unmarshal(data); err != nil {
+		return fmt.Errorf("invalid revocation certificate: %w", err)
+	}
+	if err := model.VerifyKeyRevocation(&revocation); err != nil {
+		return fmt.Errorf("invalid revocation certificate: %w", err)
+	}
+
+	if err := websocket.PublishRevocation(settings.Client.URL, revocation); err != nil {
+		return err
+	}
+
+	fmt.Printf("Revocation of the key of %s published to %s\n", revocation.UserID, settings.Client.URL)
+	return nil
+}
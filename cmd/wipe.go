@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+	"github.com/osmancadc/go-encrypted-chat/internal/websocket"
+)
+
+const wipeUsage = `Usage: go run main.go wipe (-user <username> | -profile <name>) [-yes] [-offline]`
+
+func runWipeCommand(args []string) {
+	fs := flag.NewFlagSet("wipe", flag.ExitOnError)
+	username := fs.String("user", "", "Username of the account to wipe")
+	profileName := fs.String("profile", "", "Client profile of the account to wipe")
+	configPath := fs.String("config", "", "Path to the configuration file")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	offline := fs.Bool("offline", false, "Do not contact the server")
+	config.RegisterFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fmt.Println(wipeUsage)
+		os.Exit(1)
+	}
+
+	settings, err := config.LoadSettings(*configPath, os.Environ(), fs)
+	if err != nil {
+		fmt.Printf("Error: invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	keystoreDir, err := resolveClient(settings, *profileName, username)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !*yes && !confirmWipe(*username, keystoreDir, settings.Client.History) {
+		fmt.Println("Nothing was wiped")
+		os.Exit(1)
+	}
+
+	if err := wipeAccount(settings, *username, keystoreDir, *offline); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func confirmWipe(username, keystoreDir, historyPath string) bool {
+	fmt.Printf("This destroys the keystore in %s", keystoreDir)
+	if historyPath != "" {
+		fmt.Printf(" and the history in %s", historyPath)
+	}
+	fmt.Printf(".\nType %s to confirm: ", username)
+
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	return strings.TrimSpace(line) == username
+}
+
+// wipeAccount destroys the local state before telling the server, so a
+// server that cannot be reached does not leave anything behind.
+func wipeAccount(settings *config.Settings, username, keystoreDir string, offline bool) error {
+	user := model.User{Username: username}
+	if _, err := os.Stat(keystoreDir); err == nil {
+		keystore, err := config.OpenKeystore(keystoreDir)
+		if err != nil {
+			return err
+		}
+		if device, err := keystore.LoadDevice(); err == nil {
+			user.DeviceID = device.DeviceID
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := config.Wipe(keystoreDir, settings.Client.History); err != nil {
+		return fmt.Errorf("the wipe is incomplete: %w", err)
+	}
+	fmt.Println("Local state wiped")
+
+	if offline {
+		return nil
+	}
+	if err := websocket.RequestWipe(settings.Client.URL, user); err != nil {
+		return err
+	}
+	fmt.Printf("The server at %s forgot this device\n", settings.Client.URL)
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+const (
+	bundleMagic      = "GOCHATBUNDLE"
+	bundleVersion    = 1
+	bundleIterations = 600000
+	bundleSaltSize   = 16
+
+	MinPassphraseLength = 8
+)
+
+var ErrIdentityExists = errors.New("the keystore already holds an identity")
+
+// bundleFiles are the keystore files an account bundle carries.
+var bundleFiles = []string{identityFile, contactsFile, conversationsFile, rotationFile, deviceFile}
+
+type bundle struct {
+	Version   int               `json:"version"`
+	UserID    string            `json:"userID"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Files     map[string][]byte `json:"files"`
+	History   []byte            `json:"history,omitempty"`
+}
+
+// ExportBundle packs the keystore, and the history when historyPath is set,
+// into an archive encrypted with a key derived from the passphrase. The
+// archive is magic|version|iterations|salt|nonce|ciphertext and everything
+// before the ciphertext is authenticated.
+func ExportBundle(userID, keystoreDir, historyPath string, passphrase []byte) ([]byte, error) {
+	if len(passphrase) < MinPassphraseLength {
+		return nil, fmt.Errorf("the passphrase must have at least %d characters", MinPassphraseLength)
+	}
+
+	keystore := &Keystore{dir: keystoreDir}
+	contents := bundle{Version: bundleVersion, UserID: userID, CreatedAt: time.Now().UTC(), Files: map[string][]byte{}}
+	for _, name := range bundleFiles {
+		data, err := keystore.readFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		contents.Files[name] = data
+	}
+	if _, ok := contents.Files[identityFile]; !ok {
+		return nil, fmt.Errorf("no identity in %s", keystoreDir)
+	}
+
+	if historyPath != "" {
+		history, err := os.ReadFile(historyPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading history: %w", err)
+		}
+		contents.History = history
+	}
+
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, bundleSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header := []byte(bundleMagic)
+	header = append(header, bundleVersion)
+	header = binary.BigEndian.AppendUint32(header, bundleIterations)
+	header = append(header, salt...)
+
+	gcm, err := bundleCipher(passphrase, salt, bundleIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+
+	return gcm.Seal(header, nonce, plaintext, header), nil
+}
+
+// ImportBundle decrypts and validates an account bundle and writes it to the
+// keystore of userID, and the history when the bundle has one and
+// historyPath is set. An existing identity is only replaced when overwrite is
+// true.
+func ImportBundle(data, passphrase []byte, userID, keystoreDir, historyPath string, overwrite bool) error {
+	contents, err := openBundle(data, passphrase)
+	if err != nil {
+		return err
+	}
+	if contents.UserID != userID {
+		return fmt.Errorf("the account bundle belongs to %s, not %s", contents.UserID, userID)
+	}
+
+	keystore, err := OpenKeystore(keystoreDir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(keystoreDir, identityFile)); err == nil && !overwrite {
+		return ErrIdentityExists
+	}
+	if historyPath != "" && len(contents.History) > 0 && !overwrite {
+		if _, err := os.Stat(historyPath); err == nil {
+			return fmt.Errorf("history %s already exists", historyPath)
+		}
+	}
+
+	files := map[string][]byte{}
+	for _, name := range bundleFiles {
+		files[filepath.Join(keystore.dir, name)] = contents.Files[name]
+	}
+	if historyPath != "" && len(contents.History) > 0 {
+		if err := os.MkdirAll(filepath.Dir(historyPath), dirPermissions); err != nil {
+			return err
+		}
+		files[historyPath] = contents.History
+	}
+
+	return replaceFiles(files)
+}
+
+type fileSnapshot struct {
+	path   string
+	data   []byte
+	exists bool
+}
+
+// replaceFiles writes every file, removing those without data, and puts
+// back what the files held when one of them fails, so the keystore is never
+// left half imported.
+func replaceFiles(files map[string][]byte) error {
+	snapshots := make([]fileSnapshot, 0, len(files))
+	for path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		snapshots = append(snapshots, fileSnapshot{path: path, data: data, exists: err == nil})
+	}
+
+	for i, snapshot := range snapshots {
+		err := writeOrRemove(snapshot.path, files[snapshot.path], files[snapshot.path] != nil)
+		if err == nil {
+			continue
+		}
+
+		errs := []error{err}
+		for _, written := range snapshots[:i] {
+			if err := writeOrRemove(written.path, written.data, written.exists); err != nil {
+				errs = append(errs, fmt.Errorf("error restoring %s: %w", written.path, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+func writeOrRemove(path string, data []byte, exists bool) error {
+	if exists {
+		return writeFileAtomic(path, data)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func openBundle(data, passphrase []byte) (*bundle, error) {
+	headerSize := len(bundleMagic) + 1 + 4 + bundleSaltSize
+	if len(data) < headerSize || !bytes.HasPrefix(data, []byte(bundleMagic)) {
+		return nil, fmt.Errorf("not an account bundle")
+	}
+	if version := data[len(bundleMagic)]; version != bundleVersion {
+		return nil, fmt.Errorf("unsupported account bundle version %d", version)
+	}
+
+	iterations := binary.BigEndian.Uint32(data[len(bundleMagic)+1:])
+	if iterations == 0 || iterations > 10*bundleIterations {
+		return nil, fmt.Errorf("invalid iteration count %d", iterations)
+	}
+	salt := data[headerSize-bundleSaltSize : headerSize]
+
+	gcm, err := bundleCipher(passphrase, salt, int(iterations))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize+gcm.NonceSize() {
+		return nil, fmt.Errorf("truncated account bundle")
+	}
+	header := data[:headerSize+gcm.NonceSize()]
+	nonce := header[headerSize:]
+
+	plaintext, err := gcm.Open(nil, nonce, data[len(header):], header)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted account bundle")
+	}
+
+	contents := &bundle{}
+	if err := json.Unmarshal(plaintext, contents); err != nil {
+		return nil, fmt.Errorf("invalid account bundle: %w", err)
+	}
+
+	return contents, contents.validate()
+}
+
+func bundleCipher(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := crypto.DerivePassphraseKey(passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// validate checks every file parses before anything is written.
+func (b *bundle) validate() error {
+	if b.Version != bundleVersion {
+		return fmt.Errorf("unsupported account bundle version %d", b.Version)
+	}
+	for name := range b.Files {
+		known := false
+		for _, bundleFile := range bundleFiles {
+			known = known || name == bundleFile
+		}
+		if !known {
+			return fmt.Errorf("unexpected file %q in the account bundle", name)
+		}
+	}
+
+	identityKey, ok := b.Files[identityFile]
+	if !ok {
+		return fmt.Errorf("the account bundle has no identity")
+	}
+	if _, err := crypto.ParseRSAPrivateKey(identityKey); err != nil {
+		return fmt.Errorf("invalid identity in the account bundle: %w", err)
+	}
+	if data, ok := b.Files[contactsFile]; ok {
+		if _, err := decodeContacts(data); err != nil {
+			return fmt.Errorf("invalid contacts in the account bundle: %w", err)
+		}
+	}
+
+	targets := map[string]interface{}{
+		conversationsFile: &conversationKeys{},
+		rotationFile:      &identity.KeyRotation{},
+		deviceFile:        &deviceState{},
+	}
+	for name, target := range targets {
+		if data, ok := b.Files[name]; ok {
+			if err := json.Unmarshal(data, target); err != nil {
+				return fmt.Errorf("invalid %s in the account bundle: %w", name, err)
+			}
+		}
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(b.History), []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("invalid history line %d in the account bundle: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
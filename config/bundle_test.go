@@ -0,0 +1,123 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+)
+
+func TestAccountBundle(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	original, err := New(context.Background(), source, testKeys)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	original.AddPublicKey("bob", []byte("bob public key"))
+	original.AddSymmetricKey(identity.Device{UserID: "bob"}, []byte("outbound"))
+
+	historyPath := filepath.Join(t.TempDir(), "history.jsonl")
+	history := OpenHistory(historyPath)
+	history.Append(HistoryEntry{Time: time.Now(), SenderID: "bob", Content: "hi"})
+
+	passphrase := []byte("correct horse battery")
+	if _, err := ExportBundle("alice", source, historyPath, []byte("short")); err == nil {
+		t.Errorf("ExportBundle() accepted a short passphrase")
+	}
+	data, err := ExportBundle("alice", source, historyPath, passphrase)
+	if err != nil {
+		t.Fatalf("ExportBundle() error = %v", err)
+	}
+	if bytes.Contains(data, []byte("bob public key")) {
+		t.Errorf("bundle is not encrypted")
+	}
+
+	target := filepath.Join(t.TempDir(), "target")
+	targetHistory := filepath.Join(t.TempDir(), "history.jsonl")
+
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase []byte
+	}{
+		{name: "Wrong passphrase", data: data, passphrase: []byte("wrong horse battery")},
+		{name: "Tampered ciphertext", data: tampered, passphrase: passphrase},
+		{name: "Not a bundle", data: []byte("hello"), passphrase: passphrase},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ImportBundle(tt.data, tt.passphrase, "alice", target, targetHistory, false); err == nil {
+				t.Errorf("ImportBundle() error = nil, want an error")
+			}
+		})
+	}
+
+	if err := ImportBundle(data, passphrase, "mallory", target, targetHistory, false); err == nil {
+		t.Errorf("ImportBundle() accepted the bundle of another user")
+	}
+	if err := ImportBundle(data, passphrase, "alice", target, targetHistory, false); err != nil {
+		t.Fatalf("ImportBundle() error = %v", err)
+	}
+
+	imported, err := New(context.Background(), target, testKeys)
+	if err != nil {
+		t.Fatalf("New() on the imported keystore error = %v", err)
+	}
+	originalKey, _ := original.GetRsaInstance().GetPublicKeyValue()
+	importedKey, _ := imported.GetRsaInstance().GetPublicKeyValue()
+	if !bytes.Equal(originalKey, importedKey) {
+		t.Errorf("imported identity differs from the exported one")
+	}
+	if string(imported.GetPublicKey("bob")) != "bob public key" || string(imported.GetSymmetricKey(identity.Device{UserID: "bob"})) != "outbound" {
+		t.Errorf("contacts or sessions were not imported")
+	}
+	if imported.GetDeviceID() != original.GetDeviceID() {
+		t.Errorf("device ID = %s, want %s", imported.GetDeviceID(), original.GetDeviceID())
+	}
+	entries, _ := OpenHistory(targetHistory).Load()
+	if len(entries) != 1 || entries[0].Content != "hi" {
+		t.Errorf("history = %+v, want the exported entry", entries)
+	}
+
+	if err := ImportBundle(data, passphrase, "alice", target, targetHistory, false); !errors.Is(err, ErrIdentityExists) {
+		t.Errorf("ImportBundle() over an identity error = %v, want %v", err, ErrIdentityExists)
+	}
+	if err := ImportBundle(data, passphrase, "alice", target, targetHistory, true); err != nil {
+		t.Errorf("ImportBundle() with overwrite error = %v", err)
+	}
+
+	info, _ := os.Stat(filepath.Join(target, identityFile))
+	if info.Mode().Perm() != filePermissions {
+		t.Errorf("imported identity mode = %o, want %o", info.Mode().Perm(), filePermissions)
+	}
+}
+
+func TestReplaceFiles_RollsBack(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "contacts.json")
+	created := filepath.Join(dir, "device.json")
+	os.WriteFile(existing, []byte("old"), filePermissions)
+
+	err := replaceFiles(map[string][]byte{
+		existing: []byte("new"),
+		created:  []byte("new"),
+		filepath.Join(dir, "missing", "history.jsonl"): []byte("new"),
+	})
+	if err == nil {
+		t.Fatalf("replaceFiles() error = nil, want an error")
+	}
+
+	if data, _ := os.ReadFile(existing); string(data) != "old" {
+		t.Errorf("%s = %q, want it restored", existing, data)
+	}
+	if _, err := os.Stat(created); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s was left behind", created)
+	}
+}
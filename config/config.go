@@ -1,85 +1,359 @@
 package config
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
 	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
 )
 
 type Config struct {
 	mu            sync.RWMutex
 	rsaInstance   *crypto.RSA
-	PublicKeys    map[string][]byte
-	SymmetricKeys map[string][]byte
+	keystore      *Keystore
+	Contacts      map[string]*Contact
+	SymmetricKeys map[identity.Device][]byte
+	InboundKeys   map[identity.Device][]byte
+	AuthModes     map[string]string
+	rotation      *identity.KeyRotation
+	device        deviceState
 }
 
-var (
-	once     sync.Once
-	instance *Config
-)
-
-func GetConfig() *Config {
-	once.Do(func() {
-		rsaInstance, err := crypto.GenerateRSA(2048)
+// New opens the keystore in keystoreDir, taking an identity from keys on
+// first use, or keeps everything in memory when keystoreDir is empty.
+func New(ctx context.Context, keystoreDir string, keys *crypto.KeyPool) (*Config, error) {
+	if keystoreDir == "" {
+		rsaInstance, err := keys.Get(ctx)
 		if err != nil {
-			log.Fatal("error creating the initial configuration")
+			return nil, err
 		}
-		instance = &Config{
-			PublicKeys:    map[string][]byte{},
-			SymmetricKeys: map[string][]byte{},
+		return &Config{
+			Contacts:      map[string]*Contact{},
+			SymmetricKeys: map[identity.Device][]byte{},
+			InboundKeys:   map[identity.Device][]byte{},
+			AuthModes:     map[string]string{},
 			rsaInstance:   rsaInstance,
+			device:        deviceState{DeviceID: newDeviceID()},
+		}, nil
+	}
+
+	keystore, err := OpenKeystore(keystoreDir)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaInstance, err := keystore.LoadIdentity()
+	if errors.Is(err, os.ErrNotExist) {
+		rsaInstance, err = keys.Get(ctx)
+		if err != nil {
+			return nil, err
 		}
-	})
+		err = keystore.SaveIdentity(rsaInstance)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading identity: %w", err)
+	}
+
+	contacts, err := keystore.LoadContacts()
+	if err != nil {
+		return nil, fmt.Errorf("error loading contacts: %w", err)
+	}
+
+	conversations, err := keystore.LoadConversations()
+	if err != nil {
+		return nil, fmt.Errorf("error loading conversation keys: %w", err)
+	}
 
-	return instance
+	rotation, err := keystore.LoadRotation()
+	if err != nil {
+		return nil, fmt.Errorf("error loading key rotation: %w", err)
+	}
+
+	device, err := keystore.LoadDevice()
+	if err != nil {
+		return nil, fmt.Errorf("error loading device: %w", err)
+	}
+	if device.DeviceID == "" {
+		device.DeviceID = newDeviceID()
+		if err := keystore.SaveDevice(device); err != nil {
+			return nil, fmt.Errorf("error saving device: %w", err)
+		}
+	}
+
+	return &Config{
+		Contacts:      contacts,
+		SymmetricKeys: conversations.SymmetricKeys,
+		InboundKeys:   conversations.InboundKeys,
+		AuthModes:     conversations.AuthModes,
+		rsaInstance:   rsaInstance,
+		keystore:      keystore,
+		rotation:      rotation,
+		device:        device,
+	}, nil
+}
+
+func (c *Config) Flush() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.keystore == nil {
+		return nil
+	}
+	if err := c.keystore.SaveContacts(c.Contacts); err != nil {
+		return err
+	}
+
+	return c.keystore.SaveConversations(c.conversationKeys())
+}
+
+func (c *Config) conversationKeys() conversationKeys {
+	return conversationKeys{
+		SymmetricKeys: c.SymmetricKeys,
+		InboundKeys:   c.InboundKeys,
+		AuthModes:     c.AuthModes,
+	}
+}
+
+func (c *Config) saveContacts() {
+	if c.keystore == nil {
+		return
+	}
+	if err := c.keystore.SaveContacts(c.Contacts); err != nil {
+		log.Printf("error saving contacts: %v", err)
+	}
+}
+
+func (c *Config) saveConversations() {
+	if c.keystore == nil {
+		return
+	}
+	if err := c.keystore.SaveConversations(c.conversationKeys()); err != nil {
+		log.Printf("error saving conversation keys: %v", err)
+	}
 }
 
 func (c *Config) GetRsaInstance() *crypto.RSA {
 	c.mu.RLock()
-	defer c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.rsaInstance
 }
 
-func (c *Config) AddPublicKey(userID string, publicKey []byte) {
+// RotateIdentity replaces the identity with newKey and keeps the signed
+// rotation statement so it can be sent again to contacts that were offline.
+func (c *Config) RotateIdentity(userID string, newKey *crypto.RSA) (*identity.KeyRotation, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.PublicKeys[userID] = publicKey
+	if c.device.Certificate != nil {
+		return nil, fmt.Errorf("only the device holding the identity key can rotate it")
+	}
+
+	rotation := &identity.KeyRotation{UserID: userID, Time: time.Now().UTC()}
+	if err := identity.SignKeyRotation(rotation, *c.rsaInstance, *newKey); err != nil {
+		return nil, err
+	}
+
+	// The identity goes first, losing the statement only costs contacts a key
+	// change warning, while a statement for a key we never saved cannot be undone.
+	if c.keystore != nil {
+		if err := c.keystore.SaveIdentity(newKey); err != nil {
+			return nil, fmt.Errorf("error saving the new identity: %w", err)
+		}
+		if err := c.keystore.SaveRotation(rotation); err != nil {
+			log.Printf("error saving key rotation: %v", err)
+		}
+	}
+
+	c.rsaInstance = newKey
+	c.rotation = rotation
+	c.SymmetricKeys = map[identity.Device][]byte{}
+	c.InboundKeys = map[identity.Device][]byte{}
+	c.saveConversations()
+
+	return rotation, nil
+}
+
+func (c *Config) GetRotation() *identity.KeyRotation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.rotation
+}
+
+func newDeviceID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
 }
 
-func (c *Config) GetPublicKey(userID string) []byte {
+func (c *Config) GetDeviceID() string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return c.PublicKeys[userID]
+	return c.device.DeviceID
+}
+
+// GetCertificate returns the certificate of a linked device, or nil on the
+// device holding the identity key.
+func (c *Config) GetCertificate() *identity.DeviceCertificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.device.Certificate
+}
+
+// GetIdentityKey returns the identity key of the account, which on a linked
+// device is the key of the device that linked it.
+func (c *Config) GetIdentityKey() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.device.Certificate != nil {
+		return c.device.Certificate.IdentityKey, nil
+	}
+
+	return c.rsaInstance.GetPublicKeyValue()
+}
+
+func (c *Config) SetCertificate(certificate *identity.DeviceCertificate) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	device := c.device
+	device.Certificate = certificate
+	if c.keystore != nil {
+		if err := c.keystore.SaveDevice(device); err != nil {
+			return err
+		}
+	}
+	c.device = device
+
+	return nil
+}
+
+func (c *Config) GetUserIDs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	userIDs := make([]string, 0, len(c.Contacts))
+	for userID := range c.Contacts {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	return userIDs
+}
+
+// GetAcceptedUserIDs lists the contacts the user accepted or verified, leaving
+// out those only trusted on first use.
+func (c *Config) GetAcceptedUserIDs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	userIDs := []string{}
+	for userID, contact := range c.Contacts {
+		if contact.State == TrustUnverified || contact.State == TrustVerified {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Strings(userIDs)
+
+	return userIDs
 }
 
 func (c *Config) RemovePublicKey(userID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	delete(c.PublicKeys, userID)
+	delete(c.Contacts, userID)
+	c.saveContacts()
+}
+
+func (c *Config) AddSymmetricKey(device identity.Device, symmetricKey []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.SymmetricKeys[device] = symmetricKey
+	c.saveConversations()
 }
 
-func (c *Config) AddSymmetricKey(userID string, symmetricKey []byte) {
+func (c *Config) GetSymmetricKey(device identity.Device) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.SymmetricKeys[device]
+}
+
+func (c *Config) RemoveSymmetricKey(device identity.Device) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.SymmetricKeys[userID] = symmetricKey
+	delete(c.SymmetricKeys, device)
+	c.saveConversations()
 }
 
-func (c *Config) GetSymmetricKey(userID string) []byte {
+func (c *Config) AddInboundKey(device identity.Device, symmetricKey []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.InboundKeys[device] = symmetricKey
+	c.saveConversations()
+}
 
+func (c *Config) GetInboundKey(device identity.Device) []byte {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return c.SymmetricKeys[userID]
+	return c.InboundKeys[device]
+}
+
+func (c *Config) RemoveInboundKey(device identity.Device) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.InboundKeys, device)
+	c.saveConversations()
 }
 
-func (c *Config) RemoveSymmetricKey(userID string) {
+func (c *Config) SetAuthMode(userID, mode string) {
 	c.mu.Lock()
-	defer c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.AuthModes[userID] = mode
+	c.saveConversations()
+}
+
+// dropSessions removes the sessions with every device of userID. The caller
+// must hold the lock.
+func (c *Config) dropSessions(userID string) {
+	for device := range c.SymmetricKeys {
+		if device.UserID == userID {
+			delete(c.SymmetricKeys, device)
+		}
+	}
+	for device := range c.InboundKeys {
+		if device.UserID == userID {
+			delete(c.InboundKeys, device)
+		}
+	}
+	c.saveConversations()
+}
+
+// GetAuthMode returns the authentication mode chosen for userID, empty when
+// none was chosen.
+func (c *Config) GetAuthMode(userID string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	delete(c.SymmetricKeys, userID)
+	return c.AuthModes[userID]
 }
@@ -0,0 +1,430 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+)
+
+type TrustState string
+
+const (
+	TrustUnverified TrustState = "unverified"
+	TrustTOFU       TrustState = "tofu"
+	TrustVerified   TrustState = "verified"
+	TrustRevoked    TrustState = "revoked"
+)
+
+type KeyStatus int
+
+const (
+	KeyUnchanged KeyStatus = iota
+	KeyNew
+	KeyChanged
+	KeyRevoked
+)
+
+const (
+	KeyEventFirstSeen = "first-seen"
+	KeyEventChanged   = "changed"
+	KeyEventAccepted  = "accepted"
+	KeyEventVerified  = "verified"
+	KeyEventRotated   = "rotated"
+	KeyEventRevoked   = "revoked"
+)
+
+type KeyRecord struct {
+	PublicKey []byte    `json:"publicKey"`
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+}
+
+type RevokedKey struct {
+	PublicKey []byte    `json:"publicKey"`
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+type Contact struct {
+	UserID     string       `json:"userID"`
+	PublicKey  []byte       `json:"publicKey"`
+	State      TrustState   `json:"state"`
+	PendingKey []byte       `json:"pendingKey,omitempty"`
+	History    []KeyRecord  `json:"history"`
+	Revoked    []RevokedKey `json:"revoked,omitempty"`
+	// Devices maps the device IDs of the contact to their keys. The device
+	// holding the identity key uses it as its device key.
+	Devices map[string][]byte `json:"devices,omitempty"`
+}
+
+func (c *Contact) HasPendingKey() bool {
+	return len(c.PendingKey) > 0
+}
+
+func (c *Contact) revocation(publicKey []byte) (RevokedKey, bool) {
+	for _, revoked := range c.Revoked {
+		if bytes.Equal(revoked.PublicKey, publicKey) {
+			return revoked, true
+		}
+	}
+
+	return RevokedKey{}, false
+}
+
+func (c *Contact) knowsKey(publicKey []byte) bool {
+	for _, record := range c.History {
+		if bytes.Equal(record.PublicKey, publicKey) {
+			return true
+		}
+	}
+
+	for _, deviceKey := range c.Devices {
+		if bytes.Equal(deviceKey, publicKey) {
+			return true
+		}
+	}
+
+	return bytes.Equal(c.PublicKey, publicKey) || bytes.Equal(c.PendingKey, publicKey)
+}
+
+func (c *Contact) record(publicKey []byte, event string) {
+	c.History = append(c.History, KeyRecord{PublicKey: publicKey, Event: event, Time: time.Now().UTC()})
+}
+
+func (c *Contact) copy() Contact {
+	contact := *c
+	contact.History = append([]KeyRecord(nil), c.History...)
+	contact.Revoked = append([]RevokedKey(nil), c.Revoked...)
+	contact.Devices = maps.Clone(c.Devices)
+
+	return contact
+}
+
+func decodeContacts(data []byte) (map[string]*Contact, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	contacts := map[string]*Contact{}
+	for userID, value := range raw {
+		// Keystores written before the contact book stored bare public keys.
+		var publicKey []byte
+		if err := json.Unmarshal(value, &publicKey); err == nil {
+			contact := &Contact{UserID: userID, PublicKey: publicKey, State: TrustTOFU}
+			contact.record(publicKey, KeyEventFirstSeen)
+			contacts[userID] = contact
+			continue
+		}
+
+		contact := &Contact{}
+		if err := json.Unmarshal(value, contact); err != nil {
+			return nil, fmt.Errorf("contact %s: %w", userID, err)
+		}
+		contacts[userID] = contact
+	}
+
+	return contacts, nil
+}
+
+// AddPublicKey trusts the first key seen for a contact. A different key is
+// only kept as pending until AcceptPendingKey is called.
+func (c *Config) AddPublicKey(userID string, publicKey []byte) KeyStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		contact = &Contact{UserID: userID, PublicKey: publicKey, State: TrustTOFU}
+		contact.record(publicKey, KeyEventFirstSeen)
+		c.Contacts[userID] = contact
+		c.saveContacts()
+		return KeyNew
+	}
+
+	if _, revoked := contact.revocation(publicKey); revoked {
+		return KeyRevoked
+	}
+
+	if bytes.Equal(contact.PublicKey, publicKey) {
+		return KeyUnchanged
+	}
+
+	if !bytes.Equal(contact.PendingKey, publicKey) {
+		contact.PendingKey = publicKey
+		contact.record(publicKey, KeyEventChanged)
+		c.saveContacts()
+	}
+
+	return KeyChanged
+}
+
+func (c *Config) GetPublicKey(userID string) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return nil
+	}
+
+	return contact.PublicKey
+}
+
+func (c *Config) GetContact(userID string) (Contact, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return Contact{}, false
+	}
+
+	return contact.copy(), true
+}
+
+func (c *Config) GetContacts() []Contact {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	contacts := make([]Contact, 0, len(c.Contacts))
+	for _, contact := range c.Contacts {
+		contacts = append(contacts, contact.copy())
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].UserID < contacts[j].UserID })
+
+	return contacts
+}
+
+func (c *Config) AcceptPendingKey(userID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok || !contact.HasPendingKey() {
+		return fmt.Errorf("no key change pending for %s", userID)
+	}
+
+	contact.PublicKey = contact.PendingKey
+	contact.PendingKey = nil
+	contact.State = TrustUnverified
+	contact.record(contact.PublicKey, KeyEventAccepted)
+	// The devices were certified by the old identity key.
+	contact.Devices = nil
+	c.saveContacts()
+	c.dropSessions(userID)
+
+	return nil
+}
+
+// AcceptContact accepts a contact trusted on first use without changing its
+// key.
+func (c *Config) AcceptContact(userID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return fmt.Errorf("unknown contact %s", userID)
+	}
+	switch contact.State {
+	case TrustTOFU:
+	case TrustRevoked:
+		return fmt.Errorf("the key of %s was revoked", userID)
+	default:
+		return fmt.Errorf("%s is already accepted", userID)
+	}
+
+	contact.State = TrustUnverified
+	contact.record(contact.PublicKey, KeyEventAccepted)
+	c.saveContacts()
+
+	return nil
+}
+
+func (c *Config) VerifyContact(userID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return fmt.Errorf("unknown contact %s", userID)
+	}
+	if contact.HasPendingKey() {
+		return fmt.Errorf("accept the new key of %s before verifying it", userID)
+	}
+	if _, revoked := contact.revocation(contact.PublicKey); revoked {
+		return fmt.Errorf("the key of %s was revoked", userID)
+	}
+
+	contact.State = TrustVerified
+	contact.record(contact.PublicKey, KeyEventVerified)
+	c.saveContacts()
+
+	return nil
+}
+
+// ApplyKeyRotation moves a contact from oldKey to newKey, keeping its trust
+// state. The caller must have verified the rotation statement. It reports
+// false when the rotation was already applied.
+func (c *Config) ApplyKeyRotation(userID string, oldKey, newKey []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return false, fmt.Errorf("unknown contact %s", userID)
+	}
+	if bytes.Equal(contact.PublicKey, newKey) {
+		return false, nil
+	}
+	if !bytes.Equal(contact.PublicKey, oldKey) {
+		return false, fmt.Errorf("rotation of %s does not start from its accepted key", userID)
+	}
+	if _, revoked := contact.revocation(oldKey); revoked {
+		return false, fmt.Errorf("rotation of %s is signed by a revoked key", userID)
+	}
+	if _, revoked := contact.revocation(newKey); revoked {
+		return false, fmt.Errorf("rotation of %s is to a revoked key", userID)
+	}
+
+	contact.PublicKey = newKey
+	if bytes.Equal(contact.PendingKey, newKey) {
+		contact.PendingKey = nil
+	}
+	for deviceID, deviceKey := range contact.Devices {
+		if bytes.Equal(deviceKey, oldKey) {
+			contact.Devices[deviceID] = newKey
+		}
+	}
+	contact.record(newKey, KeyEventRotated)
+	c.saveContacts()
+
+	// The sessions were signed by the old key, start new ones.
+	c.dropSessions(userID)
+
+	return true, nil
+}
+
+// RevokeKey marks a key the contact has used as revoked from the given time.
+// The caller must have verified the revocation certificate. It reports false
+// when the key was already revoked.
+func (c *Config) RevokeKey(userID string, publicKey []byte, at time.Time, reason string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok || !contact.knowsKey(publicKey) {
+		return false, fmt.Errorf("revoked key was never used by %s", userID)
+	}
+	if _, revoked := contact.revocation(publicKey); revoked {
+		return false, nil
+	}
+
+	contact.Revoked = append(contact.Revoked, RevokedKey{PublicKey: publicKey, Time: at.UTC(), Reason: reason})
+	contact.record(publicKey, KeyEventRevoked)
+	if bytes.Equal(contact.PendingKey, publicKey) {
+		contact.PendingKey = nil
+	}
+	// Nothing may be encrypted to the key anymore. Inbound sessions are kept
+	// so messages from it can still be read and flagged.
+	identity := bytes.Equal(contact.PublicKey, publicKey)
+	if identity {
+		contact.State = TrustRevoked
+	}
+	for device := range c.SymmetricKeys {
+		if device.UserID == userID && (identity || bytes.Equal(contact.Devices[device.DeviceID], publicKey)) {
+			delete(c.SymmetricKeys, device)
+		}
+	}
+	c.saveConversations()
+	c.saveContacts()
+
+	return true, nil
+}
+
+// RevokedAt reports when publicKey of the contact was revoked.
+func (c *Config) RevokedAt(userID string, publicKey []byte) (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return time.Time{}, false
+	}
+	revoked, ok := contact.revocation(publicKey)
+
+	return revoked.Time, ok
+}
+
+// AddDevice records a device of a contact. The caller must have checked that
+// deviceKey is the identity key or carries a certificate signed by it. It
+// reports whether the device is new or its key changed.
+func (c *Config) AddDevice(userID, deviceID string, deviceKey []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return false, fmt.Errorf("unknown contact %s", userID)
+	}
+	if _, revoked := contact.revocation(deviceKey); revoked {
+		return false, fmt.Errorf("device %s of %s uses a revoked key", deviceID, userID)
+	}
+	if bytes.Equal(contact.Devices[deviceID], deviceKey) {
+		return false, nil
+	}
+
+	if contact.Devices == nil {
+		contact.Devices = map[string][]byte{}
+	}
+	contact.Devices[deviceID] = deviceKey
+	c.saveContacts()
+
+	device := identity.Device{UserID: userID, DeviceID: deviceID}
+	delete(c.SymmetricKeys, device)
+	delete(c.InboundKeys, device)
+	c.saveConversations()
+
+	return true, nil
+}
+
+func (c *Config) GetDevices(userID string) map[string][]byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return nil
+	}
+
+	return maps.Clone(contact.Devices)
+}
+
+func (c *Config) GetDeviceKey(userID, deviceID string) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	contact, ok := c.Contacts[userID]
+	if !ok {
+		return nil
+	}
+
+	return contact.Devices[deviceID]
+}
+
+// HasPendingKey reports whether the key of userID changed and the new key was
+// not accepted yet.
+func (c *Config) HasPendingKey(userID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	contact, ok := c.Contacts[userID]
+
+	return ok && contact.HasPendingKey()
+}
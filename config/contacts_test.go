@@ -0,0 +1,262 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+)
+
+func TestContactBook(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keystore")
+	c, err := New(context.Background(), dir, testKeys)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	steps := []struct {
+		name        string
+		run         func() KeyStatus
+		wantStatus  KeyStatus
+		wantKey     string
+		wantState   TrustState
+		wantPending bool
+	}{
+		{
+			name:       "First key is trusted on first use",
+			run:        func() KeyStatus { return c.AddPublicKey("bob", []byte("key-1")) },
+			wantStatus: KeyNew,
+			wantKey:    "key-1",
+			wantState:  TrustTOFU,
+		},
+		{
+			name:       "Same key is unchanged",
+			run:        func() KeyStatus { return c.AddPublicKey("bob", []byte("key-1")) },
+			wantStatus: KeyUnchanged,
+			wantKey:    "key-1",
+			wantState:  TrustTOFU,
+		},
+		{
+			name:        "Different key is kept pending",
+			run:         func() KeyStatus { return c.AddPublicKey("bob", []byte("key-2")) },
+			wantStatus:  KeyChanged,
+			wantKey:     "key-1",
+			wantState:   TrustTOFU,
+			wantPending: true,
+		},
+		{
+			name: "Accepting replaces the key as unverified",
+			run: func() KeyStatus {
+				if err := c.AcceptPendingKey("bob"); err != nil {
+					t.Fatalf("AcceptPendingKey() error = %v", err)
+				}
+				return KeyUnchanged
+			},
+			wantKey:   "key-2",
+			wantState: TrustUnverified,
+		},
+		{
+			name: "Verifying marks the contact as verified",
+			run: func() KeyStatus {
+				if err := c.VerifyContact("bob"); err != nil {
+					t.Fatalf("VerifyContact() error = %v", err)
+				}
+				return KeyUnchanged
+			},
+			wantKey:   "key-2",
+			wantState: TrustVerified,
+		},
+	}
+	for _, tt := range steps {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.run(); got != tt.wantStatus {
+				t.Errorf("status = %v, want %v", got, tt.wantStatus)
+			}
+			contact, _ := c.GetContact("bob")
+			if string(contact.PublicKey) != tt.wantKey || contact.State != tt.wantState || contact.HasPendingKey() != tt.wantPending {
+				t.Errorf("contact = %+v", contact)
+			}
+			if c.HasPendingKey("bob") != tt.wantPending {
+				t.Errorf("HasPendingKey() = %v, want %v", c.HasPendingKey("bob"), tt.wantPending)
+			}
+		})
+	}
+
+	if err := c.AcceptPendingKey("bob"); err == nil {
+		t.Errorf("AcceptPendingKey() without a pending key should fail")
+	}
+
+	reloaded, err := New(context.Background(), dir, testKeys)
+	if err != nil {
+		t.Fatalf("New() reopen error = %v", err)
+	}
+	contact, _ := reloaded.GetContact("bob")
+	events := []string{}
+	for _, record := range contact.History {
+		events = append(events, record.Event)
+	}
+	want := []string{KeyEventFirstSeen, KeyEventChanged, KeyEventAccepted, KeyEventVerified}
+	if len(events) != len(want) {
+		t.Fatalf("history = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("history = %v, want %v", events, want)
+		}
+	}
+}
+
+func TestDecodeContactsMigratesBareKeys(t *testing.T) {
+	contacts, err := decodeContacts([]byte(`{"bob":"a2V5LTE="}`))
+	if err != nil {
+		t.Fatalf("decodeContacts() error = %v", err)
+	}
+	if string(contacts["bob"].PublicKey) != "key-1" || contacts["bob"].State != TrustTOFU {
+		t.Errorf("decodeContacts() = %+v", contacts["bob"])
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "alice")
+	alice, err := New(context.Background(), dir, testKeys)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	bob, err := New(context.Background(), "", testKeys)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	oldKey, _ := alice.GetRsaInstance().GetPublicKeyValue()
+	bob.AddPublicKey("alice", oldKey)
+	bob.VerifyContact("alice")
+	bob.AddSymmetricKey(identity.Device{UserID: "alice"}, []byte("outbound"))
+	bob.AddInboundKey(identity.Device{UserID: "alice"}, []byte("inbound"))
+
+	newKey, _ := testKeys.Get(context.Background())
+	rotation, err := alice.RotateIdentity("alice", newKey)
+	if err != nil {
+		t.Fatalf("RotateIdentity() error = %v", err)
+	}
+	if err := identity.VerifyKeyRotation(rotation); err != nil {
+		t.Fatalf("VerifyKeyRotation() error = %v", err)
+	}
+
+	applied, err := bob.ApplyKeyRotation("alice", rotation.OldPublicKey, rotation.NewPublicKey)
+	if err != nil || !applied {
+		t.Fatalf("ApplyKeyRotation() = %v, %v, want true", applied, err)
+	}
+	contact, _ := bob.GetContact("alice")
+	if !bytes.Equal(contact.PublicKey, rotation.NewPublicKey) || contact.State != TrustVerified {
+		t.Errorf("contact after rotation = %+v, want the new key still verified", contact)
+	}
+	if last := contact.History[len(contact.History)-1]; last.Event != KeyEventRotated {
+		t.Errorf("last key event = %s, want %s", last.Event, KeyEventRotated)
+	}
+	if bob.GetSymmetricKey(identity.Device{UserID: "alice"}) != nil || bob.GetInboundKey(identity.Device{UserID: "alice"}) != nil {
+		t.Errorf("sessions signed by the old key were kept")
+	}
+
+	if applied, err := bob.ApplyKeyRotation("alice", rotation.OldPublicKey, rotation.NewPublicKey); err != nil || applied {
+		t.Errorf("ApplyKeyRotation() again = %v, %v, want false", applied, err)
+	}
+	if _, err := bob.ApplyKeyRotation("alice", []byte("other"), []byte("another")); err == nil {
+		t.Errorf("ApplyKeyRotation() from a key that is not the accepted one should fail")
+	}
+
+	reloaded, err := New(context.Background(), dir, testKeys)
+	if err != nil {
+		t.Fatalf("New() reopen error = %v", err)
+	}
+	reloadedKey, _ := reloaded.GetRsaInstance().GetPublicKeyValue()
+	if !bytes.Equal(reloadedKey, rotation.NewPublicKey) {
+		t.Errorf("rotated identity was not saved")
+	}
+	if reloaded.GetRotation() == nil || !bytes.Equal(reloaded.GetRotation().NewSignature, rotation.NewSignature) {
+		t.Errorf("rotation statement was not saved")
+	}
+}
+
+func TestRevokeKey(t *testing.T) {
+	c, err := New(context.Background(), "", testKeys)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	c.AddPublicKey("bob", []byte("key-1"))
+	c.AddSymmetricKey(identity.Device{UserID: "bob"}, []byte("outbound"))
+	c.AddInboundKey(identity.Device{UserID: "bob"}, []byte("inbound"))
+
+	if _, err := c.RevokeKey("bob", []byte("never-seen"), time.Now(), ""); err == nil {
+		t.Errorf("RevokeKey() of a key bob never used should fail")
+	}
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if applied, err := c.RevokeKey("bob", []byte("key-1"), at, "stolen"); err != nil || !applied {
+		t.Fatalf("RevokeKey() = %v, %v, want true", applied, err)
+	}
+	if applied, _ := c.RevokeKey("bob", []byte("key-1"), at, "stolen"); applied {
+		t.Errorf("RevokeKey() applied the same revocation twice")
+	}
+
+	contact, _ := c.GetContact("bob")
+	if contact.State != TrustRevoked {
+		t.Errorf("State = %s, want %s", contact.State, TrustRevoked)
+	}
+	if got, revoked := c.RevokedAt("bob", []byte("key-1")); !revoked || !got.Equal(at) {
+		t.Errorf("RevokedAt() = %v, %v, want %v", got, revoked, at)
+	}
+	if c.GetSymmetricKey(identity.Device{UserID: "bob"}) != nil {
+		t.Errorf("outbound session to a revoked key was kept")
+	}
+	if c.GetInboundKey(identity.Device{UserID: "bob"}) == nil {
+		t.Errorf("inbound session was dropped, messages could not be flagged")
+	}
+	if status := c.AddPublicKey("bob", []byte("key-1")); status != KeyRevoked {
+		t.Errorf("AddPublicKey() of a revoked key = %v, want %v", status, KeyRevoked)
+	}
+	if err := c.VerifyContact("bob"); err == nil {
+		t.Errorf("VerifyContact() of a revoked key should fail")
+	}
+
+	if status := c.AddPublicKey("bob", []byte("key-2")); status != KeyChanged {
+		t.Errorf("AddPublicKey() of a new key = %v, want %v", status, KeyChanged)
+	}
+	if err := c.AcceptPendingKey("bob"); err != nil {
+		t.Fatalf("AcceptPendingKey() error = %v", err)
+	}
+	if _, revoked := c.RevokedAt("bob", []byte("key-2")); revoked {
+		t.Errorf("the new key of bob is reported as revoked")
+	}
+}
+
+func TestAcceptContact(t *testing.T) {
+	c, err := New(context.Background(), "", testKeys)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	c.AddPublicKey("bob", []byte("key-1"))
+	c.AddPublicKey("carol", []byte("key-2"))
+
+	if got := c.GetAcceptedUserIDs(); len(got) != 0 {
+		t.Errorf("GetAcceptedUserIDs() = %v, want none trusted on first use", got)
+	}
+	if err := c.AcceptContact("bob"); err != nil {
+		t.Fatalf("AcceptContact() error = %v", err)
+	}
+	if err := c.AcceptContact("bob"); err == nil {
+		t.Errorf("AcceptContact() of an accepted contact should fail")
+	}
+	if err := c.AcceptContact("dave"); err == nil {
+		t.Errorf("AcceptContact() of an unknown contact should fail")
+	}
+	if err := c.VerifyContact("carol"); err != nil {
+		t.Fatalf("VerifyContact() error = %v", err)
+	}
+	if got := c.GetAcceptedUserIDs(); !slices.Equal(got, []string{"bob", "carol"}) {
+		t.Errorf("GetAcceptedUserIDs() = %v, want [bob carol]", got)
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// parseTOML decodes a TOML document into its values keyed by their dotted
+// path, such as server.address. Arrays holding only strings become []string.
+func parseTOML(name string, data []byte) (map[string]interface{}, error) {
+	document := map[string]interface{}{}
+	if _, err := toml.Decode(string(data), &document); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	values := map[string]interface{}{}
+	flattenTOML("", document, values)
+
+	return values, nil
+}
+
+func flattenTOML(prefix string, table map[string]interface{}, values map[string]interface{}) {
+	for key, value := range table {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenTOML(key, v, values)
+		case []interface{}:
+			values[key] = stringArray(v)
+		default:
+			values[key] = v
+		}
+	}
+}
+
+// stringArray returns items as a []string when they are all strings, and
+// unchanged otherwise so the setting reports the wrong type.
+func stringArray(items []interface{}) interface{} {
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return items
+		}
+		strs = append(strs, s)
+	}
+
+	return strs
+}
+
+// formatTOMLValue writes value the way it would appear on the right of an
+// assignment in a TOML file.
+func formatTOMLValue(value interface{}) string {
+	var line strings.Builder
+	if err := toml.NewEncoder(&line).Encode(map[string]interface{}{"v": value}); err != nil {
+		return fmt.Sprint(value)
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(line.String(), "v = "), "\n")
+}
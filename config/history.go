@@ -0,0 +1,147 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is one message kept in the history file.
+type HistoryEntry struct {
+	Time       time.Time           `json:"time"`
+	MessageID  string              `json:"messageID,omitempty"`
+	SenderID   string              `json:"senderID"`
+	Content    string              `json:"content"`
+	Outgoing   bool                `json:"outgoing"`
+	ReplyTo    string              `json:"replyTo,omitempty"`
+	ThreadRoot string              `json:"threadRoot,omitempty"`
+	Edited     bool                `json:"edited,omitempty"`
+	Deleted    bool                `json:"deleted,omitempty"`
+	Reactions  map[string][]string `json:"reactions,omitempty"`
+}
+
+type History struct {
+	mu     sync.Mutex
+	path   string
+	closed bool
+}
+
+func OpenHistory(path string) *History {
+	return &History{path: path}
+}
+
+// Close makes every later write a no-op, so a history that is about to be
+// wiped cannot be created again by a message arriving afterwards. A write in
+// progress finishes first.
+func (h *History) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+}
+
+func (h *History) Append(entry HistoryEntry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+
+	return err
+}
+
+func (h *History) Load() ([]HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.load()
+}
+
+// Update applies update to the message messageID of senderID and rewrites
+// the history. It reports false when there is no such message.
+func (h *History) Update(senderID, messageID string, update func(*HistoryEntry)) (bool, error) {
+	return h.rewrite(func(entry *HistoryEntry) bool {
+		return messageID != "" && entry.MessageID == messageID && entry.SenderID == senderID
+	}, update)
+}
+
+// UpdateMessage is Update for the message messageID of any sender.
+func (h *History) UpdateMessage(messageID string, update func(*HistoryEntry)) (bool, error) {
+	return h.rewrite(func(entry *HistoryEntry) bool {
+		return messageID != "" && entry.MessageID == messageID
+	}, update)
+}
+
+func (h *History) rewrite(match func(*HistoryEntry) bool, update func(*HistoryEntry)) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false, nil
+	}
+	entries, err := h.load()
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	var data []byte
+	for i := range entries {
+		if match(&entries[i]) {
+			update(&entries[i])
+			found = true
+		}
+
+		line, err := json.Marshal(entries[i])
+		if err != nil {
+			return false, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if !found {
+		return false, nil
+	}
+
+	return true, writeFileAtomic(h.path, data)
+}
+
+func (h *History) load() ([]HistoryEntry, error) {
+	file, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []HistoryEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
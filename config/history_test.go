@@ -0,0 +1,44 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory_Update(t *testing.T) {
+	tests := []struct {
+		name      string
+		senderID  string
+		messageID string
+		wantFound bool
+		want      string
+	}{
+		{name: "Edits the message of the sender", senderID: "bob", messageID: "message-1", wantFound: true, want: "edited"},
+		{name: "Ignores another sender", senderID: "mallory", messageID: "message-1", want: "original"},
+		{name: "Ignores unknown messages", senderID: "bob", messageID: "message-2", want: "original"},
+		{name: "Ignores messages without ID", senderID: "alice", messageID: "", want: "original"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history := OpenHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+			history.Append(HistoryEntry{Time: time.Now(), MessageID: "message-1", SenderID: "bob", Content: "original"})
+			history.Append(HistoryEntry{Time: time.Now(), SenderID: "alice", Content: "no ID", Outgoing: true})
+
+			found, err := history.Update(tt.senderID, tt.messageID, func(entry *HistoryEntry) {
+				entry.Content, entry.Edited = "edited", true
+			})
+			if err != nil || found != tt.wantFound {
+				t.Fatalf("Update() = %v, %v, want %v", found, err, tt.wantFound)
+			}
+
+			entries, err := history.Load()
+			if err != nil || len(entries) != 2 {
+				t.Fatalf("Load() = %+v, %v, want 2 entries", entries, err)
+			}
+			if entries[0].Content != tt.want || entries[0].Edited != tt.wantFound || entries[1].Content != "no ID" {
+				t.Errorf("Load() = %+v, want the first entry to read %q", entries, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+const (
+	appName = "go-encrypted-chat"
+
+	identityFile      = "identity.pem"
+	contactsFile      = "contacts.json"
+	conversationsFile = "conversations.json"
+	rotationFile      = "rotation.json"
+	deviceFile        = "device.json"
+
+	dirPermissions  = 0o700
+	filePermissions = 0o600
+)
+
+type Keystore struct {
+	dir string
+}
+
+type deviceState struct {
+	DeviceID    string                      `json:"deviceID"`
+	Certificate *identity.DeviceCertificate `json:"certificate,omitempty"`
+}
+
+type conversationKeys struct {
+	SymmetricKeys map[identity.Device][]byte `json:"symmetricKeys"`
+	InboundKeys   map[identity.Device][]byte `json:"inboundKeys"`
+	AuthModes     map[string]string          `json:"authModes"`
+}
+
+func DataDir() (string, error) {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dataHome) {
+		return filepath.Join(dataHome, appName), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot locate the data directory: %w", err)
+	}
+
+	return filepath.Join(home, ".local", "share", appName), nil
+}
+
+func DefaultKeystoreDir(username string) (string, error) {
+	if err := validateName(username); err != nil {
+		return "", err
+	}
+
+	dataDir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dataDir, "keystores", username), nil
+}
+
+func OpenKeystore(dir string) (*Keystore, error) {
+	if err := os.MkdirAll(dir, dirPermissions); err != nil {
+		return nil, fmt.Errorf("error creating keystore: %w", err)
+	}
+	if err := os.Chmod(dir, dirPermissions); err != nil {
+		return nil, fmt.Errorf("error securing keystore: %w", err)
+	}
+
+	return &Keystore{dir: dir}, nil
+}
+
+func (k *Keystore) Dir() string {
+	return k.dir
+}
+
+func (k *Keystore) LoadIdentity() (*crypto.RSA, error) {
+	data, err := k.readFile(identityFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypto.ParseRSAPrivateKey(data)
+}
+
+func (k *Keystore) SaveIdentity(rsaInstance *crypto.RSA) error {
+	data, err := rsaInstance.MarshalPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(k.dir, identityFile), data)
+}
+
+func (k *Keystore) LoadContacts() (map[string]*Contact, error) {
+	data, err := k.readFile(contactsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]*Contact{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeContacts(data)
+}
+
+func (k *Keystore) SaveContacts(contacts map[string]*Contact) error {
+	return k.saveJSON(contactsFile, contacts)
+}
+
+func (k *Keystore) LoadConversations() (conversationKeys, error) {
+	conversations := conversationKeys{
+		SymmetricKeys: map[identity.Device][]byte{},
+		InboundKeys:   map[identity.Device][]byte{},
+		AuthModes:     map[string]string{},
+	}
+
+	err := k.loadJSON(conversationsFile, &conversations)
+
+	return conversations, err
+}
+
+func (k *Keystore) SaveConversations(conversations conversationKeys) error {
+	return k.saveJSON(conversationsFile, conversations)
+}
+
+func (k *Keystore) LoadRotation() (*identity.KeyRotation, error) {
+	var rotation *identity.KeyRotation
+	err := k.loadJSON(rotationFile, &rotation)
+
+	return rotation, err
+}
+
+func (k *Keystore) SaveRotation(rotation *identity.KeyRotation) error {
+	return k.saveJSON(rotationFile, rotation)
+}
+
+func (k *Keystore) LoadDevice() (deviceState, error) {
+	var device deviceState
+	err := k.loadJSON(deviceFile, &device)
+
+	return device, err
+}
+
+func (k *Keystore) SaveDevice(device deviceState) error {
+	return k.saveJSON(deviceFile, device)
+}
+
+func (k *Keystore) readFile(name string) ([]byte, error) {
+	path := filepath.Join(k.dir, name)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("%s is accessible by other users (mode %o), refusing to load it", path, info.Mode().Perm())
+	}
+
+	return os.ReadFile(path)
+}
+
+func (k *Keystore) loadJSON(name string, target interface{}) error {
+	data, err := k.readFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, target)
+}
+
+func (k *Keystore) saveJSON(name string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(k.dir, name), data)
+}
+
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(filePermissions); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+
+	return nil
+}
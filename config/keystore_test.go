@@ -0,0 +1,110 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+// Identities come from a shared pool so the tests do not wait on each key.
+var testKeys = crypto.NewKeyPool(DefaultRSABits, 4)
+
+func TestKeystore_Persistence(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keystore")
+
+	first, err := New(context.Background(), dir, testKeys)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	first.AddPublicKey("bob", []byte("bob public key"))
+	first.AddSymmetricKey(identity.Device{UserID: "bob", DeviceID: "phone"}, []byte("outbound"))
+	first.AddInboundKey(identity.Device{UserID: "bob"}, []byte("inbound"))
+	first.SetAuthMode("bob", "deniable")
+
+	second, err := New(context.Background(), dir, testKeys)
+	if err != nil {
+		t.Fatalf("New() reopen error = %v", err)
+	}
+
+	firstKey, _ := first.GetRsaInstance().GetPublicKeyValue()
+	secondKey, _ := second.GetRsaInstance().GetPublicKeyValue()
+	if !reflect.DeepEqual(firstKey, secondKey) {
+		t.Errorf("identity was not reloaded from the keystore")
+	}
+	if !reflect.DeepEqual(second.Contacts, first.Contacts) ||
+		!reflect.DeepEqual(second.SymmetricKeys, first.SymmetricKeys) ||
+		!reflect.DeepEqual(second.InboundKeys, first.InboundKeys) ||
+		!reflect.DeepEqual(second.AuthModes, first.AuthModes) {
+		t.Errorf("keys were not reloaded from the keystore")
+	}
+
+	info, _ := os.Stat(dir)
+	if info.Mode().Perm() != dirPermissions {
+		t.Errorf("keystore directory mode = %o, want %o", info.Mode().Perm(), dirPermissions)
+	}
+	for _, name := range []string{identityFile, contactsFile, conversationsFile} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s was not written: %v", name, err)
+		}
+		if info.Mode().Perm() != filePermissions {
+			t.Errorf("%s mode = %o, want %o", name, info.Mode().Perm(), filePermissions)
+		}
+	}
+}
+
+func TestKeystore_RejectsLoosePermissions(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := New(context.Background(), dir, testKeys); err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	os.Chmod(filepath.Join(dir, identityFile), 0o644)
+
+	if _, err := New(context.Background(), dir, testKeys); err == nil {
+		t.Errorf("New() loaded a world readable identity")
+	}
+}
+
+func TestDefaultKeystoreDir(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", "/data")
+
+	tests := []struct {
+		name     string
+		username string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "Uses XDG_DATA_HOME",
+			username: "alice",
+			want:     "/data/go-encrypted-chat/keystores/alice",
+		},
+		{
+			name:     "Rejects path traversal",
+			username: "../alice",
+			wantErr:  true,
+		},
+		{
+			name:     "Rejects empty username",
+			username: "",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DefaultKeystoreDir(tt.username)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DefaultKeystoreDir() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("DefaultKeystoreDir() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
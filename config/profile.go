@@ -0,0 +1,227 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	profileFile = "profile.toml"
+	historyFile = "history.jsonl"
+)
+
+type Profile struct {
+	Name      string
+	Username  string
+	ServerURL string
+	dir       string
+}
+
+func ProfilesDir() (string, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dataDir, "profiles"), nil
+}
+
+func ListProfiles() ([]*Profile, error) {
+	profilesDir, err := ProfilesDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(profilesDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := []*Profile{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		profile, err := LoadProfile(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+
+	return profiles, nil
+}
+
+func LoadProfile(name string) (*Profile, error) {
+	dir, err := profileDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, profileFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("profile %q does not exist", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := parseTOML(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{Name: name, dir: dir}
+	for key, value := range values {
+		text, ok := value.(string)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%s: %s: expected a string", path, key)
+		case key == "username":
+			profile.Username = text
+		case key == "server_url":
+			profile.ServerURL = text
+		default:
+			return nil, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+	}
+
+	if profile.Username == "" {
+		return nil, fmt.Errorf("%s: username is required", path)
+	}
+
+	return profile, nil
+}
+
+func CreateProfile(name, username, serverURL string) (*Profile, error) {
+	if username == "" {
+		return nil, fmt.Errorf("a username is required to create profile %q", name)
+	}
+	if serverURL != "" {
+		settings := DefaultSettings()
+		settings.Client.URL = serverURL
+		if err := settings.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := profileDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), dirPermissions); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, dirPermissions); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("profile %q already exists", name)
+		}
+		return nil, err
+	}
+
+	profile := &Profile{
+		Name:      name,
+		Username:  username,
+		ServerURL: serverURL,
+		dir:       dir,
+	}
+	if err := profile.save(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// CloneProfile copies the settings of an existing profile. Key material and
+// history are never copied, so the clone generates its own identity.
+func CloneProfile(source, name, username string) (*Profile, error) {
+	original, err := LoadProfile(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if username == "" {
+		username = original.Username
+	}
+
+	return CreateProfile(name, username, original.ServerURL)
+}
+
+func DeleteProfile(name string) error {
+	profile, err := LoadProfile(name)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(profile.dir)
+}
+
+func (p *Profile) Dir() string {
+	return p.dir
+}
+
+func (p *Profile) KeystoreDir() string {
+	return filepath.Join(p.dir, "keystore")
+}
+
+func (p *Profile) HistoryPath() string {
+	return filepath.Join(p.dir, historyFile)
+}
+
+func (p *Profile) save() error {
+	var content strings.Builder
+	fmt.Fprintf(&content, "username = %s\n", formatTOMLValue(p.Username))
+	if p.ServerURL != "" {
+		fmt.Fprintf(&content, "server_url = %s\n", formatTOMLValue(p.ServerURL))
+	}
+
+	return writeFileAtomic(filepath.Join(p.dir, profileFile), []byte(content.String()))
+}
+
+func profileDir(name string) (string, error) {
+	if err := validateName(name); err != nil {
+		return "", fmt.Errorf("invalid profile name: %w", err)
+	}
+	if strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid profile name %q", name)
+	}
+
+	profilesDir, err := ProfilesDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(profilesDir, name), nil
+}
+
+func (s *Settings) ApplyProfile(profile *Profile) error {
+	if source := s.sources["client.keystore"]; source != sourceDefault {
+		return fmt.Errorf("client.keystore is set from %s, but profile %q has its own keystore", source, profile.Name)
+	}
+	s.Client.Keystore = profile.KeystoreDir()
+	s.sources["client.keystore"] = sourceProfile
+
+	if s.sources["client.history"] == sourceDefault {
+		s.Client.History = profile.HistoryPath()
+		s.sources["client.history"] = sourceProfile
+	}
+
+	source := s.sources["client.url"]
+	if profile.ServerURL != "" && (source == sourceDefault || source == sourceFile) {
+		s.Client.URL = profile.ServerURL
+		s.sources["client.url"] = sourceProfile
+	}
+
+	return s.Validate()
+}
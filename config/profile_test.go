@@ -0,0 +1,78 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	work, err := CreateProfile("work", "alice", "wss://chat.example.com/ws")
+	if err != nil {
+		t.Fatalf("CreateProfile() error = %v", err)
+	}
+	if _, err := New(context.Background(), work.KeystoreDir(), testKeys); err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	clone, err := CloneProfile("work", "testing", "alice-test")
+	if err != nil {
+		t.Fatalf("CloneProfile() error = %v", err)
+	}
+	if clone.ServerURL != work.ServerURL || clone.Username != "alice-test" {
+		t.Errorf("CloneProfile() = %+v, want the source server with the new username", clone)
+	}
+	if _, err := os.Stat(filepath.Join(clone.KeystoreDir(), identityFile)); !os.IsNotExist(err) {
+		t.Errorf("CloneProfile() copied key material from the source profile")
+	}
+
+	tests := []struct {
+		name    string
+		create  func() error
+		wantErr bool
+	}{
+		{
+			name:    "Rejects an existing profile",
+			create:  func() error { _, err := CreateProfile("work", "bob", ""); return err },
+			wantErr: true,
+		},
+		{
+			name:    "Rejects a missing username",
+			create:  func() error { _, err := CreateProfile("empty", "", ""); return err },
+			wantErr: true,
+		},
+		{
+			name:    "Rejects path traversal",
+			create:  func() error { _, err := CreateProfile("../escape", "bob", ""); return err },
+			wantErr: true,
+		},
+		{
+			name:    "Rejects an invalid server URL",
+			create:  func() error { _, err := CreateProfile("web", "bob", "http://example.com"); return err },
+			wantErr: true,
+		},
+		{
+			name:    "Rejects cloning a missing profile",
+			create:  func() error { _, err := CloneProfile("missing", "copy", ""); return err },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.create(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := DeleteProfile("testing"); err != nil {
+		t.Fatalf("DeleteProfile() error = %v", err)
+	}
+	profiles, err := ListProfiles()
+	if err != nil || len(profiles) != 1 || profiles[0].Name != "work" {
+		t.Errorf("ListProfiles() = %v, %v, want only work", profiles, err)
+	}
+}
@@ -0,0 +1,546 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultRSABits = 2048
+
+	envPrefix = "GOCHAT_"
+
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+	sourceProfile = "profile"
+)
+
+type ServerSettings struct {
+	Address        string
+	RateLimit      int
+	RateBurst      int
+	BannedUsers    []string
+	BannedIPs      []string
+	AllowedOrigins []string
+	TLSCert        string
+	TLSKey         string
+}
+
+type ClientSettings struct {
+	URL          string
+	CharLimit    int
+	Keystore     string
+	History      string
+	PanicKey     string
+	Encoding     string
+	ReadReceipts bool
+	HideLastSeen bool
+	AwayAfter    int
+}
+
+type LogSettings struct {
+	Level string
+}
+
+type CryptoSettings struct {
+	RSABits int
+}
+
+type Settings struct {
+	Server  ServerSettings
+	Client  ClientSettings
+	Log     LogSettings
+	Crypto  CryptoSettings
+	path    string
+	sources map[string]string
+}
+
+type setting struct {
+	key   string
+	flag  string
+	usage string
+	ptr   func(*Settings) interface{}
+}
+
+var settingsTable = []setting{
+	{
+		key:   "server.address",
+		flag:  "addr",
+		usage: "Address the server listens on",
+		ptr:   func(s *Settings) interface{} { return &s.Server.Address },
+	},
+	{
+		key:   "server.rate_limit",
+		flag:  "rate-limit",
+		usage: "Messages per second accepted from each client, 0 disables the limit",
+		ptr:   func(s *Settings) interface{} { return &s.Server.RateLimit },
+	},
+	{
+		key:   "server.rate_burst",
+		flag:  "rate-burst",
+		usage: "Messages a client may send in a burst above the rate limit",
+		ptr:   func(s *Settings) interface{} { return &s.Server.RateBurst },
+	},
+	{
+		key:   "server.banned_users",
+		flag:  "banned-users",
+		usage: "Comma separated usernames refused by the server",
+		ptr:   func(s *Settings) interface{} { return &s.Server.BannedUsers },
+	},
+	{
+		key:   "server.banned_ips",
+		flag:  "banned-ips",
+		usage: "Comma separated client IP addresses refused by the server",
+		ptr:   func(s *Settings) interface{} { return &s.Server.BannedIPs },
+	},
+	{
+		key:   "server.allowed_origins",
+		flag:  "allowed-origins",
+		usage: "Comma separated Origin headers accepted by the server, empty allows any",
+		ptr:   func(s *Settings) interface{} { return &s.Server.AllowedOrigins },
+	},
+	{
+		key:   "server.tls_cert",
+		flag:  "tls-cert",
+		usage: "PEM certificate file, enables TLS together with -tls-key",
+		ptr:   func(s *Settings) interface{} { return &s.Server.TLSCert },
+	},
+	{
+		key:   "server.tls_key",
+		flag:  "tls-key",
+		usage: "PEM private key file for -tls-cert",
+		ptr:   func(s *Settings) interface{} { return &s.Server.TLSKey },
+	},
+	{
+		key:   "client.url",
+		flag:  "url",
+		usage: "WebSocket URL the client connects to",
+		ptr:   func(s *Settings) interface{} { return &s.Client.URL },
+	},
+	{
+		key:   "client.char_limit",
+		flag:  "char-limit",
+		usage: "Maximum number of characters per message",
+		ptr:   func(s *Settings) interface{} { return &s.Client.CharLimit },
+	},
+	{
+		key:   "client.keystore",
+		flag:  "keystore",
+		usage: "Keystore directory (default $XDG_DATA_HOME/go-encrypted-chat/keystores/<user>)",
+		ptr:   func(s *Settings) interface{} { return &s.Client.Keystore },
+	},
+	{
+		key:   "client.history",
+		flag:  "history",
+		usage: "File the message history is kept in (disabled when empty)",
+		ptr:   func(s *Settings) interface{} { return &s.Client.History },
+	},
+	{
+		key:   "client.panic_key",
+		flag:  "panic-key",
+		usage: "Key combination that wipes the account and exits, such as ctrl+x (disabled when empty)",
+		ptr:   func(s *Settings) interface{} { return &s.Client.PanicKey },
+	},
+	{
+		key:   "client.encoding",
+		flag:  "encoding",
+		usage: "Encoding asked for after connecting: json, or cbor for smaller binary frames",
+		ptr:   func(s *Settings) interface{} { return &s.Client.Encoding },
+	},
+	{
+		key:   "client.read_receipts",
+		flag:  "read-receipts",
+		usage: "Tell contacts when their messages were read, and show when yours were",
+		ptr:   func(s *Settings) interface{} { return &s.Client.ReadReceipts },
+	},
+	{
+		key:   "client.hide_last_seen",
+		flag:  "hide-last-seen",
+		usage: "Do not let contacts see when you were last online",
+		ptr:   func(s *Settings) interface{} { return &s.Client.HideLastSeen },
+	},
+	{
+		key:   "client.away_after",
+		flag:  "away-after",
+		usage: "Minutes without input before contacts see you as away, 0 disables",
+		ptr:   func(s *Settings) interface{} { return &s.Client.AwayAfter },
+	},
+	{
+		key:   "log.level",
+		flag:  "log-level",
+		usage: "Log level: DEBUG, INFO, WARN, ERROR or FATAL",
+		ptr:   func(s *Settings) interface{} { return &s.Log.Level },
+	},
+	{
+		key:   "crypto.rsa_bits",
+		flag:  "rsa-bits",
+		usage: "Size in bits of newly generated RSA identity keys",
+		ptr:   func(s *Settings) interface{} { return &s.Crypto.RSABits },
+	},
+}
+
+func DefaultSettings() *Settings {
+	settings := &Settings{
+		Server: ServerSettings{
+			Address:        ":8080",
+			RateLimit:      20,
+			RateBurst:      40,
+			BannedUsers:    []string{},
+			BannedIPs:      []string{},
+			AllowedOrigins: []string{},
+		},
+		Client: ClientSettings{
+			URL:          "ws://localhost:8080/ws",
+			CharLimit:    280,
+			Encoding:     "json",
+			ReadReceipts: true,
+			AwayAfter:    5,
+		},
+		Log: LogSettings{
+			Level: "INFO",
+		},
+		Crypto: CryptoSettings{
+			RSABits: DefaultRSABits,
+		},
+		sources: map[string]string{},
+	}
+	for _, s := range settingsTable {
+		settings.sources[s.key] = sourceDefault
+	}
+
+	return settings
+}
+
+func DefaultSettingsPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, appName, "config.toml"), nil
+}
+
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	return f.value
+}
+
+func (f *flagValue) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be set with a bare -flag.
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, s := range settingsTable {
+		_, isBool := s.ptr(&Settings{}).(*bool)
+		fs.Var(&flagValue{isBool: isBool}, s.flag, fmt.Sprintf("%s (%s)", s.usage, s.key))
+	}
+}
+
+// LoadSettings layers the defaults, the configuration file, GOCHAT_*
+// environment variables and the flags set on fs, in that order.
+func LoadSettings(path string, environ []string, fs *flag.FlagSet) (*Settings, error) {
+	settings := DefaultSettings()
+
+	explicit := path != ""
+	if !explicit {
+		defaultPath, err := DefaultSettingsPath()
+		if err == nil {
+			path = defaultPath
+		}
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := settings.applyFile(path, data); err != nil {
+				return nil, err
+			}
+			settings.path = path
+		case explicit || !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("error reading configuration file: %w", err)
+		}
+	}
+
+	if err := settings.applyEnv(environ); err != nil {
+		return nil, err
+	}
+
+	if fs != nil {
+		if err := settings.applyFlags(fs); err != nil {
+			return nil, err
+		}
+	}
+
+	return settings, settings.Validate()
+}
+
+func (s *Settings) applyFile(path string, data []byte) error {
+	values, err := parseTOML(path, data)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for key, value := range values {
+		entry, ok := lookupSetting(key)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, key))
+			continue
+		}
+		if err := entry.setValue(s, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, key, err))
+			continue
+		}
+		s.sources[key] = sourceFile
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Settings) applyEnv(environ []string) error {
+	var errs []error
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+
+		for _, entry := range settingsTable {
+			if entry.env() != name {
+				continue
+			}
+			if err := entry.setString(s, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			s.sources[entry.key] = sourceEnv
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Settings) applyFlags(fs *flag.FlagSet) error {
+	var errs []error
+	fs.Visit(func(f *flag.Flag) {
+		for _, entry := range settingsTable {
+			if entry.flag != f.Name {
+				continue
+			}
+			if err := entry.setString(s, f.Value.String()); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", f.Name, err))
+				continue
+			}
+			s.sources[entry.key] = sourceFlag
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+func (s *Settings) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(s.Server.Address); err != nil {
+		errs = append(errs, fmt.Errorf("server.address: %w", err))
+	}
+
+	if s.Server.RateLimit < 0 || s.Server.RateBurst < 0 {
+		errs = append(errs, fmt.Errorf("server.rate_limit and server.rate_burst must not be negative"))
+	}
+
+	for _, ip := range s.Server.BannedIPs {
+		if net.ParseIP(ip) == nil {
+			errs = append(errs, fmt.Errorf("server.banned_ips: invalid IP address %q", ip))
+		}
+	}
+
+	if (s.Server.TLSCert == "") != (s.Server.TLSKey == "") {
+		errs = append(errs, fmt.Errorf("server.tls_cert and server.tls_key must be set together"))
+	}
+
+	clientURL, err := url.Parse(s.Client.URL)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("client.url: %w", err))
+	} else if clientURL.Scheme != "ws" && clientURL.Scheme != "wss" {
+		errs = append(errs, fmt.Errorf("client.url: scheme must be ws or wss, got %q", clientURL.Scheme))
+	}
+
+	if s.Client.CharLimit <= 0 {
+		errs = append(errs, fmt.Errorf("client.char_limit: must be positive, got %d", s.Client.CharLimit))
+	}
+
+	if s.Client.PanicKey != "" && !strings.HasPrefix(s.Client.PanicKey, "ctrl+") && !strings.HasPrefix(s.Client.PanicKey, "alt+") {
+		errs = append(errs, fmt.Errorf("client.panic_key: must start with ctrl+ or alt+, got %q", s.Client.PanicKey))
+	}
+
+	if s.Client.AwayAfter < 0 {
+		errs = append(errs, fmt.Errorf("client.away_after: must not be negative, got %d", s.Client.AwayAfter))
+	}
+
+	switch s.Client.Encoding {
+	case "json", "cbor":
+	default:
+		errs = append(errs, fmt.Errorf("client.encoding: must be json or cbor, got %q", s.Client.Encoding))
+	}
+
+	switch s.Log.Level {
+	case "DEBUG", "INFO", "WARN", "ERROR", "FATAL":
+	default:
+		errs = append(errs, fmt.Errorf("log.level: unknown level %q", s.Log.Level))
+	}
+
+	switch s.Crypto.RSABits {
+	case 2048, 3072, 4096:
+	default:
+		errs = append(errs, fmt.Errorf("crypto.rsa_bits: must be 2048, 3072 or 4096, got %d", s.Crypto.RSABits))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Changed lists the keys whose effective value differs between s and other.
+func (s *Settings) Changed(other *Settings) []string {
+	changed := []string{}
+	for _, entry := range settingsTable {
+		if !reflect.DeepEqual(settingValue(entry.ptr(s)), settingValue(entry.ptr(other))) {
+			changed = append(changed, entry.key)
+		}
+	}
+
+	return changed
+}
+
+func (s *Settings) Path() string {
+	return s.path
+}
+
+func (s *Settings) Print(w io.Writer) {
+	if s.path != "" {
+		fmt.Fprintf(w, "# loaded from %s\n", s.path)
+	}
+
+	table := ""
+	for _, entry := range settingsTable {
+		section, key, _ := strings.Cut(entry.key, ".")
+		if section != table {
+			if table != "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "[%s]\n", section)
+			table = section
+		}
+
+		value := settingValue(entry.ptr(s))
+		fmt.Fprintf(w, "%s = %s # %s\n", key, formatTOMLValue(value), s.sources[entry.key])
+	}
+}
+
+func lookupSetting(key string) (setting, bool) {
+	for _, entry := range settingsTable {
+		if entry.key == key {
+			return entry, true
+		}
+	}
+
+	return setting{}, false
+}
+
+func (e setting) env() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(e.key, ".", "_"))
+}
+
+func (e setting) setValue(s *Settings, value interface{}) error {
+	switch ptr := e.ptr(s).(type) {
+	case *string:
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string")
+		}
+		*ptr = v
+	case *int:
+		v, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("expected an integer")
+		}
+		*ptr = int(v)
+	case *bool:
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("expected a boolean")
+		}
+		*ptr = v
+	case *[]string:
+		v, ok := value.([]string)
+		if !ok {
+			return fmt.Errorf("expected an array of strings")
+		}
+		*ptr = v
+	}
+
+	return nil
+}
+
+func (e setting) setString(s *Settings, raw string) error {
+	switch e.ptr(s).(type) {
+	case *int:
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", raw)
+		}
+		return e.setValue(s, v)
+	case *bool:
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", raw)
+		}
+		return e.setValue(s, v)
+	case *[]string:
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return e.setValue(s, items)
+	default:
+		return e.setValue(s, raw)
+	}
+}
+
+func settingValue(ptr interface{}) interface{} {
+	switch v := ptr.(type) {
+	case *string:
+		return *v
+	case *int:
+		return *v
+	case *bool:
+		return *v
+	case *[]string:
+		return *v
+	}
+
+	return nil
+}
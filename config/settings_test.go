@@ -0,0 +1,159 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "Parses tables, comments and value types",
+			data: "# comment\ntop = 'literal'\n[server]\naddress = \":9000\" # trailing\nenabled = true\n\n[limits]\nburst = 1_000\norigins = [\"a#b\", 'c']\n",
+			want: map[string]interface{}{
+				"top":            "literal",
+				"server.address": ":9000",
+				"server.enabled": true,
+				"limits.burst":   int64(1000),
+				"limits.origins": []string{"a#b", "c"},
+			},
+		},
+		{
+			name: "Parses multi-line arrays and strings",
+			data: "[server]\norigins = [\n  \"a\",\n  \"b\",\n]\nmotd = \"\"\"\nhello\"\"\"\n",
+			want: map[string]interface{}{
+				"server.origins": []string{"a", "b"},
+				"server.motd":    "hello",
+			},
+		},
+		{
+			name:    "Rejects duplicate keys",
+			data:    "a = 1\na = 2\n",
+			wantErr: true,
+		},
+		{
+			name:    "Rejects missing values",
+			data:    "a =\n",
+			wantErr: true,
+		},
+		{
+			name:    "Rejects unterminated strings",
+			data:    "a = \"open\n",
+			wantErr: true,
+		},
+		{
+			name:    "Rejects lines without assignment",
+			data:    "[server]\naddress\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML("test.toml", []byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseTOML() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte("[server]\naddress = \":9000\"\n[client]\nchar_limit = 500\n[log]\nlevel = \"WARN\"\n"), 0o600)
+
+	type args struct {
+		environ []string
+		flags   []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		check   func(*Settings) bool
+		wantErr bool
+	}{
+		{
+			name: "File overrides defaults",
+			check: func(s *Settings) bool {
+				return s.Server.Address == ":9000" && s.Client.CharLimit == 500 && s.Crypto.RSABits == DefaultRSABits
+			},
+		},
+		{
+			name: "Environment overrides file",
+			args: args{environ: []string{"GOCHAT_CLIENT_CHAR_LIMIT=100", "GOCHAT_LOG_LEVEL=DEBUG"}},
+			check: func(s *Settings) bool {
+				return s.Client.CharLimit == 100 && s.Log.Level == "DEBUG"
+			},
+		},
+		{
+			name: "Flags override environment",
+			args: args{environ: []string{"GOCHAT_LOG_LEVEL=DEBUG"}, flags: []string{"-log-level", "ERROR"}},
+			check: func(s *Settings) bool {
+				return s.Log.Level == "ERROR" && s.sources["log.level"] == sourceFlag
+			},
+		},
+		{
+			name:    "Returns error on malformed environment value",
+			args:    args{environ: []string{"GOCHAT_CRYPTO_RSA_BITS=many"}},
+			wantErr: true,
+		},
+		{
+			name:    "Returns error on invalid values",
+			args:    args{flags: []string{"-url", "http://localhost", "-rsa-bits", "1024"}},
+			wantErr: true,
+		},
+		{
+			name:    "Returns error on a panic key without modifier",
+			args:    args{flags: []string{"-panic-key", "x"}},
+			wantErr: true,
+		},
+		{
+			name: "Privacy flags override defaults",
+			args: args{flags: []string{"-read-receipts=false", "-hide-last-seen=true", "-away-after", "0"}},
+			check: func(s *Settings) bool {
+				return !s.Client.ReadReceipts && s.Client.HideLastSeen && s.Client.AwayAfter == 0
+			},
+		},
+		{
+			name: "Bare boolean flags enable the setting",
+			args: args{flags: []string{"-hide-last-seen", "-away-after", "0"}},
+			check: func(s *Settings) bool {
+				return s.Client.HideLastSeen && s.Client.AwayAfter == 0
+			},
+		},
+		{
+			name:    "Returns error on a negative away delay",
+			args:    args{environ: []string{"GOCHAT_CLIENT_AWAY_AFTER=-1"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			RegisterFlags(fs)
+			if err := fs.Parse(tt.args.flags); err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			got, err := LoadSettings(path, tt.args.environ, fs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadSettings() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !tt.check(got) {
+				t.Errorf("LoadSettings() = %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+)
+
+// Wipe overwrites every file of the keystore in keystoreDir and the history
+// file with random bytes before removing them. Journaling, copy-on-write and
+// flash storage may still keep old blocks around, so the overwrite is only as
+// good as the filesystem allows. Missing files are not an error.
+func Wipe(keystoreDir, historyPath string) error {
+	var errs []error
+
+	if keystoreDir != "" {
+		err := filepath.WalkDir(keystoreDir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					errs = append(errs, err)
+				}
+				return nil
+			}
+			if entry.Type().IsRegular() {
+				errs = append(errs, shred(path))
+			}
+			return nil
+		})
+		errs = append(errs, err)
+		if err := os.RemoveAll(keystoreDir); err != nil {
+			errs = append(errs, fmt.Errorf("error removing keystore: %w", err))
+		}
+	}
+
+	if historyPath != "" {
+		errs = append(errs, shred(historyPath))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Wipe destroys the keystore and history of c. Nothing is written to the
+// keystore afterwards.
+func (c *Config) Wipe(historyPath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keystoreDir := ""
+	if c.keystore != nil {
+		keystoreDir = c.keystore.Dir()
+		c.keystore = nil
+	}
+	c.Contacts = map[string]*Contact{}
+	c.SymmetricKeys = map[identity.Device][]byte{}
+	c.InboundKeys = map[identity.Device][]byte{}
+
+	return Wipe(keystoreDir, historyPath)
+}
+
+func shred(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error wiping %s: %w", path, err)
+	}
+
+	info, err := file.Stat()
+	if err == nil {
+		_, err = io.CopyN(file, rand.Reader, info.Size())
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error wiping %s: %w", path, err)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWipe(t *testing.T) {
+	dir := t.TempDir()
+	keystoreDir := filepath.Join(dir, "keystore")
+	cfg, err := New(context.Background(), keystoreDir, testKeys)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cfg.AddPublicKey("bob", []byte("bob public key"))
+
+	historyPath := filepath.Join(dir, "history.jsonl")
+	OpenHistory(historyPath).Append(HistoryEntry{Time: time.Now(), SenderID: "bob", Content: "meet at noon"})
+
+	// A second link to the history shows what is left on disk after the wipe.
+	linkPath := filepath.Join(dir, "history.link")
+	if err := os.Link(historyPath, linkPath); err != nil {
+		t.Skipf("hard links are not supported: %v", err)
+	}
+
+	if err := cfg.Wipe(historyPath); err != nil {
+		t.Fatalf("Wipe() error = %v", err)
+	}
+
+	for _, path := range []string{keystoreDir, historyPath} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still exists after the wipe", path)
+		}
+	}
+	left, err := os.ReadFile(linkPath)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if bytes.Contains(left, []byte("meet at noon")) {
+		t.Errorf("the history was not overwritten")
+	}
+
+	cfg.AddPublicKey("carol", []byte("carol public key"))
+	if _, err := os.Stat(keystoreDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the keystore was written again after the wipe")
+	}
+
+	if err := Wipe(keystoreDir, historyPath); err != nil {
+		t.Errorf("Wipe() of missing files error = %v", err)
+	}
+}
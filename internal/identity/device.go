@@ -0,0 +1,128 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+// DeviceAddress names one device of a user. It is only unambiguous for IDs
+// that passed ValidateDeviceAddress.
+func DeviceAddress(userID, deviceID string) string {
+	if deviceID == "" {
+		return userID
+	}
+
+	return userID + "/" + deviceID
+}
+
+// Device names one device of a user. Keys kept per device are indexed by it
+// rather than by its address, so no two devices can share an entry.
+type Device struct {
+	UserID   string
+	DeviceID string
+}
+
+func (d Device) String() string {
+	return DeviceAddress(d.UserID, d.DeviceID)
+}
+
+// MarshalText stores a device as its address, for JSON object keys.
+func (d Device) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Device) UnmarshalText(text []byte) error {
+	d.UserID, d.DeviceID, _ = strings.Cut(string(text), "/")
+
+	return nil
+}
+
+// ValidateUsername rejects usernames that could be mistaken for the address
+// of a device of another user.
+func ValidateUsername(userID string) error {
+	if userID == "" {
+		return fmt.Errorf("no username")
+	}
+	if strings.Contains(userID, "/") {
+		return fmt.Errorf("username %q contains a slash", userID)
+	}
+
+	return nil
+}
+
+// ValidateDeviceAddress checks the IDs of a device that keys are kept for.
+func ValidateDeviceAddress(userID, deviceID string) error {
+	if err := ValidateUsername(userID); err != nil {
+		return err
+	}
+	if deviceID == "" {
+		return fmt.Errorf("no device of %s", userID)
+	}
+	if strings.Contains(deviceID, "/") {
+		return fmt.Errorf("device ID %q of %s contains a slash", deviceID, userID)
+	}
+
+	return nil
+}
+
+// DeviceCertificate is issued by the device holding the identity key of a
+// user to every device it links, so contacts can trust the device key.
+type DeviceCertificate struct {
+	UserID      string    `json:"userID"`
+	DeviceID    string    `json:"deviceID"`
+	DeviceKey   []byte    `json:"deviceKey"`
+	IdentityKey []byte    `json:"identityKey"`
+	Time        time.Time `json:"time"`
+	Signature   []byte    `json:"signature"`
+}
+
+func (m *DeviceCertificate) SignedData() []byte {
+	data := []byte("go-encrypted-chat device certificate v1")
+	data = append(data, 0)
+	data = append(data, DeviceAddress(m.UserID, m.DeviceID)...)
+	data = append(data, 0)
+	data = append(data, m.Time.UTC().Format(time.RFC3339Nano)...)
+	data = append(data, 0)
+	data = appendLengthPrefixed(data, m.IdentityKey)
+
+	return append(data, m.DeviceKey...)
+}
+
+func SignDeviceCertificate(certificate *DeviceCertificate, key crypto.RSA) (err error) {
+	certificate.IdentityKey, err = key.GetPublicKeyValue()
+	if err != nil {
+		return
+	}
+	certificate.Signature, err = key.Sign(certificate.SignedData())
+
+	return
+}
+
+// VerifyDeviceCertificate checks that the certificate binds deviceKey to the
+// device of userID and returns the identity key that signed it.
+func VerifyDeviceCertificate(certificate *DeviceCertificate, userID, deviceID string, deviceKey []byte) ([]byte, error) {
+	if certificate.UserID != userID || certificate.DeviceID != deviceID || !bytes.Equal(certificate.DeviceKey, deviceKey) {
+		return nil, fmt.Errorf("certificate was issued for another device")
+	}
+
+	key, err := crypto.ParseRSAPublicKey(certificate.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key: %w", err)
+	}
+	if err := key.Verify(certificate.SignedData(), certificate.Signature); err != nil {
+		return nil, err
+	}
+
+	return certificate.IdentityKey, nil
+}
+
+func appendLengthPrefixed(data, value []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+
+	return append(data, value...)
+}
@@ -0,0 +1,78 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+// KeyRotation is the statement announcing a new identity key of a user.
+type KeyRotation struct {
+	UserID       string    `json:"userID"`
+	OldPublicKey []byte    `json:"oldPublicKey"`
+	NewPublicKey []byte    `json:"newPublicKey"`
+	Time         time.Time `json:"time"`
+	OldSignature []byte    `json:"oldSignature"`
+	NewSignature []byte    `json:"newSignature"`
+}
+
+func (m *KeyRotation) SignedData() []byte {
+	data := []byte("go-encrypted-chat key rotation v1")
+	data = append(data, 0)
+	data = append(data, m.UserID...)
+	data = append(data, 0)
+	data = append(data, m.Time.UTC().Format(time.RFC3339Nano)...)
+	data = append(data, 0)
+	data = appendLengthPrefixed(data, m.OldPublicKey)
+
+	return append(data, m.NewPublicKey...)
+}
+
+func (m *KeyRotation) Unmarshal(data []byte) error {
+	err := json.Unmarshal(data, &m)
+
+	return err
+}
+
+// SignKeyRotation signs the statement with both keys, so it proves the holder
+// of the old key chose the new one and the new key belongs to the same user.
+func SignKeyRotation(payload *KeyRotation, oldKey, newKey crypto.RSA) (err error) {
+	payload.OldPublicKey, err = oldKey.GetPublicKeyValue()
+	if err != nil {
+		return
+	}
+	payload.NewPublicKey, err = newKey.GetPublicKeyValue()
+	if err != nil {
+		return
+	}
+
+	payload.OldSignature, err = oldKey.Sign(payload.SignedData())
+	if err != nil {
+		return
+	}
+	payload.NewSignature, err = newKey.Sign(payload.SignedData())
+
+	return
+}
+
+func VerifyKeyRotation(payload *KeyRotation) error {
+	oldKey, err := crypto.ParseRSAPublicKey(payload.OldPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid old key: %w", err)
+	}
+	newKey, err := crypto.ParseRSAPublicKey(payload.NewPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid new key: %w", err)
+	}
+
+	if err := oldKey.Verify(payload.SignedData(), payload.OldSignature); err != nil {
+		return fmt.Errorf("old key signature: %w", err)
+	}
+	if err := newKey.Verify(payload.SignedData(), payload.NewSignature); err != nil {
+		return fmt.Errorf("new key signature: %w", err)
+	}
+
+	return nil
+}
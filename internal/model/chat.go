@@ -0,0 +1,49 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+)
+
+type StatusMessage struct {
+	Text string
+}
+
+type ConversationMessage struct {
+	UserID   string
+	AuthMode string
+	Trust    string
+}
+
+type KeyChangeMessage struct {
+	UserID         string
+	OldFingerprint string
+	NewFingerprint string
+}
+
+type KeyAcceptedMessage struct {
+	UserID string
+}
+
+type Command struct {
+	Name string
+	Args []string
+}
+
+func ParseCommand(input string) (Command, bool) {
+	if !strings.HasPrefix(input, "/") {
+		return Command{}, false
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(input, "/"))
+	if len(fields) == 0 {
+		return Command{}, false
+	}
+
+	return Command{Name: fields[0], Args: fields[1:]}, true
+}
+
+type HistoryMessage struct {
+	Entries []config.HistoryEntry
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Kinds of content carried encrypted inside text messages. The server only
+// sees ciphertext, so it cannot tell a receipt from a message.
+const (
+	ContentText     = "text"
+	ContentReceipt  = "receipt"
+	ContentRead     = "read"
+	ContentTyping   = "typing"
+	ContentStopped  = "stopped"
+	ContentEdit     = "edit"
+	ContentDelete   = "delete"
+	ContentReaction = "reaction"
+)
+
+// Content is the plaintext of every encrypted message. Target is the ID of
+// the message an edit, a deletion or a reaction applies to. A reply names
+// its parent and the first message of its thread.
+type Content struct {
+	Kind       string   `json:"kind"`
+	Text       string   `json:"text,omitempty"`
+	MessageIDs []string `json:"messageIDs,omitempty"`
+	Target     string   `json:"target,omitempty"`
+	Remove     bool     `json:"remove,omitempty"`
+	ReplyTo    string   `json:"replyTo,omitempty"`
+	ThreadRoot string   `json:"threadRoot,omitempty"`
+	Padding    string   `json:"padding,omitempty"`
+}
+
+// ContentBucket is the size every plaintext is padded to a multiple of, so
+// the length of a ciphertext does not give away short kinds like receipts.
+const ContentBucket = 256
+
+// paddingOverhead is the length of an empty "padding" member.
+var paddingOverhead = len(`,"padding":""`)
+
+func (c *Content) Marshal() (string, error) {
+	padded := *c
+	padded.Padding = ""
+	data, err := json.Marshal(padded)
+	if err != nil {
+		return "", err
+	}
+
+	size := len(data) + paddingOverhead
+	padded.Padding = strings.Repeat("0", ContentBucket-size%ContentBucket)
+	data, err = json.Marshal(padded)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func ParseContent(plaintext string) (Content, error) {
+	var content Content
+	if err := json.Unmarshal([]byte(plaintext), &content); err != nil {
+		return Content{}, fmt.Errorf("malformed content: %w", err)
+	}
+	if content.Kind == "" {
+		return Content{}, fmt.Errorf("malformed content: no kind")
+	}
+
+	return content, nil
+}
+
+// Delivery states of an outgoing message: handed to the connection, accepted
+// by the server, received and read by every recipient.
+const (
+	DeliverySent      = "sent"
+	DeliveryStored    = "stored"
+	DeliveryDelivered = "delivered"
+	DeliveryRead      = "read"
+	DeliveryFailed    = "failed"
+)
+
+// DeliveryStates lists the states a message goes through, in order.
+var DeliveryStates = []string{DeliverySent, DeliveryStored, DeliveryDelivered, DeliveryRead}
+
+type DeliveryMessage struct {
+	MessageID string
+	State     string
+}
+
+// ReadMessage reports messages of a device that were shown to the user.
+type ReadMessage struct {
+	UserID     string
+	DeviceID   string
+	MessageIDs []string
+}
+
+// TypingMessage reports that a contact started or stopped typing.
+type TypingMessage struct {
+	UserID string
+	Typing bool
+}
+
+// EditMessage changes or deletes a message. It goes from the view to the
+// client for messages of the user, and back for messages of contacts.
+type EditMessage struct {
+	UserID    string
+	MessageID string
+	Text      string
+	Deleted   bool
+}
+
+// MaxReactionLength bounds the bytes of a reaction, enough for any emoji
+// sequence.
+const MaxReactionLength = 32
+
+// ReactionMessage adds or removes the reaction of a user to a message.
+type ReactionMessage struct {
+	UserID    string
+	MessageID string
+	Emoji     string
+	Removed   bool
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContent_Marshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		content Content
+	}{
+		{name: "Receipt", content: Content{Kind: ContentReceipt, MessageIDs: []string{"message-1"}}},
+		{name: "Short text", content: Content{Kind: ContentText, Text: "hi"}},
+		{name: "Text longer than a bucket", content: Content{Kind: ContentText, Text: strings.Repeat("é", ContentBucket)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := tt.content.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if len(plaintext)%ContentBucket != 0 {
+				t.Errorf("len(Marshal()) = %d, want a multiple of %d", len(plaintext), ContentBucket)
+			}
+
+			got, err := ParseContent(plaintext)
+			if err != nil {
+				t.Fatalf("ParseContent() error = %v", err)
+			}
+			got.Padding = ""
+			if got.Kind != tt.content.Kind || got.Text != tt.content.Text || len(got.MessageIDs) != len(tt.content.MessageIDs) {
+				t.Errorf("ParseContent() = %+v, want %+v", got, tt.content)
+			}
+		})
+	}
+}
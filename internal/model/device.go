@@ -0,0 +1,65 @@
+package model
+
+import (
+	"encoding/json"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+)
+
+type DeviceLinkRequestPayload struct {
+	UserID    string `json:"userID"`
+	DeviceID  string `json:"deviceID"`
+	PublicKey []byte `json:"publicKey"`
+	Proof     []byte `json:"proof"`
+}
+
+func (m *DeviceLinkRequestPayload) ProofData() []byte {
+	data := []byte("go-encrypted-chat link request v1")
+	data = append(data, 0)
+	data = append(data, identity.DeviceAddress(m.UserID, m.DeviceID)...)
+	data = append(data, 0)
+
+	return append(data, m.PublicKey...)
+}
+
+func (m *DeviceLinkRequestPayload) Unmarshal(data []byte) error {
+	err := json.Unmarshal(data, &m)
+
+	return err
+}
+
+type DeviceLinkResponsePayload struct {
+	Certificate identity.DeviceCertificate `json:"certificate"`
+	Proof       []byte                     `json:"proof"`
+}
+
+func (m *DeviceLinkResponsePayload) ProofData() []byte {
+	data := []byte("go-encrypted-chat link response v1")
+	data = append(data, 0)
+
+	return append(data, m.Certificate.SignedData()...)
+}
+
+func (m *DeviceLinkResponsePayload) Unmarshal(data []byte) error {
+	err := json.Unmarshal(data, &m)
+
+	return err
+}
+
+type DeviceInfo struct {
+	DeviceID string `json:"deviceID"`
+}
+
+// DeviceListPayload lists the connected devices of a user. The server sends
+// it to the devices of the user and its contacts whenever one connects or
+// disconnects.
+type DeviceListPayload struct {
+	UserID  string       `json:"userID"`
+	Devices []DeviceInfo `json:"devices"`
+}
+
+func (m *DeviceListPayload) Unmarshal(data []byte) error {
+	err := json.Unmarshal(data, &m)
+
+	return err
+}
@@ -1,7 +1,9 @@
 package model
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"fmt"
 
 	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
 )
@@ -33,3 +35,103 @@ func DecryptRSA(ciphertext []byte, rsaInstance crypto.RSA) (plaintext []byte, er
 
 	return
 }
+
+func SealEnvelope(plaintext []byte, aesInstance crypto.AES, keyID uint32, sequence uint64) (envelope []byte, err error) {
+	cipherFactory := crypto.Encryptor{}
+	envelope, err = aesInstance.SealEnvelope(&cipherFactory, rand.Reader, keyID, sequence, plaintext)
+
+	return
+}
+
+func OpenEnvelope(data []byte, aesInstance crypto.AES) (envelope *crypto.Envelope, plaintext []byte, err error) {
+	cipherFactory := crypto.Encryptor{}
+	envelope, plaintext, err = aesInstance.OpenEnvelope(&cipherFactory, data)
+
+	return
+}
+
+const (
+	AuthModeSignature = "signature"
+	AuthModeDeniable  = "deniable"
+
+	deniableMACInfo = "go-encrypted-chat deniable mac v1"
+	deviceLinkInfo  = "go-encrypted-chat device link v1"
+)
+
+func IsValidAuthMode(mode string) bool {
+	return mode == AuthModeSignature || mode == AuthModeDeniable
+}
+
+func AuthenticateMessage(payload *TextMessagePayload, mode string, rsaInstance crypto.RSA, sessionKey []byte) (err error) {
+	payload.AuthMode = mode
+
+	switch mode {
+	case AuthModeSignature:
+		payload.Auth, err = rsaInstance.Sign(payload.AuthData())
+	case AuthModeDeniable:
+		var macKey []byte
+		macKey, err = crypto.DeriveKey(sessionKey, nil, deniableMACInfo, crypto.MACSize)
+		if err != nil {
+			return
+		}
+		payload.Auth = crypto.ComputeMAC(macKey, payload.AuthData())
+	default:
+		err = fmt.Errorf("unknown authentication mode %q", mode)
+	}
+
+	return
+}
+
+func VerifyMessage(payload *TextMessagePayload, senderKey crypto.RSA, sessionKey []byte) error {
+	switch payload.AuthMode {
+	case AuthModeSignature:
+		return senderKey.Verify(payload.AuthData(), payload.Auth)
+	case AuthModeDeniable:
+		macKey, err := crypto.DeriveKey(sessionKey, nil, deniableMACInfo, crypto.MACSize)
+		if err != nil {
+			return err
+		}
+		if !crypto.VerifyMAC(macKey, payload.AuthData(), payload.Auth) {
+			return fmt.Errorf("invalid message authentication code")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown authentication mode %q", payload.AuthMode)
+	}
+}
+
+func SignKeyRevocation(payload *KeyRevocationPayload, key crypto.RSA) (err error) {
+	payload.PublicKey, err = key.GetPublicKeyValue()
+	if err != nil {
+		return
+	}
+	payload.Signature, err = key.Sign(payload.SignedData())
+
+	return
+}
+
+func VerifyKeyRevocation(payload *KeyRevocationPayload) error {
+	key, err := crypto.ParseRSAPublicKey(payload.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid revoked key: %w", err)
+	}
+
+	return key.Verify(payload.SignedData(), payload.Signature)
+}
+
+// LinkProof authenticates a device link message with the one-time code, which
+// never goes through the server.
+func LinkProof(code string, data []byte) ([]byte, error) {
+	key, err := crypto.DeriveKey([]byte(code), nil, deviceLinkInfo, crypto.MACSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypto.ComputeMAC(key, data), nil
+}
+
+func VerifyLinkProof(code string, data, proof []byte) bool {
+	expected, err := LinkProof(code, data)
+
+	return err == nil && hmac.Equal(expected, proof)
+}
@@ -0,0 +1,126 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/pkg/cbor"
+)
+
+const cborNull = 0xf6
+
+var (
+	ErrUnknownMessageType = errors.New("unknown message type")
+	ErrMalformedMessage   = errors.New("malformed message")
+)
+
+// messageTypes maps every message type to a constructor of its payload, nil
+// for types without one.
+var messageTypes = map[string]func() interface{}{
+	UsernameMessageType:      func() interface{} { return &UsernamePayload{} },
+	TextMessageType:          func() interface{} { return &TextMessagePayload{} },
+	PublicKeyExchangeType:    func() interface{} { return &PublicKeyExchangePayload{} },
+	SymmetricKeyExchangeType: func() interface{} { return &SymmetricKeyExchangePayload{} },
+	KeyRotationType:          func() interface{} { return &identity.KeyRotation{} },
+	KeyRevocationType:        func() interface{} { return &KeyRevocationPayload{} },
+	DeviceLinkRequestType:    func() interface{} { return &DeviceLinkRequestPayload{} },
+	DeviceLinkResponseType:   func() interface{} { return &DeviceLinkResponsePayload{} },
+	DeviceListType:           func() interface{} { return &DeviceListPayload{} },
+	AccountWipeType:          nil,
+	AckType:                  nil,
+	PresenceUpdateType:       func() interface{} { return &PresenceUpdatePayload{} },
+	PresenceType:             func() interface{} { return &PresencePayload{} },
+	HelloType:                func() interface{} { return &HelloPayload{} },
+	WelcomeType:              func() interface{} { return &WelcomePayload{} },
+	ErrorType:                func() interface{} { return &ErrorPayload{} },
+}
+
+// Encodings of frames after the handshake. JSON travels in text frames and
+// CBOR in binary frames.
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+)
+
+// Envelope is a frame as read from the wire. The payload is kept raw, in the
+// encoding of the frame, until Decode, so frames are only decoded once and
+// only by whoever needs them.
+type Envelope struct {
+	Type     string
+	ID       string
+	Payload  []byte
+	Encoding string
+}
+
+// ParseEnvelope reads the envelope of a frame, failing on unknown types. A
+// CBOR frame starts with a map header, which no JSON document does.
+func ParseEnvelope(data []byte) (Envelope, error) {
+	var envelope Envelope
+	if len(data) > 0 && data[0]&0xe0 == 0xa0 {
+		var frame struct {
+			Type    string          `json:"type"`
+			ID      string          `json:"id"`
+			Payload cbor.RawMessage `json:"payload"`
+		}
+		if err := cbor.Unmarshal(data, &frame); err != nil {
+			return Envelope{}, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+		}
+		envelope = Envelope{Type: frame.Type, ID: frame.ID, Payload: frame.Payload, Encoding: EncodingCBOR}
+	} else {
+		var frame struct {
+			Type    string          `json:"type"`
+			ID      string          `json:"id"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := json.Unmarshal(data, &frame); err != nil {
+			return Envelope{}, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+		}
+		envelope = Envelope{Type: frame.Type, ID: frame.ID, Payload: frame.Payload, Encoding: EncodingJSON}
+	}
+
+	if _, ok := messageTypes[envelope.Type]; !ok {
+		return Envelope{}, fmt.Errorf("%w %q", ErrUnknownMessageType, envelope.Type)
+	}
+
+	return envelope, nil
+}
+
+// Decode returns a pointer to the payload type registered for the envelope,
+// or nil for types without a payload.
+func (e Envelope) Decode() (interface{}, error) {
+	newPayload, ok := messageTypes[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownMessageType, e.Type)
+	}
+	if newPayload == nil {
+		return nil, nil
+	}
+
+	payload := newPayload()
+	var err error
+	switch {
+	case len(e.Payload) == 0, string(e.Payload) == "null", e.Payload[0] == cborNull:
+		return nil, fmt.Errorf("%w: %s without payload", ErrMalformedMessage, e.Type)
+	case e.Encoding == EncodingCBOR:
+		err = cbor.Unmarshal(e.Payload, payload)
+	default:
+		err = json.Unmarshal(e.Payload, payload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrMalformedMessage, e.Type, err)
+	}
+
+	return payload, nil
+}
+
+// EncodeMessage encodes message for a connection speaking encoding, JSON when
+// it is empty.
+func EncodeMessage(encoding string, message WebsocketMessage) ([]byte, error) {
+	if encoding == EncodingCBOR {
+		return cbor.Marshal(message)
+	}
+
+	return json.Marshal(message)
+}
@@ -0,0 +1,146 @@
+package model
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+)
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    interface{}
+		wantErr error
+	}{
+		{
+			name: "Decodes the registered payload",
+			data: `{"type":"textMessage","payload":{"senderID":"alice"}}`,
+			want: &TextMessagePayload{SenderID: "alice"},
+		},
+		{
+			name: "Accepts types without payload",
+			data: `{"type":"accountWipe"}`,
+			want: nil,
+		},
+		{
+			name:    "Rejects unknown types",
+			data:    `{"type":"bogus","payload":{}}`,
+			wantErr: ErrUnknownMessageType,
+		},
+		{
+			name:    "Rejects frames that are not JSON",
+			data:    `hello`,
+			wantErr: ErrMalformedMessage,
+		},
+		{
+			name:    "Rejects missing payloads",
+			data:    `{"type":"textMessage"}`,
+			wantErr: ErrMalformedMessage,
+		},
+		{
+			name:    "Rejects payloads of the wrong shape",
+			data:    `{"type":"textMessage","payload":"hello"}`,
+			wantErr: ErrMalformedMessage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := ParseEnvelope([]byte(tt.data))
+			var got interface{}
+			if err == nil {
+				got, err = envelope.Decode()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// benchmarkMessage is a public key announcement, the largest frame sent on
+// every connect.
+var benchmarkMessage = WebsocketMessage{
+	Type: PublicKeyExchangeType,
+	Payload: PublicKeyExchangePayload{
+		PublicKey: bytes.Repeat([]byte{0x30, 0x82, 0x01, 0x22}, 74),
+		UserID:    "alice",
+		DeviceID:  "0a1b2c3d",
+		Certificate: &identity.DeviceCertificate{
+			UserID:      "alice",
+			DeviceID:    "0a1b2c3d",
+			DeviceKey:   bytes.Repeat([]byte{0x30}, 294),
+			IdentityKey: bytes.Repeat([]byte{0x31}, 294),
+			Time:        time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC),
+			Signature:   bytes.Repeat([]byte{0x7f}, 256),
+		},
+	},
+}
+
+func TestEncodeMessage(t *testing.T) {
+	for _, encoding := range []string{EncodingJSON, EncodingCBOR} {
+		t.Run(encoding, func(t *testing.T) {
+			data, err := EncodeMessage(encoding, benchmarkMessage)
+			if err != nil {
+				t.Fatalf("EncodeMessage() error = %v", err)
+			}
+			envelope, err := ParseEnvelope(data)
+			if err != nil {
+				t.Fatalf("ParseEnvelope() error = %v", err)
+			}
+			if envelope.Encoding != encoding {
+				t.Errorf("ParseEnvelope() encoding = %s, want %s", envelope.Encoding, encoding)
+			}
+			payload, err := envelope.Decode()
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			want := benchmarkMessage.Payload.(PublicKeyExchangePayload)
+			if !reflect.DeepEqual(*payload.(*PublicKeyExchangePayload), want) {
+				t.Errorf("Decode() = %+v, want %+v", payload, want)
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	for _, encoding := range []string{EncodingJSON, EncodingCBOR} {
+		b.Run(encoding, func(b *testing.B) {
+			var data []byte
+			for i := 0; i < b.N; i++ {
+				data, _ = EncodeMessage(encoding, benchmarkMessage)
+			}
+			b.ReportMetric(float64(len(data)), "frame-bytes")
+		})
+	}
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	for _, encoding := range []string{EncodingJSON, EncodingCBOR} {
+		b.Run(encoding, func(b *testing.B) {
+			data, _ := EncodeMessage(encoding, benchmarkMessage)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				envelope, err := ParseEnvelope(data)
+				if err == nil {
+					_, err = envelope.Decode()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "frame-bytes")
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package model
+
+import "fmt"
+
+// Codes of the errors sent by the server. The first three refuse a
+// handshake, the others a single frame.
+const (
+	ErrorCodeVersionMismatch  = "version_mismatch"
+	ErrorCodeUnsupportedSuite = "unsupported_suite"
+	ErrorCodeBadHandshake     = "bad_handshake"
+	ErrorCodeBanned           = "banned"
+	ErrorCodeMalformedFrame   = "malformed_frame"
+	ErrorCodeUnknownType      = "unknown_type"
+	ErrorCodeForbiddenFrame   = "forbidden_frame"
+	ErrorCodeInvalidFrame     = "invalid_frame"
+	ErrorCodeUnknownRecipient = "unknown_recipient"
+	ErrorCodeRateLimited      = "rate_limited"
+)
+
+// ErrorPayload is sent instead of a frame the server cannot accept. The
+// correlation ID is the ID of the frame it answers, or one made up by the
+// server and logged with the problem. RecipientID names the user a refused
+// copy was addressed to, when the refusal is only about that user.
+type ErrorPayload struct {
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+	CorrelationID string `json:"correlationID,omitempty"`
+	RecipientID   string `json:"recipientID,omitempty"`
+}
+
+func (e *ErrorPayload) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
@@ -0,0 +1,107 @@
+package model
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+)
+
+// Protocol versions spoken by this build. Clients announcing a range that
+// does not overlap are refused.
+// Version 2 encrypts a Content instead of bare text.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+)
+
+// Optional features negotiated in the hello/welcome exchange. Either side
+// only uses a feature when the welcome lists it.
+const (
+	FeatureReceipts    = "receipts"
+	FeatureCompression = "compression"
+	FeaturePresence    = "presence"
+)
+
+// SuiteRSAAESGCM is the end-to-end suite: RSA-OAEP key transport, RSA-PSS
+// signatures and AES-256-GCM messages.
+const SuiteRSAAESGCM = "rsa-oaep-sha256+aes-256-gcm"
+
+// HelloPayload is the first frame of every client.
+type HelloPayload struct {
+	Username   string   `json:"username"`
+	DeviceID   string   `json:"deviceID,omitempty"`
+	MinVersion int      `json:"minVersion"`
+	MaxVersion int      `json:"maxVersion"`
+	Features   []string `json:"features"`
+	Suites     []string `json:"suites"`
+	Encodings  []string `json:"encodings,omitempty"`
+}
+
+// WelcomePayload answers a hello with what both sides support.
+type WelcomePayload struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+	Suite    string   `json:"suite"`
+	Encoding string   `json:"encoding,omitempty"`
+}
+
+func (m *WelcomePayload) Has(feature string) bool {
+	return slices.Contains(m.Features, feature)
+}
+
+// Negotiate picks the highest version both sides speak, the first suite and
+// encoding of the client that are in suites and encodings, and the features
+// both support. Clients that list no encoding speak JSON. The error is an
+// *ErrorPayload ready to be sent back.
+func (m *HelloPayload) Negotiate(features, suites, encodings []string) (WelcomePayload, error) {
+	if m.Username == "" {
+		return WelcomePayload{}, &ErrorPayload{Code: ErrorCodeBadHandshake, Message: "the hello names no user"}
+	}
+	// Tools connect without a device, clients always name theirs.
+	if err := identity.ValidateUsername(m.Username); err != nil {
+		return WelcomePayload{}, &ErrorPayload{Code: ErrorCodeBadHandshake, Message: err.Error()}
+	}
+	if m.DeviceID != "" {
+		if err := identity.ValidateDeviceAddress(m.Username, m.DeviceID); err != nil {
+			return WelcomePayload{}, &ErrorPayload{Code: ErrorCodeBadHandshake, Message: err.Error()}
+		}
+	}
+
+	version := min(m.MaxVersion, ProtocolVersion)
+	if version < max(m.MinVersion, MinProtocolVersion) {
+		return WelcomePayload{}, &ErrorPayload{
+			Code:    ErrorCodeVersionMismatch,
+			Message: fmt.Sprintf("the client speaks versions %d to %d, the server %d to %d", m.MinVersion, m.MaxVersion, MinProtocolVersion, ProtocolVersion),
+		}
+	}
+
+	welcome := WelcomePayload{Version: version, Features: []string{}, Encoding: EncodingJSON}
+	for _, encoding := range m.Encodings {
+		if slices.Contains(encodings, encoding) {
+			welcome.Encoding = encoding
+			break
+		}
+	}
+
+	for _, suite := range m.Suites {
+		if slices.Contains(suites, suite) {
+			welcome.Suite = suite
+			break
+		}
+	}
+	if welcome.Suite == "" {
+		return WelcomePayload{}, &ErrorPayload{
+			Code:    ErrorCodeUnsupportedSuite,
+			Message: fmt.Sprintf("no common suite, the server supports %v", suites),
+		}
+	}
+
+	for _, feature := range m.Features {
+		if slices.Contains(features, feature) && !slices.Contains(welcome.Features, feature) {
+			welcome.Features = append(welcome.Features, feature)
+		}
+	}
+
+	return welcome, nil
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestHelloPayload_Negotiate(t *testing.T) {
+	features := []string{FeatureCompression}
+	suites := []string{SuiteRSAAESGCM}
+	encodings := []string{EncodingCBOR, EncodingJSON}
+
+	tests := []struct {
+		name     string
+		hello    HelloPayload
+		want     WelcomePayload
+		wantCode string
+	}{
+		{
+			name:  "Keeps the common features",
+			hello: HelloPayload{Username: "alice", MinVersion: ProtocolVersion, MaxVersion: ProtocolVersion, Features: []string{"typing", FeatureCompression}, Suites: suites},
+			want:  WelcomePayload{Version: ProtocolVersion, Features: []string{FeatureCompression}, Suite: SuiteRSAAESGCM, Encoding: EncodingJSON},
+		},
+		{
+			name:  "Picks the highest common version",
+			hello: HelloPayload{Username: "alice", MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion + 3, Suites: []string{"future", SuiteRSAAESGCM}},
+			want:  WelcomePayload{Version: ProtocolVersion, Features: []string{}, Suite: SuiteRSAAESGCM, Encoding: EncodingJSON},
+		},
+		{
+			name:  "Picks the first common encoding of the client",
+			hello: HelloPayload{Username: "alice", MinVersion: ProtocolVersion, MaxVersion: ProtocolVersion, Suites: suites, Encodings: []string{"msgpack", EncodingCBOR, EncodingJSON}},
+			want:  WelcomePayload{Version: ProtocolVersion, Features: []string{}, Suite: SuiteRSAAESGCM, Encoding: EncodingCBOR},
+		},
+		{
+			name:     "Rejects newer clients",
+			hello:    HelloPayload{Username: "alice", MinVersion: ProtocolVersion + 1, MaxVersion: ProtocolVersion + 2, Suites: suites},
+			wantCode: ErrorCodeVersionMismatch,
+		},
+		{
+			name:     "Rejects clients without a common suite",
+			hello:    HelloPayload{Username: "alice", MinVersion: ProtocolVersion, MaxVersion: ProtocolVersion, Suites: []string{"rot13"}},
+			wantCode: ErrorCodeUnsupportedSuite,
+		},
+		{
+			name:     "Rejects anonymous hellos",
+			hello:    HelloPayload{MinVersion: ProtocolVersion, MaxVersion: ProtocolVersion, Suites: suites},
+			wantCode: ErrorCodeBadHandshake,
+		},
+		{
+			name:     "Rejects usernames that look like a device address",
+			hello:    HelloPayload{Username: "alice/dev1", MinVersion: ProtocolVersion, MaxVersion: ProtocolVersion, Suites: suites},
+			wantCode: ErrorCodeBadHandshake,
+		},
+		{
+			name:     "Rejects device IDs with a slash",
+			hello:    HelloPayload{Username: "alice", DeviceID: "dev1/x", MinVersion: ProtocolVersion, MaxVersion: ProtocolVersion, Suites: suites},
+			wantCode: ErrorCodeBadHandshake,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.hello.Negotiate(features, suites, encodings)
+			if tt.wantCode != "" {
+				var refusal *ErrorPayload
+				if !errors.As(err, &refusal) || refusal.Code != tt.wantCode {
+					t.Errorf("Negotiate() error = %v, want code %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Negotiate() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Negotiate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,38 @@
 package model
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+)
+
+const (
+	UsernameMessageType      = "usernameMessage"
+	TextMessageType          = "textMessage"
+	PublicKeyExchangeType    = "publicKeyExchange"
+	SymmetricKeyExchangeType = "symmetricKeyExchange"
+	KeyRotationType          = "keyRotation"
+	KeyRevocationType        = "keyRevocation"
+	DeviceLinkRequestType    = "deviceLinkRequest"
+	DeviceLinkResponseType   = "deviceLinkResponse"
+	DeviceListType           = "deviceList"
+	AccountWipeType          = "accountWipe"
+	HelloType                = "hello"
+	WelcomeType              = "welcome"
+	ErrorType                = "error"
+	AckType                  = "ack"
+	PresenceUpdateType       = "presenceUpdate"
+	PresenceType             = "presence"
 )
 
+// WebsocketMessage is a frame as sent. ID is chosen by the sender of a frame
+// that expects an answer, such as the ack of the server.
 type WebsocketMessage struct {
 	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
 	Payload interface{} `json:"payload"`
 }
 
@@ -26,9 +52,11 @@ func (m *WebsocketMessage) Unmarshal(data []byte) error {
 }
 
 type PublicKeyExchangePayload struct {
-	PublicKey      []byte `json:"publicKey"`
-	NeedsPublicKey bool   `json:"needPublicKey"`
-	UserID         string `json:"userID"`
+	PublicKey      []byte                      `json:"publicKey"`
+	NeedsPublicKey bool                        `json:"needPublicKey"`
+	UserID         string                      `json:"userID"`
+	DeviceID       string                      `json:"deviceID"`
+	Certificate    *identity.DeviceCertificate `json:"certificate,omitempty"`
 }
 
 func (m *PublicKeyExchangePayload) Unmarshal(data []byte) error {
@@ -37,10 +65,103 @@ func (m *PublicKeyExchangePayload) Unmarshal(data []byte) error {
 	return err
 }
 
+type SymmetricKeyExchangePayload struct {
+	SenderID        string `json:"senderID"`
+	SenderDevice    string `json:"senderDevice"`
+	RecipientID     string `json:"recipientID"`
+	RecipientDevice string `json:"recipientDevice"`
+	EncryptedKey    []byte `json:"encryptedKey"`
+	Signature       []byte `json:"signature"`
+}
+
+func (m *SymmetricKeyExchangePayload) SignedData() []byte {
+	data := []byte(identity.DeviceAddress(m.SenderID, m.SenderDevice))
+	data = append(data, 0)
+	data = append(data, identity.DeviceAddress(m.RecipientID, m.RecipientDevice)...)
+	data = append(data, 0)
+
+	return append(data, m.EncryptedKey...)
+}
+
+func (m *SymmetricKeyExchangePayload) Unmarshal(data []byte) error {
+	err := json.Unmarshal(data, &m)
+
+	return err
+}
+
+// KeyRevocationPayload is signed by the revoked key itself, so it can be
+// generated in advance and kept offline. A zero Time makes the revocation
+// effective when the server publishes it.
+type KeyRevocationPayload struct {
+	UserID      string    `json:"userID"`
+	PublicKey   []byte    `json:"publicKey"`
+	Time        time.Time `json:"time"`
+	Reason      string    `json:"reason,omitempty"`
+	Signature   []byte    `json:"signature"`
+	PublishedAt time.Time `json:"publishedAt"`
+}
+
+func (m *KeyRevocationPayload) SignedData() []byte {
+	data := []byte("go-encrypted-chat key revocation v1")
+	data = append(data, 0)
+	data = append(data, m.UserID...)
+	data = append(data, 0)
+	if !m.Time.IsZero() {
+		data = append(data, m.Time.UTC().Format(time.RFC3339Nano)...)
+	}
+	data = append(data, 0)
+	data = append(data, m.Reason...)
+	data = append(data, 0)
+
+	return append(data, m.PublicKey...)
+}
+
+// EffectiveTime is when the key stopped being valid.
+func (m *KeyRevocationPayload) EffectiveTime() time.Time {
+	if m.Time.IsZero() {
+		return m.PublishedAt
+	}
+
+	return m.Time
+}
+
+func (m *KeyRevocationPayload) Unmarshal(data []byte) error {
+	err := json.Unmarshal(data, &m)
+
+	return err
+}
+
+// TextMessagePayload carries an encrypted Content. Content, ReplyTo and
+// ThreadRoot are only filled in locally, on the wire they are encrypted.
 type TextMessagePayload struct {
-	Content  string `json:"content"`
-	SenderID string `json:"senderID"`
-	GroupID  string `json:"groupID"`
+	MessageID       string    `json:"messageID"`
+	Content         string    `json:"content,omitempty"`
+	ReplyTo         string    `json:"replyTo,omitempty"`
+	ThreadRoot      string    `json:"threadRoot,omitempty"`
+	SenderID        string    `json:"senderID"`
+	SenderDevice    string    `json:"senderDevice,omitempty"`
+	RecipientID     string    `json:"recipientID,omitempty"`
+	RecipientDevice string    `json:"recipientDevice,omitempty"`
+	GroupID         string    `json:"groupID"`
+	SentAt          time.Time `json:"sentAt"`
+	Ciphertext      []byte    `json:"ciphertext,omitempty"`
+	AuthMode        string    `json:"authMode,omitempty"`
+	Auth            []byte    `json:"auth,omitempty"`
+}
+
+func (m *TextMessagePayload) AuthData() []byte {
+	data := []byte(m.MessageID)
+	data = append(data, 0)
+	data = append(data, identity.DeviceAddress(m.SenderID, m.SenderDevice)...)
+	data = append(data, 0)
+	data = append(data, identity.DeviceAddress(m.RecipientID, m.RecipientDevice)...)
+	data = append(data, 0)
+	data = append(data, m.AuthMode...)
+	data = append(data, 0)
+	data = append(data, m.SentAt.UTC().Format(time.RFC3339Nano)...)
+	data = append(data, 0)
+
+	return append(data, m.Ciphertext...)
 }
 
 func (m *TextMessagePayload) Marshal() ([]byte, error) {
@@ -60,6 +181,7 @@ func (m *TextMessagePayload) Unmarshal(data []byte) error {
 
 type UsernamePayload struct {
 	Username string `json:"Username"`
+	DeviceID string `json:"deviceID,omitempty"`
 }
 
 func (m *UsernamePayload) Unmarshal(data []byte) error {
@@ -70,8 +192,15 @@ func (m *UsernamePayload) Unmarshal(data []byte) error {
 
 type IncomingMessage struct {
 	Message TextMessagePayload
+	Warning string
 }
 
 func (m IncomingMessage) String() string {
 	return fmt.Sprintf("%s: %s", m.Message.SenderID, m.Message.Content)
 }
+
+func appendLengthPrefixed(data, value []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+
+	return append(data, value...)
+}
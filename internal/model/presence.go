@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// Presence states of a user. Clients only announce online and away, the
+// server knows when the last device of a user goes offline.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// PresenceUpdatePayload is sent by a client to the server, which pushes the
+// presence of the user to the listed contacts only.
+type PresenceUpdatePayload struct {
+	State        string   `json:"state"`
+	Contacts     []string `json:"contacts"`
+	HideLastSeen bool     `json:"hideLastSeen,omitempty"`
+}
+
+// PresencePayload tells a contact the presence of a user. LastSeen is only
+// set for offline users that do not hide it.
+type PresencePayload struct {
+	UserID   string     `json:"userID"`
+	State    string     `json:"state"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+type PresenceMessage struct {
+	UserID   string
+	State    string
+	LastSeen time.Time
+}
@@ -9,6 +9,7 @@ import (
 type User struct {
 	ID       string
 	Username string
+	DeviceID string
 }
 
 func NewUser(userID, username string) (*User, error) {
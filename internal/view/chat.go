@@ -2,41 +2,116 @@ package view
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
 	"github.com/osmancadc/go-encrypted-chat/internal/model"
 )
 
 const gap = "\n\n"
 
+// defaultReaction is used when ctrl+r is pressed with an empty input.
+const defaultReaction = "👍"
+
+// quoteLength is the number of characters of a parent quoted above a reply.
+const quoteLength = 40
+
+// Typing signals are repeated every typingInterval while the user types, and
+// a stop is sent after typingIdle without keystrokes. Contacts drop a typing
+// indicator that was not refreshed within typingTimeout.
+const (
+	typingInterval = 3 * time.Second
+	typingIdle     = 5 * time.Second
+	typingTimeout  = 6 * time.Second
+)
+
 type (
 	errMsg error
+
+	typingIdleMsg struct {
+		keystrokes int
+	}
+	typingExpiredMsg struct{}
+
+	awayMsg struct {
+		activity int
+	}
 )
 
+// chatLine is a message in the viewport. Outgoing lines carry the ID and the
+// delivery state of the message, incoming ones the device that sent it.
+type chatLine struct {
+	id         string
+	prefix     string
+	text       string
+	warning    string
+	state      string
+	userID     string
+	deviceID   string
+	read       bool
+	edited     bool
+	deleted    bool
+	reactions  map[string][]string
+	replyTo    string
+	threadRoot string
+	row        int
+	rows       int
+}
+
 type ChatModel struct {
 	viewport      viewport.Model
-	messages      []string
+	messages      []chatLine
 	textarea      textarea.Model
 	senderStyle   lipgloss.Style
 	receiverStyle lipgloss.Style
+	statusStyle   lipgloss.Style
+	warningStyle  lipgloss.Style
 	err           error
 	conn          *websocket.Conn
+	status        string
+	conversations map[string]string
+	keyWarnings   map[string]string
+	width         int
+	height        int
+	wiping        bool
+	blurred       bool
+	typingSent    time.Time
+	keystrokes    int
+	typing        map[string]time.Time
+	activity      int
+	away          bool
+	presence      map[string]model.PresenceMessage
+	selected      string
+	thread        string
 	Username      string
+	PanicKey      string
+	AwayAfter     time.Duration
 	Send          chan model.TextMessagePayload
+	Reads         chan model.ReadMessage
+	Typing        chan bool
+	Edits         chan model.EditMessage
+	Reactions     chan model.ReactionMessage
+	Presence      chan string
+	Commands      chan model.Command
 }
 
-func InitialModel(conn *websocket.Conn, username string) ChatModel {
+func InitialModel(conn *websocket.Conn, username string, charLimit int) ChatModel {
 	ta := textarea.New()
 	ta.Placeholder = "Send a message..."
 	ta.Focus()
 
 	ta.Prompt = "┃ "
-	ta.CharLimit = 280
+	ta.CharLimit = charLimit
 
 	ta.SetWidth(30)
 	ta.SetHeight(3)
@@ -52,74 +127,760 @@ func InitialModel(conn *websocket.Conn, username string) ChatModel {
 
 	return ChatModel{
 		textarea:      ta,
-		messages:      []string{},
+		messages:      []chatLine{},
 		viewport:      vp,
 		senderStyle:   lipgloss.NewStyle().Foreground(lipgloss.Color("#60d300")),
 		receiverStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("#22a5ff")),
+		statusStyle:   lipgloss.NewStyle().Foreground(lipgloss.Color("#8a8a8a")),
+		warningStyle:  lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("#ffffff")).Background(lipgloss.Color("#c0392b")),
 		err:           nil,
 		conn:          conn,
+		conversations: map[string]string{},
+		keyWarnings:   map[string]string{},
+		typing:        map[string]time.Time{},
+		presence:      map[string]model.PresenceMessage{},
 		Username:      username,
 		Send:          make(chan model.TextMessagePayload),
+		Reads:         make(chan model.ReadMessage),
+		Typing:        make(chan bool),
+		Edits:         make(chan model.EditMessage),
+		Reactions:     make(chan model.ReactionMessage),
+		Presence:      make(chan string),
+		Commands:      make(chan model.Command),
 	}
 }
 
 func (m ChatModel) Init() tea.Cmd {
-	return nil
+	return m.awayTimer()
 }
 
 func (m ChatModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var (
-		tiCmd tea.Cmd
-		vpCmd tea.Cmd
+		tiCmd       tea.Cmd
+		vpCmd       tea.Cmd
+		typingCmd   tea.Cmd
+		presenceCmd tea.Cmd
+		editCmd     tea.Cmd
+		sendCmd     tea.Cmd
 	)
 
+	previous := m.textarea.Value()
 	m.textarea, tiCmd = m.textarea.Update(msg)
 	m.viewport, vpCmd = m.viewport.Update(msg)
 
 	switch msg := msg.(type) {
 	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
 		m.viewport.Width = msg.Width
 		m.textarea.SetWidth(msg.Width)
-		m.viewport.Height = msg.Height - m.textarea.Height() - lipgloss.Height(gap)
+		m = m.resize()
 
 		if len(m.messages) > 0 {
-			m.viewport.SetContent(lipgloss.NewStyle().Width(m.viewport.Width).Render(strings.Join(m.messages, "\n")))
+			m.render()
 		}
 		m.viewport.GotoBottom()
 	case tea.KeyMsg:
+		if m.PanicKey != "" && msg.String() == m.PanicKey {
+			m.wiping = true
+			return m, tea.Quit
+		}
+		presenceCmd = m.active()
+
+		switch msg.String() {
+		case "alt+up":
+			m.selectMessage(-1)
+			return m, presenceCmd
+		case "alt+down":
+			m.selectMessage(1)
+			return m, presenceCmd
+		}
 
 		switch msg.Type {
+		case tea.KeyCtrlR:
+			editCmd = m.react(previous)
+		case tea.KeyCtrlT:
+			m.toggleThread()
 		case tea.KeyCtrlC, tea.KeyEsc:
 			fmt.Println(m.textarea.Value())
 			return m, tea.Quit
 		case tea.KeyEnter:
-			m.messages = append(m.messages, m.senderStyle.Render("You: ")+m.textarea.Value())
-			m.viewport.SetContent(lipgloss.NewStyle().Width(m.viewport.Width).Render(strings.Join(m.messages, "\n")))
+			if command, ok := model.ParseCommand(m.textarea.Value()); ok {
+				switch command.Name {
+				case "edit", "delete":
+					editCmd = m.editLast(command.Name, m.textarea.Value())
+				default:
+					// The client may be waiting for Update to take one of its
+					// messages, so it is handed over from a command.
+					commands := m.Commands
+					sendCmd = func() tea.Msg {
+						commands <- command
+						return nil
+					}
+				}
+				m.textarea.Reset()
+				break
+			}
+			line := chatLine{id: uuid.NewString(), prefix: m.senderStyle.Render("You: "), text: m.textarea.Value()}
+			line.replyTo, line.threadRoot = m.replyTarget()
+			m.messages = append(m.messages, line)
+			m.selected = ""
+			m.render()
 			m.viewport.GotoBottom()
 
-			m.Send <- model.TextMessagePayload{Content: m.textarea.Value(), SenderID: m.Username}
+			message := model.TextMessagePayload{
+				MessageID:  line.id,
+				Content:    line.text,
+				SenderID:   m.Username,
+				ReplyTo:    line.replyTo,
+				ThreadRoot: line.threadRoot,
+			}
+			send := m.Send
+			sendCmd = func() tea.Msg {
+				send <- message
+				return nil
+			}
 			m.textarea.Reset()
+			// The message itself clears the indicator of contacts.
+			m.typingSent = time.Time{}
 		}
+		typingCmd = m.typingSignal(previous)
 	case model.IncomingMessage:
 		newModel := m
 		sender := fmt.Sprintf("%s: ", msg.Message.SenderID)
-		newModel.messages = append(newModel.messages, newModel.receiverStyle.Render(sender)+msg.Message.Content)
-		newModel.viewport.SetContent(lipgloss.NewStyle().Width(newModel.viewport.Width).Render(strings.Join(newModel.messages, "\n")))
+		if msg.Message.AuthMode == model.AuthModeDeniable {
+			sender = fmt.Sprintf("%s (deniable): ", msg.Message.SenderID)
+		}
+		line := chatLine{
+			id:         msg.Message.MessageID,
+			prefix:     newModel.receiverStyle.Render(sender),
+			text:       msg.Message.Content,
+			userID:     msg.Message.SenderID,
+			deviceID:   msg.Message.SenderDevice,
+			replyTo:    msg.Message.ReplyTo,
+			threadRoot: msg.Message.ThreadRoot,
+		}
+		if msg.Warning != "" {
+			line.warning = newModel.warningStyle.Render("[" + msg.Warning + "]")
+		}
+		delete(newModel.typing, msg.Message.SenderID)
+		newModel.messages = append(newModel.messages, line)
+		newModel.render()
 		newModel.viewport.GotoBottom()
-		return newModel, nil
+		return newModel, newModel.readVisible()
+	case model.HistoryMessage:
+		lines := make([]chatLine, 0, len(msg.Entries)+len(m.messages))
+		for _, entry := range msg.Entries {
+			line := chatLine{
+				id:         entry.MessageID,
+				text:       entry.Content,
+				read:       true,
+				edited:     entry.Edited,
+				deleted:    entry.Deleted,
+				reactions:  entry.Reactions,
+				replyTo:    entry.ReplyTo,
+				threadRoot: entry.ThreadRoot,
+			}
+			if entry.Outgoing {
+				line.prefix = m.senderStyle.Render("You: ")
+			} else {
+				line.prefix, line.userID = m.receiverStyle.Render(entry.SenderID+": "), entry.SenderID
+			}
+			lines = append(lines, line)
+		}
+		m.messages = append(lines, m.messages...)
+		m.render()
+		m.viewport.GotoBottom()
+		return m, nil
+	case model.EditMessage:
+		if line := m.findLine(msg.UserID, msg.MessageID); line != nil {
+			line.edit(msg.Text, msg.Deleted)
+			m.render()
+		}
+		return m, nil
+	case model.ReactionMessage:
+		if line := m.findMessage(msg.MessageID); line != nil {
+			line.react(msg.UserID, msg.Emoji, msg.Removed)
+			m.render()
+		}
+		return m, nil
+	case model.TypingMessage:
+		if !msg.Typing {
+			delete(m.typing, msg.UserID)
+			return m, nil
+		}
+		m.typing[msg.UserID] = time.Now().Add(typingTimeout)
+		return m, tea.Tick(typingTimeout, func(time.Time) tea.Msg { return typingExpiredMsg{} })
+	case typingExpiredMsg:
+		now := time.Now()
+		for userID, expires := range m.typing {
+			if !expires.After(now) {
+				delete(m.typing, userID)
+			}
+		}
+		return m, nil
+	case typingIdleMsg:
+		if msg.keystrokes != m.keystrokes || m.typingSent.IsZero() {
+			return m, nil
+		}
+		m.typingSent = time.Time{}
+		return m, m.signalTyping(false)
+	case awayMsg:
+		if msg.activity != m.activity || m.away {
+			return m, nil
+		}
+		m.away = true
+		return m, m.signalPresence(model.PresenceAway)
+	case model.PresenceMessage:
+		m.presence[msg.UserID] = msg
+		return m, nil
+	case tea.FocusMsg:
+		m.blurred = false
+		return m, tea.Batch(m.active(), m.readVisible())
+	case tea.BlurMsg:
+		m.blurred = true
+		return m, nil
+	case model.DeliveryMessage:
+		m.setDelivery(msg.MessageID, msg.State)
+		return m, nil
+	case model.StatusMessage:
+		m.status = msg.Text
+		return m, nil
+	case model.ConversationMessage:
+		m.conversations[msg.UserID] = msg.AuthMode
+		if msg.Trust != "" {
+			m.conversations[msg.UserID] = msg.AuthMode + "/" + msg.Trust
+		}
+		return m, nil
+	case model.KeyChangeMessage:
+		m.keyWarnings[msg.UserID] = fmt.Sprintf(
+			"⚠ THE KEY OF %s HAS CHANGED (was %s, now %s). Nothing is sent to %s until you verify it out of band and type /accept %s",
+			msg.UserID, msg.OldFingerprint, msg.NewFingerprint, msg.UserID, msg.UserID,
+		)
+		return m.resize(), nil
+	case model.KeyAcceptedMessage:
+		delete(m.keyWarnings, msg.UserID)
+		return m.resize(), nil
 	case errMsg:
 		m.err = msg
 		return m, nil
 	}
 
-	return m, tea.Batch(tiCmd, vpCmd)
+	return m, tea.Batch(tiCmd, vpCmd, typingCmd, presenceCmd, editCmd, sendCmd, m.readVisible())
 }
 
 func (m ChatModel) View() string {
+	// Nothing of the conversation is left on screen when wiping.
+	if m.wiping {
+		return ""
+	}
+
 	return fmt.Sprintf(
-		"%s%s%s",
+		"%s\n%s\n%s%s\n%s",
 		m.viewport.View(),
-		gap,
+		m.statusStyle.MaxWidth(m.viewport.Width).Render(m.contextLine()),
+		m.warnings(),
+		m.statusStyle.Render(m.statusLine()),
 		m.textarea.View(),
 	)
 }
+
+// Wiping reports whether the program quit because the panic key was pressed.
+func (m ChatModel) Wiping() bool {
+	return m.wiping
+}
+
+func (m *ChatModel) render() {
+	style := lipgloss.NewStyle().Width(m.viewport.Width)
+	lines := make([]string, 0, len(m.messages)+1)
+	row := 0
+	if m.thread != "" {
+		lines = append(lines, style.Render(m.statusStyle.Render("── thread · ctrl+t goes back to the room ──")))
+		row++
+	}
+	for i := range m.messages {
+		line := &m.messages[i]
+		if !m.inThread(*line) {
+			line.row, line.rows = -1, 0
+			continue
+		}
+
+		text := line.prefix + line.text
+		switch {
+		case line.deleted:
+			text = line.prefix + m.statusStyle.Italic(true).Render("message deleted")
+		case line.edited:
+			text += " " + m.statusStyle.Render("(edited)")
+		}
+		if reactions := line.reactionSummary(); reactions != "" && !line.deleted {
+			text += " " + m.statusStyle.Render(reactions)
+		}
+		if line.warning != "" {
+			text += " " + line.warning
+		}
+		if line.id != "" && line.id == m.selected {
+			text = "▶ " + text
+		}
+		if line.state != "" {
+			text += " " + m.statusStyle.Render("· "+line.state)
+		}
+		if line.replyTo != "" {
+			text = m.statusStyle.Render(m.quote(line.replyTo)) + "\n" + text
+		}
+		text = style.Render(text)
+		line.row, line.rows = row, lipgloss.Height(text)
+		row += line.rows
+		lines = append(lines, text)
+	}
+
+	m.viewport.SetContent(strings.Join(lines, "\n"))
+}
+
+// findLine returns the message messageID of userID, empty for the user.
+func (m *ChatModel) findLine(userID, messageID string) *chatLine {
+	if messageID == "" {
+		return nil
+	}
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].id == messageID && m.messages[i].userID == userID {
+			return &m.messages[i]
+		}
+	}
+
+	return nil
+}
+
+func (l *chatLine) edit(text string, deleted bool) {
+	switch {
+	case deleted:
+		l.text, l.deleted = "", true
+	case !l.deleted:
+		l.text, l.edited = text, true
+	}
+}
+
+// editLast handles /edit <text> and /delete, which apply to the last message
+// of the user that was not deleted.
+func (m *ChatModel) editLast(name, input string) tea.Cmd {
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(input), "/"+name))
+	if name == "edit" && text == "" {
+		m.status = "usage: /edit <new text>"
+		return nil
+	}
+
+	var line *chatLine
+	for i := len(m.messages) - 1; i >= 0 && line == nil; i-- {
+		if m.messages[i].userID == "" && m.messages[i].id != "" && !m.messages[i].deleted {
+			line = &m.messages[i]
+		}
+	}
+	if line == nil {
+		m.status = fmt.Sprintf("no message of yours to %s", name)
+		return nil
+	}
+
+	edit := model.EditMessage{MessageID: line.id, Text: text, Deleted: name == "delete"}
+	line.edit(edit.Text, edit.Deleted)
+	m.render()
+
+	edits := m.Edits
+	return func() tea.Msg {
+		edits <- edit
+		return nil
+	}
+}
+
+// findMessage returns the message messageID of any sender.
+func (m *ChatModel) findMessage(messageID string) *chatLine {
+	if messageID == "" {
+		return nil
+	}
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].id == messageID {
+			return &m.messages[i]
+		}
+	}
+
+	return nil
+}
+
+// selectMessage moves the selection by step among the messages that can be
+// reacted to, starting from the last one, and scrolls it into view.
+func (m *ChatModel) selectMessage(step int) {
+	selectable := []int{}
+	current := -1
+	for i, line := range m.messages {
+		if line.id == "" || line.deleted || !m.inThread(line) {
+			continue
+		}
+		if line.id == m.selected {
+			current = len(selectable)
+		}
+		selectable = append(selectable, i)
+	}
+	if len(selectable) == 0 {
+		return
+	}
+
+	next := len(selectable) - 1
+	if current >= 0 {
+		// Moving down past the last message clears the selection.
+		if current+step >= len(selectable) {
+			m.selected = ""
+			m.render()
+			return
+		}
+		next = max(current+step, 0)
+	}
+	m.selected = m.messages[selectable[next]].id
+	m.render()
+
+	line := m.messages[selectable[next]]
+	if line.row < m.viewport.YOffset {
+		m.viewport.SetYOffset(line.row)
+	} else if bottom := line.row + line.rows; bottom > m.viewport.YOffset+m.viewport.Height {
+		m.viewport.SetYOffset(bottom - m.viewport.Height)
+	}
+}
+
+// react toggles a reaction of the user on the selected message, or on the
+// last message of a contact when none is selected. The reaction is what was
+// typed in the input, a thumbs up when the input is empty.
+func (m *ChatModel) react(input string) tea.Cmd {
+	emoji := strings.TrimSpace(input)
+	if emoji == "" {
+		emoji = defaultReaction
+	}
+	if len(emoji) > model.MaxReactionLength || strings.ContainsAny(emoji, " \t") {
+		m.status = "type a single emoji before pressing ctrl+r"
+		return nil
+	}
+
+	line := m.findMessage(m.selected)
+	for i := len(m.messages) - 1; i >= 0 && line == nil; i-- {
+		if m.messages[i].userID != "" && m.messages[i].id != "" && !m.messages[i].deleted {
+			line = &m.messages[i]
+		}
+	}
+	if line == nil || line.deleted {
+		m.status = "no message to react to"
+		return nil
+	}
+
+	reaction := model.ReactionMessage{MessageID: line.id, Emoji: emoji, Removed: slices.Contains(line.reactions[emoji], m.Username)}
+	line.react(m.Username, reaction.Emoji, reaction.Removed)
+	m.textarea.Reset()
+	m.render()
+
+	reactions := m.Reactions
+	return func() tea.Msg {
+		reactions <- reaction
+		return nil
+	}
+}
+
+func (l *chatLine) react(userID, emoji string, removed bool) {
+	users := slices.DeleteFunc(slices.Clone(l.reactions[emoji]), func(user string) bool { return user == userID })
+	if !removed {
+		users = append(users, userID)
+	}
+
+	reactions := maps.Clone(l.reactions)
+	if reactions == nil {
+		reactions = map[string][]string{}
+	}
+	reactions[emoji] = users
+	if len(users) == 0 {
+		delete(reactions, emoji)
+	}
+	l.reactions = reactions
+}
+
+// reactionSummary counts the reactions of a message, the most used first.
+func (l chatLine) reactionSummary() string {
+	emojis := slices.Collect(maps.Keys(l.reactions))
+	sort.Slice(emojis, func(i, j int) bool {
+		if len(l.reactions[emojis[i]]) != len(l.reactions[emojis[j]]) {
+			return len(l.reactions[emojis[i]]) > len(l.reactions[emojis[j]])
+		}
+		return emojis[i] < emojis[j]
+	})
+
+	parts := make([]string, 0, len(emojis))
+	for _, emoji := range emojis {
+		parts = append(parts, fmt.Sprintf("%s %d", emoji, len(l.reactions[emoji])))
+	}
+
+	return strings.Join(parts, "  ")
+}
+
+// readVisible marks the incoming messages on screen as read while the
+// terminal has focus, and reports them to the devices that sent them.
+func (m *ChatModel) readVisible() tea.Cmd {
+	if m.blurred {
+		return nil
+	}
+
+	top, bottom := m.viewport.YOffset, m.viewport.YOffset+m.viewport.Height
+	reads := map[string]*model.ReadMessage{}
+	for i := range m.messages {
+		line := &m.messages[i]
+		if line.read || line.id == "" || line.userID == "" || line.row+line.rows <= top || line.row >= bottom {
+			continue
+		}
+		line.read = true
+
+		address := identity.DeviceAddress(line.userID, line.deviceID)
+		if reads[address] == nil {
+			reads[address] = &model.ReadMessage{UserID: line.userID, DeviceID: line.deviceID}
+		}
+		reads[address].MessageIDs = append(reads[address].MessageIDs, line.id)
+	}
+	if len(reads) == 0 {
+		return nil
+	}
+
+	// Sent from a command so Update never waits on the client.
+	reported := m.Reads
+	return func() tea.Msg {
+		for _, read := range reads {
+			reported <- *read
+		}
+		return nil
+	}
+}
+
+// setDelivery updates the state shown next to an outgoing message. Failures
+// always show, other states only when they move the message forward.
+func (m *ChatModel) setDelivery(messageID, state string) {
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		line := &m.messages[i]
+		if line.id != messageID {
+			continue
+		}
+		if state == model.DeliveryFailed || slices.Index(model.DeliveryStates, state) > slices.Index(model.DeliveryStates, line.state) {
+			line.state = state
+			m.render()
+		}
+		return
+	}
+}
+
+// typingSignal announces typing at most once per typingInterval while the
+// input changes, and stopping once the input is cleared.
+func (m *ChatModel) typingSignal(previous string) tea.Cmd {
+	value := m.textarea.Value()
+	if value == previous {
+		return nil
+	}
+	if value == "" {
+		if m.typingSent.IsZero() {
+			return nil
+		}
+		m.typingSent = time.Time{}
+		return m.signalTyping(false)
+	}
+
+	m.keystrokes++
+	keystrokes := m.keystrokes
+	cmds := []tea.Cmd{tea.Tick(typingIdle, func(time.Time) tea.Msg { return typingIdleMsg{keystrokes: keystrokes} })}
+	if time.Since(m.typingSent) >= typingInterval {
+		m.typingSent = time.Now()
+		cmds = append(cmds, m.signalTyping(true))
+	}
+
+	return tea.Batch(cmds...)
+}
+
+func (m ChatModel) signalTyping(typing bool) tea.Cmd {
+	signals := m.Typing
+	return func() tea.Msg {
+		signals <- typing
+		return nil
+	}
+}
+
+// active restarts the away timer, and tells contacts the user is back when
+// it was away.
+func (m *ChatModel) active() tea.Cmd {
+	m.activity++
+	if !m.away {
+		return m.awayTimer()
+	}
+
+	m.away = false
+	return tea.Batch(m.awayTimer(), m.signalPresence(model.PresenceOnline))
+}
+
+func (m ChatModel) awayTimer() tea.Cmd {
+	if m.AwayAfter <= 0 {
+		return nil
+	}
+
+	activity := m.activity
+	return tea.Tick(m.AwayAfter, func(time.Time) tea.Msg { return awayMsg{activity: activity} })
+}
+
+func (m ChatModel) signalPresence(state string) tea.Cmd {
+	states := m.Presence
+	return func() tea.Msg {
+		states <- state
+		return nil
+	}
+}
+
+func (m ChatModel) inThread(line chatLine) bool {
+	return m.thread == "" || line.id == m.thread || line.threadRoot == m.thread
+}
+
+// replyTarget returns the parent and the thread of a message about to be
+// sent: the selected message, or the last one of the open thread.
+func (m *ChatModel) replyTarget() (string, string) {
+	parent := m.findMessage(m.selected)
+	for i := len(m.messages) - 1; i >= 0 && parent == nil && m.thread != ""; i-- {
+		if m.messages[i].id != "" && m.inThread(m.messages[i]) {
+			parent = &m.messages[i]
+		}
+	}
+	if parent == nil {
+		return "", ""
+	}
+
+	if parent.threadRoot != "" {
+		return parent.id, parent.threadRoot
+	}
+	return parent.id, parent.id
+}
+
+// toggleThread opens the thread of the selected message, showing only its
+// messages, or goes back to the room.
+func (m *ChatModel) toggleThread() {
+	if m.thread != "" {
+		m.thread = ""
+	} else {
+		line := m.findMessage(m.selected)
+		if line == nil {
+			m.status = "select a message with alt+up to open its thread"
+			return
+		}
+		m.thread = line.threadRoot
+		if m.thread == "" {
+			m.thread = line.id
+		}
+	}
+
+	m.selected = ""
+	m.render()
+	m.viewport.GotoBottom()
+}
+
+// quote is the snippet of a parent shown above a reply.
+func (m *ChatModel) quote(messageID string) string {
+	parent := m.findMessage(messageID)
+	if parent == nil {
+		return "┃ a message that is not loaded"
+	}
+
+	author := parent.userID
+	if author == "" {
+		author = "You"
+	}
+	text := parent.text
+	if parent.deleted {
+		text = "message deleted"
+	}
+	if runes := []rune(text); len(runes) > quoteLength {
+		text = string(runes[:quoteLength]) + "…"
+	}
+
+	return "┃ " + author + ": " + text
+}
+
+// contextLine shows who is typing and what a message would reply to.
+func (m ChatModel) contextLine() string {
+	parts := []string{}
+	if typing := m.typingLine(); typing != "" {
+		parts = append(parts, typing)
+	}
+	if m.selected != "" {
+		parts = append(parts, "↪ replying to "+strings.TrimPrefix(m.quote(m.selected), "┃ ")+" · ctrl+t opens the thread")
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+func (m ChatModel) typingLine() string {
+	userIDs := make([]string, 0, len(m.typing))
+	for userID := range m.typing {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	switch len(userIDs) {
+	case 0:
+		return ""
+	case 1:
+		return userIDs[0] + " is typing…"
+	case 2, 3:
+		return strings.Join(userIDs[:len(userIDs)-1], ", ") + " and " + userIDs[len(userIDs)-1] + " are typing…"
+	default:
+		return "several people are typing…"
+	}
+}
+
+func (m ChatModel) resize() ChatModel {
+	if m.height > 0 {
+		m.viewport.Height = m.height - m.textarea.Height() - lipgloss.Height(gap) - 1 - strings.Count(m.warnings(), "\n")
+	}
+
+	return m
+}
+
+func (m ChatModel) warnings() string {
+	userIDs := make([]string, 0, len(m.keyWarnings))
+	for userID := range m.keyWarnings {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	var warnings strings.Builder
+	for _, userID := range userIDs {
+		warnings.WriteString(m.warningStyle.Width(m.viewport.Width).Render(m.keyWarnings[userID]) + "\n")
+	}
+
+	return warnings.String()
+}
+
+func (m ChatModel) statusLine() string {
+	userIDs := make([]string, 0, len(m.conversations))
+	for userID := range m.conversations {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	parts := make([]string, 0, len(userIDs)+1)
+	for _, userID := range userIDs {
+		name := userID
+		if presence, ok := m.presence[userID]; ok {
+			name = fmt.Sprintf("%s (%s)", userID, presenceText(presence))
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", name, m.conversations[userID]))
+	}
+	if m.status != "" {
+		parts = append(parts, m.status)
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+func presenceText(presence model.PresenceMessage) string {
+	if presence.State != model.PresenceOffline || presence.LastSeen.IsZero() {
+		return presence.State
+	}
+
+	lastSeen := presence.LastSeen.Local()
+	if now := time.Now(); lastSeen.YearDay() == now.YearDay() && lastSeen.Year() == now.Year() {
+		return "last seen " + lastSeen.Format("15:04")
+	}
+
+	return "last seen " + lastSeen.Format("Jan 2 15:04")
+}
@@ -1,12 +1,21 @@
 package websocket
 
 import (
-	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
 	"github.com/osmancadc/go-encrypted-chat/internal/model"
 	"github.com/osmancadc/go-encrypted-chat/internal/view"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
 	"github.com/osmancadc/go-encrypted-chat/pkg/logger"
 )
 
@@ -15,51 +24,126 @@ var log = logger.NewLogger("INFO")
 type ClientHandler struct {
 	Conn            *Connection
 	program         *tea.Program
-	externalMsgChan chan model.IncomingMessage
+	externalMsgChan chan tea.Msg
+	config          *config.Config
+	keys            *crypto.KeyPool
+	settings        config.ClientSettings
+	history         *config.History
+	sessionMu       sync.Mutex
+	sequences       map[identity.Device]uint64
+	link            linkState
+	deviceLists     map[string][]model.DeviceInfo
+	closed          chan struct{}
+	protocol        model.WelcomePayload
+	outgoing        map[string]*outgoingMessage
+	presence        string
+	contactPresence map[string]string
+	heldReads       map[identity.Device][]string
 }
 
-func NewClientHandler(conn *Connection) *ClientHandler {
-	return &ClientHandler{
+func NewClientHandler(conn *Connection, cfg *config.Config, keys *crypto.KeyPool, settings config.ClientSettings) *ClientHandler {
+	handler := &ClientHandler{
 		Conn:            conn,
-		externalMsgChan: make(chan model.IncomingMessage),
+		externalMsgChan: make(chan tea.Msg),
+		config:          cfg,
+		keys:            keys,
+		settings:        settings,
+		sequences:       map[identity.Device]uint64{},
+		deviceLists:     map[string][]model.DeviceInfo{},
+		closed:          make(chan struct{}),
+		outgoing:        map[string]*outgoingMessage{},
+		contactPresence: map[string]string{},
+		heldReads:       map[identity.Device][]string{},
 	}
+	if settings.History != "" {
+		handler.history = config.OpenHistory(settings.History)
+	}
+
+	return handler
 }
 
-func (h *ClientHandler) Run() {
-	u := "ws://localhost:8080/ws"
+func SetLogLevel(level string) {
+	log.SetLevel(level)
+}
 
-	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+func (h *ClientHandler) Run() {
+	conn, _, err := dialer.Dial(h.settings.URL, nil)
 	if err != nil {
 		log.Fatalf("Error connecting to WebSocket: %v\n", err)
 	}
+	h.protocol, err = clientHandshake(conn, h.Conn.User, h.settings.Encoding)
+	if err != nil {
+		log.Fatalf("The server refused the connection: %v\n", err)
+	}
+	log.Debugf("Speaking protocol version %d in %s with features %v\n", h.protocol.Version, h.protocol.Encoding, h.protocol.Features)
 	h.Conn.SetConn(conn)
-	h.Conn.SetChat()
+	h.Conn.SetChat(h.settings.CharLimit)
 
 	go h.readPump()
 	go h.writePump()
 
 	log.Info("Client connected to server")
 
-	h.sendMessage(model.WebsocketMessage{
-		Type: "usernameMessage",
-		Payload: model.UsernamePayload{
-			Username: h.Conn.User.Username,
-		},
-	})
+	// Contacts that missed a rotation need it before they see the new key.
+	if rotation := h.config.GetRotation(); rotation != nil {
+		h.sendMessage(model.WebsocketMessage{Type: model.KeyRotationType, Payload: rotation})
+	}
 
-	chatModel := view.InitialModel(h.Conn.GetConn(), h.Conn.User.Username)
-	h.program = tea.NewProgram(chatModel)
+	// A device being linked only announces its key once it is certified.
+	if h.linking() {
+		err = h.requestLink()
+	} else {
+		err = h.announcePublicKey(true)
+	}
+	if err != nil {
+		log.Errorf("Error announcing public key: %v\n", err)
+	}
+	h.sendPresence(model.PresenceOnline)
+
+	chatModel := view.InitialModel(h.Conn.GetConn(), h.Conn.User.Username, h.settings.CharLimit)
+	chatModel.PanicKey = h.settings.PanicKey
+	chatModel.AwayAfter = time.Duration(h.settings.AwayAfter) * time.Minute
+	h.program = tea.NewProgram(chatModel, tea.WithReportFocus())
 
 	go func() {
 		for msg := range chatModel.Send {
-			websocketMsg := model.WebsocketMessage{
-				Type: "textMessage",
-				Payload: model.TextMessagePayload{
-					Content:  msg.Content,
-					SenderID: msg.SenderID,
-				},
-			}
-			h.sendMessage(websocketMsg)
+			h.sendText(msg)
+		}
+	}()
+
+	go func() {
+		for read := range chatModel.Reads {
+			h.sendRead(read)
+		}
+	}()
+
+	go func() {
+		for state := range chatModel.Presence {
+			h.sendPresence(state)
+		}
+	}()
+
+	go func() {
+		for edit := range chatModel.Edits {
+			h.sendEdit(edit)
+		}
+	}()
+
+	go func() {
+		for reaction := range chatModel.Reactions {
+			h.sendReaction(reaction)
+		}
+	}()
+
+	go func() {
+		for typing := range chatModel.Typing {
+			h.sendTyping(typing)
+		}
+	}()
+
+	go func() {
+		for command := range chatModel.Commands {
+			h.handleCommand(command)
 		}
 	}()
 
@@ -69,14 +153,21 @@ func (h *ClientHandler) Run() {
 		}
 	}()
 
-	_, err = h.program.Run()
+	go h.loadHistory()
+	go h.restoreContacts()
+
+	final, err := h.program.Run()
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
+	if chat, ok := final.(view.ChatModel); ok && chat.Wiping() {
+		h.panicWipe()
+	}
 
 }
 
 func (h *ClientHandler) readPump() {
+	defer close(h.closed)
 	defer h.Conn.Close()
 	log.Debug("Entered to readPump")
 	for {
@@ -96,7 +187,7 @@ func (h *ClientHandler) writePump() {
 	log.Debug("Entered to write Pump")
 
 	for message := range h.Conn.GetSendChan() {
-		err := h.Conn.WriteMessage(websocket.TextMessage, message)
+		err := h.Conn.WriteMessage(frameType(h.protocol.Encoding), message)
 		if err != nil {
 			log.Errorf("Write error: %v\n", err)
 			break
@@ -105,34 +196,334 @@ func (h *ClientHandler) writePump() {
 	}
 }
 
-func (h *ClientHandler) handleMessage(message []byte) (err error) {
-	var chatMessage model.WebsocketMessage
-	err = json.Unmarshal(message, &chatMessage)
+func (h *ClientHandler) handleMessage(message []byte) error {
+	envelope, err := model.ParseEnvelope(message)
+	if err != nil {
+		log.Errorf("Dropping frame from the server: %v\n", err)
+		return err
+	}
+	payload, err := envelope.Decode()
 	if err != nil {
-		log.Errorf("Failed to unmarshal message: %s", err.Error())
+		log.Errorf("Dropping frame from the server: %v\n", err)
+		return err
+	}
+	if envelope.Type == model.AckType {
+		h.handleAck(envelope.ID)
+		return nil
+	}
+
+	switch payload := payload.(type) {
+	case *model.PublicKeyExchangePayload:
+		h.handlePublicKey(*payload)
+	case *model.SymmetricKeyExchangePayload:
+		h.handleSymmetricKey(*payload)
+	case *identity.KeyRotation:
+		h.handleKeyRotation(*payload)
+	case *model.KeyRevocationPayload:
+		h.handleKeyRevocation(*payload)
+	case *model.DeviceLinkRequestPayload:
+		h.handleLinkRequest(*payload)
+	case *model.DeviceLinkResponsePayload:
+		h.handleLinkResponse(*payload)
+	case *model.PresencePayload:
+		h.handlePresence(*payload)
+	case *model.ErrorPayload:
+		h.handleError(*payload)
+	case *model.DeviceListPayload:
+		h.sessionMu.Lock()
+		h.deviceLists[payload.UserID] = payload.Devices
+		h.sessionMu.Unlock()
+	case *model.TextMessagePayload:
+		h.handleTextMessage(*payload)
+	default:
+		log.Debugf("Ignoring %s frame\n", envelope.Type)
+	}
+
+	return nil
+}
+
+func (h *ClientHandler) handleTextMessage(textMsg model.TextMessagePayload) {
+	if textMsg.RecipientID != h.Conn.User.Username || textMsg.RecipientDevice != h.Conn.User.DeviceID {
+		return
+	}
+	if err := identity.ValidateDeviceAddress(textMsg.SenderID, textMsg.SenderDevice); err != nil {
+		log.Warnf("Ignoring message: %v\n", err)
+		return
+	}
+
+	plaintext, err := h.decryptFrom(textMsg)
+	if err == nil {
+		var content model.Content
+		content, err = model.ParseContent(plaintext)
+		if err == nil {
+			h.handleContent(textMsg, content)
+			return
+		}
+	}
+
+	log.Errorf("Dropping message from %s: %v\n", textMsg.SenderID, err)
+	h.notify(model.StatusMessage{Text: fmt.Sprintf("dropped message from %s: %v", textMsg.SenderID, err)})
+}
+
+// handleContent acts on a decrypted message. Kinds this client does not know
+// come from newer clients and are ignored.
+func (h *ClientHandler) handleContent(textMsg model.TextMessagePayload, content model.Content) {
+	// Messages are only flagged, anything that changes what is already on
+	// screen or its delivery state is refused.
+	warning := h.revocationWarning(textMsg)
+	if warning != "" && content.Kind != model.ContentText {
+		log.Warnf("Ignoring %s content from %s %s\n", content.Kind, textMsg.SenderID, warning)
 		return
 	}
 
-	var textMsg model.TextMessagePayload
+	switch content.Kind {
+	case model.ContentText:
+		textMsg.Content = content.Text
+
+		if warning != "" {
+			log.Warnf("Message from %s %s\n", textMsg.SenderID, warning)
+		}
 
-	byteMsg, err := json.Marshal(chatMessage.Payload)
+		textMsg.ReplyTo, textMsg.ThreadRoot = content.ReplyTo, content.ThreadRoot
+		h.recordHistory(textMsg, false)
+		h.notify(model.IncomingMessage{Message: textMsg, Warning: warning})
+		h.sendReceipt(textMsg)
+	case model.ContentReceipt:
+		h.handleReceipt(textMsg.SenderID, content.MessageIDs, model.DeliveryDelivered)
+	case model.ContentEdit, model.ContentDelete:
+		h.handleEdit(textMsg.SenderID, content)
+	case model.ContentReaction:
+		h.handleReaction(textMsg.SenderID, content)
+	case model.ContentTyping, model.ContentStopped:
+		h.notify(model.TypingMessage{UserID: textMsg.SenderID, Typing: content.Kind == model.ContentTyping})
+	case model.ContentRead:
+		// Read receipts are ignored as well as not sent when turned off.
+		if h.settings.ReadReceipts {
+			h.handleReceipt(textMsg.SenderID, content.MessageIDs, model.DeliveryRead)
+		}
+	default:
+		log.Debugf("Ignoring %s content from %s\n", content.Kind, textMsg.SenderID)
+	}
+}
+
+func (h *ClientHandler) sendText(message model.TextMessagePayload) {
+	h.trackOutgoing(message.MessageID)
+	content := model.Content{Kind: model.ContentText, Text: message.Content, ReplyTo: message.ReplyTo, ThreadRoot: message.ThreadRoot}
+	recipients := h.sendToContacts(content, message.MessageID)
+	if len(recipients) == 0 {
+		h.forgetOutgoing(message.MessageID)
+		h.notify(model.DeliveryMessage{MessageID: message.MessageID, State: model.DeliveryFailed})
+		return
+	}
+
+	message.SenderID = h.Conn.User.Username
+	h.recordHistory(message, true)
+	h.setRecipients(message.MessageID, recipients)
+	h.notify(model.DeliveryMessage{MessageID: message.MessageID, State: model.DeliverySent})
+}
+
+// sendToContacts encrypts content to every device of every contact and
+// returns the contacts that got at least one copy. Contacts whose key changed
+// are left out until the new key is accepted.
+func (h *ClientHandler) sendToContacts(content model.Content, messageID string) []string {
+	// Every copy of a message shares its ID, whatever its kind.
+	if messageID == "" {
+		messageID = uuid.NewString()
+	}
+
+	userIDs := h.config.GetUserIDs()
+	if len(userIDs) == 0 {
+		h.notify(model.StatusMessage{Text: "nobody to send to yet"})
+		return nil
+	}
+
+	// Every device of a contact gets its own copy, encrypted to its own session.
+	recipients := []string{}
+	blocked := []string{}
+	for _, userID := range userIDs {
+		if h.config.HasPendingKey(userID) {
+			blocked = append(blocked, userID)
+			continue
+		}
+
+		devices := h.config.GetDevices(userID)
+		if len(devices) == 0 {
+			h.notify(model.StatusMessage{Text: fmt.Sprintf("could not send to %s: no device known yet", userID)})
+			continue
+		}
+
+		sent := false
+		for _, deviceID := range slices.Sorted(maps.Keys(devices)) {
+			if err := h.sendContent(userID, deviceID, content, messageID); err != nil {
+				log.Errorf("Error encrypting message for %s: %v\n", identity.DeviceAddress(userID, deviceID), err)
+				h.notify(model.StatusMessage{Text: fmt.Sprintf("could not send to %s: %v", userID, err)})
+				continue
+			}
+			sent = true
+		}
+		if sent {
+			recipients = append(recipients, userID)
+		}
+	}
+	if len(blocked) > 0 {
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("not sent to %s: accept or investigate the key change first", strings.Join(blocked, ", "))})
+	}
+
+	return recipients
+}
+
+// sendContent encrypts content for one device. Frames without a message ID
+// get a fresh one, so the server cannot tell receipts and signals from
+// messages by their outer fields.
+func (h *ClientHandler) sendContent(userID, deviceID string, content model.Content, messageID string) error {
+	if messageID == "" {
+		messageID = uuid.NewString()
+	}
+
+	payload, err := h.encryptFor(userID, deviceID, content, messageID)
 	if err != nil {
+		return err
+	}
+
+	return h.sendMessage(model.WebsocketMessage{
+		Type:    model.TextMessageType,
+		ID:      messageID,
+		Payload: payload,
+	})
+}
+
+func (h *ClientHandler) handleCommand(command model.Command) {
+	switch command.Name {
+	case "auth":
+		if len(command.Args) != 2 || !model.IsValidAuthMode(command.Args[0]) {
+			h.notify(model.StatusMessage{Text: "usage: /auth <signature|deniable> <user>"})
+			return
+		}
+		mode, userID := command.Args[0], command.Args[1]
+		h.config.SetAuthMode(userID, mode)
+		h.notify(h.conversationMessage(userID))
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("messages to %s now use %s authentication", userID, mode)})
+	case "accept":
+		if len(command.Args) != 1 {
+			h.notify(model.StatusMessage{Text: "usage: /accept <user>"})
+			return
+		}
+		userID := command.Args[0]
+		if !h.config.HasPendingKey(userID) {
+			if err := h.config.AcceptContact(userID); err != nil {
+				h.notify(model.StatusMessage{Text: err.Error()})
+				return
+			}
+			h.resendPresence()
+			h.notify(h.conversationMessage(userID))
+			h.notify(model.StatusMessage{Text: fmt.Sprintf("accepted %s, who now sees your presence and devices", userID)})
+			return
+		}
+		if err := h.acceptKey(userID); err != nil {
+			h.notify(model.StatusMessage{Text: err.Error()})
+			return
+		}
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("accepted the new key of %s, verify it with /fingerprint %s", userID, userID)})
+	case "verify":
+		if len(command.Args) != 1 {
+			h.notify(model.StatusMessage{Text: "usage: /verify <user>"})
+			return
+		}
+		if err := h.config.VerifyContact(command.Args[0]); err != nil {
+			h.notify(model.StatusMessage{Text: err.Error()})
+			return
+		}
+		h.resendPresence()
+		h.notify(h.conversationMessage(command.Args[0]))
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("%s marked as verified", command.Args[0])})
+	case "fingerprint":
+		h.showFingerprint(command.Args)
+	case "link":
+		h.startLink()
+	case "devices":
+		h.showDevices(command.Args)
+	case "rotate":
+		h.notify(model.StatusMessage{Text: "rotating your identity key..."})
+		if err := h.rotateIdentity(); err != nil {
+			log.Errorf("Error rotating identity: %v\n", err)
+			h.notify(model.StatusMessage{Text: fmt.Sprintf("could not rotate your identity key: %v", err)})
+			return
+		}
+		h.showFingerprint(nil)
+	default:
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("unknown command /%s", command.Name)})
+	}
+}
+
+func (h *ClientHandler) restoreContacts() {
+	for _, contact := range h.config.GetContacts() {
+		h.notify(h.conversationMessage(contact.UserID))
+		h.notifyKeyChange(contact.UserID)
+	}
+}
+
+func (h *ClientHandler) showFingerprint(args []string) {
+	if len(args) == 0 {
+		publicKey, err := h.config.GetRsaInstance().GetPublicKeyValue()
+		if err != nil {
+			h.notify(model.StatusMessage{Text: err.Error()})
+			return
+		}
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("your fingerprint: %s", crypto.Fingerprint(publicKey))})
+		return
+	}
+
+	contact, ok := h.config.GetContact(args[0])
+	if !ok {
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("unknown contact %s", args[0])})
+		return
+	}
+	h.notify(model.StatusMessage{Text: fmt.Sprintf("%s (%s): %s", contact.UserID, contact.State, crypto.Fingerprint(contact.PublicKey))})
+}
+
+func (h *ClientHandler) loadHistory() {
+	if h.history == nil {
 		return
 	}
 
-	err = textMsg.Unmarshal(byteMsg)
+	entries, err := h.history.Load()
 	if err != nil {
+		log.Errorf("Error loading history: %v\n", err)
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("could not load history: %v", err)})
 		return
 	}
 
-	incomingMsg := model.IncomingMessage{Message: textMsg}
-	h.externalMsgChan <- incomingMsg
-	return nil
+	if len(entries) > 0 {
+		h.notify(model.HistoryMessage{Entries: entries})
+	}
+}
+
+func (h *ClientHandler) recordHistory(message model.TextMessagePayload, outgoing bool) {
+	if h.history == nil {
+		return
+	}
+
+	err := h.history.Append(config.HistoryEntry{
+		Time:       time.Now(),
+		MessageID:  message.MessageID,
+		SenderID:   message.SenderID,
+		Content:    message.Content,
+		Outgoing:   outgoing,
+		ReplyTo:    message.ReplyTo,
+		ThreadRoot: message.ThreadRoot,
+	})
+	if err != nil {
+		log.Errorf("Error saving history: %v\n", err)
+	}
+}
+
+func (h *ClientHandler) notify(msg tea.Msg) {
+	h.externalMsgChan <- msg
 }
 
 func (h *ClientHandler) sendMessage(msg model.WebsocketMessage) (err error) {
 	log.Debug("Entered to send message")
-	msgBytes, err := json.Marshal(msg)
+	msgBytes, err := model.EncodeMessage(h.protocol.Encoding, msg)
 	if err != nil {
 		log.Errorf("Error parsing: %v\n", err.Error())
 		return
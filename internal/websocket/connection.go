@@ -1,6 +1,9 @@
 package websocket
 
 import (
+	"sync"
+	"time"
+
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -8,12 +11,25 @@ import (
 	"github.com/osmancadc/go-encrypted-chat/internal/view"
 )
 
+const (
+	// writeWait bounds every write, so a peer that stops reading cannot hold
+	// the writer forever.
+	writeWait = 10 * time.Second
+	// closeWait bounds the close frame, which is best effort.
+	closeWait = time.Second
+)
+
 type Connection struct {
 	ID   string
 	conn *websocket.Conn
 	send chan []byte
 	User model.User
 	chat *tea.Program
+
+	// writeMu serializes writes, the websocket allows one writer at a time.
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func NewConnection(user model.User) *Connection {
@@ -24,8 +40,8 @@ func NewConnection(user model.User) *Connection {
 	}
 }
 
-func (c *Connection) SetChat() {
-	c.chat = tea.NewProgram(view.InitialModel(c.conn, c.User.Username))
+func (c *Connection) SetChat(charLimit int) {
+	c.chat = tea.NewProgram(view.InitialModel(c.conn, c.User.Username, charLimit))
 }
 
 func (c *Connection) GetChat() *tea.Program {
@@ -46,20 +62,31 @@ func (c *Connection) GetSendChan() chan []byte {
 
 func (c *Connection) WriteMessage(messageType int, data []byte) error {
 	if c.conn != nil {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 		return c.conn.WriteMessage(messageType, data)
 	}
 	return nil
 }
 
+// Close sends a close frame and closes the connection once, later calls
+// return the result of the first. It does not wait for a write in progress,
+// which fails once the connection is closed.
 func (c *Connection) Close() error {
-	if c.conn != nil {
-		err := c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		if err != nil {
-			return err
-		}
-		return c.conn.Close()
+	if c.conn == nil {
+		return nil
 	}
-	return nil
+
+	c.closeOnce.Do(func() {
+		c.closeErr = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeWait))
+		if err := c.conn.Close(); c.closeErr == nil {
+			c.closeErr = err
+		}
+	})
+
+	return c.closeErr
 }
 
 func (c *Connection) ReadMessage() (messageType int, p []byte, err error) {
@@ -0,0 +1,78 @@
+package websocket
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+// deviceRegistry counts the connections of each device of a user. The device
+// IDs are not authenticated, clients only trust devices with a certificate.
+type deviceRegistry map[string]map[string]int
+
+func (r deviceRegistry) connect(username, deviceID string) {
+	devices, ok := r[username]
+	if !ok {
+		devices = map[string]int{}
+		r[username] = devices
+	}
+	devices[deviceID]++
+}
+
+func (r deviceRegistry) disconnect(username, deviceID string) {
+	devices := r[username]
+	if devices == nil {
+		return
+	}
+	if devices[deviceID]--; devices[deviceID] <= 0 {
+		delete(devices, deviceID)
+	}
+	if len(devices) == 0 {
+		delete(r, username)
+	}
+}
+
+// message lists the connected devices of username.
+func (r deviceRegistry) message(username string) model.WebsocketMessage {
+	list := model.DeviceListPayload{UserID: username, Devices: []model.DeviceInfo{}}
+	for deviceID := range r[username] {
+		list.Devices = append(list.Devices, model.DeviceInfo{DeviceID: deviceID})
+	}
+	sort.Slice(list.Devices, func(i, j int) bool { return list.Devices[i].DeviceID < list.Devices[j].DeviceID })
+
+	return model.WebsocketMessage{Type: model.DeviceListType, Payload: list}
+}
+
+// mayListDevices tells whether the devices of username may be shown to
+// viewer: its own devices and the contacts it announced with its presence.
+// The caller must hold clientsMu.
+func (s *Server) mayListDevices(username, viewer string) bool {
+	if username == viewer {
+		return true
+	}
+	presence, ok := s.presence[username]
+
+	return ok && slices.Contains(presence.contacts, viewer)
+}
+
+// broadcastDevices sends the device list of username to its own devices and
+// to its contacts. The caller must hold clientsMu.
+func (s *Server) broadcastDevices(username string) {
+	frame := messageFrame(s.devices.message(username))
+	for _, client := range s.clients {
+		if s.mayListDevices(username, client.Conn.User.Username) {
+			client.queue(frame)
+		}
+	}
+}
+
+// sendDevices sends a client that just connected the device lists it may
+// see. The caller must hold clientsMu.
+func (s *Server) sendDevices(h *ServerHandler) {
+	for username := range s.devices {
+		if s.mayListDevices(username, h.Conn.User.Username) {
+			h.queue(messageFrame(s.devices.message(username)))
+		}
+	}
+}
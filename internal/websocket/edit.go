@@ -0,0 +1,54 @@
+package websocket
+
+import (
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+// sendEdit sends an edit or a deletion of a message of the user to every
+// contact and applies it to the history.
+func (h *ClientHandler) sendEdit(edit model.EditMessage) {
+	content := model.Content{Kind: model.ContentEdit, Target: edit.MessageID, Text: edit.Text}
+	if edit.Deleted {
+		content = model.Content{Kind: model.ContentDelete, Target: edit.MessageID}
+	}
+
+	h.sendToContacts(content, "")
+	h.applyEdit(h.Conn.User.Username, content)
+}
+
+// handleEdit applies an edit or a deletion from a contact. Only messages the
+// contact sent are matched, so nobody can change the messages of others.
+func (h *ClientHandler) handleEdit(senderID string, content model.Content) {
+	if content.Target == "" {
+		log.Warnf("Ignoring %s from %s without a target\n", content.Kind, senderID)
+		return
+	}
+
+	h.applyEdit(senderID, content)
+	h.notify(model.EditMessage{
+		UserID:    senderID,
+		MessageID: content.Target,
+		Text:      content.Text,
+		Deleted:   content.Kind == model.ContentDelete,
+	})
+}
+
+func (h *ClientHandler) applyEdit(senderID string, content model.Content) {
+	if h.history == nil {
+		return
+	}
+
+	_, err := h.history.Update(senderID, content.Target, func(entry *config.HistoryEntry) {
+		if content.Kind == model.ContentDelete {
+			entry.Content, entry.Deleted = "", true
+			return
+		}
+		if !entry.Deleted {
+			entry.Content, entry.Edited = content.Text, true
+		}
+	})
+	if err != nil {
+		log.Errorf("Error saving an edit to the history: %v\n", err)
+	}
+}
@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+func edits(h *ClientHandler) []model.EditMessage {
+	messages := []model.EditMessage{}
+	for len(h.externalMsgChan) > 0 {
+		if edit, ok := (<-h.externalMsgChan).(model.EditMessage); ok {
+			messages = append(messages, edit)
+		}
+	}
+
+	return messages
+}
+
+func TestEditAndDelete(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+	bob.history = config.OpenHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+
+	alice.announcePublicKey(true)
+	exchange(alice, bob)
+	alice.sendText(model.TextMessagePayload{MessageID: "message-1", Content: "helo"})
+	exchange(alice, bob)
+	incoming(bob)
+
+	alice.sendEdit(model.EditMessage{MessageID: "message-1", Text: "hello"})
+	exchange(alice, bob)
+	want := model.EditMessage{UserID: "alice", MessageID: "message-1", Text: "hello"}
+	if got := edits(bob); len(got) != 1 || got[0] != want {
+		t.Errorf("bob received %+v, want %+v", got, want)
+	}
+
+	// An edit can only match a message of its own sender.
+	bob.handleContent(model.TextMessagePayload{SenderID: "mallory"}, model.Content{Kind: model.ContentEdit, Target: "message-1", Text: "forged"})
+	entries, _ := bob.history.Load()
+	if len(entries) != 1 || entries[0].Content != "hello" || !entries[0].Edited {
+		t.Fatalf("history = %+v, want the edited message", entries)
+	}
+
+	alice.sendEdit(model.EditMessage{MessageID: "message-1", Deleted: true})
+	exchange(alice, bob)
+	entries, _ = bob.history.Load()
+	if len(entries) != 1 || entries[0].Content != "" || !entries[0].Deleted {
+		t.Errorf("history = %+v, want a tombstone", entries)
+	}
+}
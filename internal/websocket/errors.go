@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+// sendError tells the client why one of its frames was not accepted, and
+// logs the problem with the same correlation ID.
+func (h *ServerHandler) sendError(frameID, code, format string, args ...interface{}) {
+	h.queueError(frameID, model.ErrorPayload{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+func (h *ServerHandler) queueError(frameID string, payload model.ErrorPayload) {
+	payload.CorrelationID = frameID
+	if payload.CorrelationID == "" {
+		payload.CorrelationID = uuid.NewString()
+	}
+
+	h.server.log.Warnf("Rejecting frame %s of client %s: %v\n", payload.CorrelationID, h.Conn.User.Username, &payload)
+	h.queue(messageFrame(model.WebsocketMessage{Type: model.ErrorType, ID: frameID, Payload: payload}))
+}
+
+// handleError reports a refused copy of a message the user sent. A refusal
+// about one recipient only fails it for that recipient, the message fails
+// once no recipient is left. Refusals of receipts and signals are only logged.
+func (h *ClientHandler) handleError(payload model.ErrorPayload) {
+	log.Warnf("Server refused frame %s: %v\n", payload.CorrelationID, &payload)
+
+	h.sessionMu.Lock()
+	message, tracked := h.outgoing[payload.CorrelationID]
+	if tracked && payload.RecipientID != "" {
+		message.reached[payload.RecipientID] = model.DeliveryFailed
+	}
+	h.sessionMu.Unlock()
+
+	if !tracked {
+		return
+	}
+	h.notify(model.StatusMessage{Text: fmt.Sprintf("server error: %s (ref %s)", payload.Message, payload.CorrelationID)})
+
+	if payload.RecipientID == "" {
+		h.forgetOutgoing(payload.CorrelationID)
+		h.notify(model.DeliveryMessage{MessageID: payload.CorrelationID, State: model.DeliveryFailed})
+		return
+	}
+	h.checkProgress(payload.CorrelationID)
+}
+
+// connected reports whether a client of username other than h is connected.
+func (h *ServerHandler) connected(username string) bool {
+	h.server.clientsMu.Lock()
+	defer h.server.clientsMu.Unlock()
+
+	for _, client := range h.server.clients {
+		if client != h && client.Conn.User.Username == username {
+			return true
+		}
+	}
+
+	return false
+}
+
+// senderOf returns the user and device a frame claims to be sent by.
+func senderOf(envelope model.Envelope) (string, string, error) {
+	payload, err := envelope.Decode()
+	if err != nil {
+		return "", "", err
+	}
+
+	switch payload := payload.(type) {
+	case *model.TextMessagePayload:
+		return payload.SenderID, payload.SenderDevice, nil
+	case *model.SymmetricKeyExchangePayload:
+		return payload.SenderID, payload.SenderDevice, nil
+	case *model.PublicKeyExchangePayload:
+		return payload.UserID, payload.DeviceID, nil
+	}
+
+	return "", "", nil
+}
+
+// recipientOf returns the user a frame is addressed to, empty for frames
+// without a recipient.
+func recipientOf(envelope model.Envelope) (string, error) {
+	payload, err := envelope.Decode()
+	if err != nil {
+		return "", err
+	}
+
+	switch payload := payload.(type) {
+	case *model.TextMessagePayload:
+		return payload.RecipientID, nil
+	case *model.SymmetricKeyExchangePayload:
+		return payload.RecipientID, nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+// wireFrame is a frame on its way to clients that may speak different
+// encodings. Relayed frames are passed on as received to clients speaking
+// their encoding and decoded once for the others.
+type wireFrame struct {
+	message  *model.WebsocketMessage
+	envelope model.Envelope
+	encoded  map[string][]byte
+}
+
+func messageFrame(message model.WebsocketMessage) *wireFrame {
+	return &wireFrame{message: &message, encoded: map[string][]byte{}}
+}
+
+func relayedFrame(envelope model.Envelope, data []byte) *wireFrame {
+	return &wireFrame{envelope: envelope, encoded: map[string][]byte{envelope.Encoding: data}}
+}
+
+func (f *wireFrame) in(encoding string) ([]byte, error) {
+	if encoding == "" {
+		encoding = model.EncodingJSON
+	}
+	if data, ok := f.encoded[encoding]; ok {
+		return data, nil
+	}
+
+	if f.message == nil {
+		payload, err := f.envelope.Decode()
+		if err != nil {
+			return nil, err
+		}
+		f.message = &model.WebsocketMessage{Type: f.envelope.Type, ID: f.envelope.ID, Payload: payload}
+	}
+	data, err := model.EncodeMessage(encoding, *f.message)
+	if err != nil {
+		return nil, err
+	}
+	f.encoded[encoding] = data
+
+	return data, nil
+}
+
+// queue sends frame to the client in the encoding of its connection. It is
+// called with clientsMu held, so it never waits: a client too slow to take its
+// frames is disconnected and the frame dropped.
+func (h *ServerHandler) queue(frame *wireFrame) {
+	data, err := frame.in(h.protocol.Encoding)
+	if err != nil {
+		h.server.log.Errorf("Error encoding a frame for client %s: %v\n", h.Conn.User.Username, err)
+		return
+	}
+
+	select {
+	case h.Conn.GetSendChan() <- data:
+	default:
+		h.server.log.Warnf("Disconnecting client %s, its send queue is full\n", h.Conn.ID)
+		go h.Conn.Close()
+	}
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// Features and suites offered by this build.
+var (
+	clientFeatures = []string{model.FeatureReceipts, model.FeatureCompression, model.FeaturePresence}
+	serverFeatures = []string{model.FeatureReceipts, model.FeatureCompression, model.FeaturePresence}
+	suites         = []string{model.SuiteRSAAESGCM}
+	encodings      = []string{model.EncodingCBOR, model.EncodingJSON}
+)
+
+var dialer = &websocket.Dialer{
+	Proxy:             websocket.DefaultDialer.Proxy,
+	HandshakeTimeout:  websocket.DefaultDialer.HandshakeTimeout,
+	EnableCompression: true,
+}
+
+// clientHandshake sends the hello of user, asking for encoding, and waits for
+// the welcome of the server. A refusal is returned as an *model.ErrorPayload.
+// The handshake itself is always JSON.
+func clientHandshake(conn *websocket.Conn, user model.User, encoding string) (model.WelcomePayload, error) {
+	err := conn.WriteJSON(model.WebsocketMessage{
+		Type: model.HelloType,
+		Payload: model.HelloPayload{
+			Username:   user.Username,
+			DeviceID:   user.DeviceID,
+			MinVersion: model.MinProtocolVersion,
+			MaxVersion: model.ProtocolVersion,
+			Features:   clientFeatures,
+			Suites:     suites,
+			Encodings:  []string{encoding, model.EncodingJSON},
+		},
+	})
+	if err != nil {
+		return model.WelcomePayload{}, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return model.WelcomePayload{}, fmt.Errorf("no welcome from the server: %w", err)
+	}
+	envelope, err := model.ParseEnvelope(message)
+	if err != nil {
+		return model.WelcomePayload{}, err
+	}
+	payload, err := envelope.Decode()
+	if err != nil {
+		return model.WelcomePayload{}, err
+	}
+
+	switch payload := payload.(type) {
+	case *model.WelcomePayload:
+		conn.EnableWriteCompression(payload.Has(model.FeatureCompression))
+		return *payload, nil
+	case *model.ErrorPayload:
+		return model.WelcomePayload{}, payload
+	default:
+		return model.WelcomePayload{}, fmt.Errorf("expected %s, got %s", model.WelcomeType, envelope.Type)
+	}
+}
+
+// readHello reads the hello a client opens with and negotiates what the
+// connection uses. Clients of the protocol before versioning open with a
+// usernameMessage and are refused as version 0.
+func readHello(conn *websocket.Conn) (model.User, model.WelcomePayload, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return model.User{}, model.WelcomePayload{}, err
+	}
+
+	envelope, err := model.ParseEnvelope(message)
+	if err != nil {
+		return model.User{}, model.WelcomePayload{}, &model.ErrorPayload{Code: model.ErrorCodeBadHandshake, Message: err.Error()}
+	}
+	switch envelope.Type {
+	case model.HelloType:
+	case model.UsernameMessageType:
+		return model.User{}, model.WelcomePayload{}, &model.ErrorPayload{
+			Code:    model.ErrorCodeVersionMismatch,
+			Message: fmt.Sprintf("the client speaks version 0, the server %d to %d", model.MinProtocolVersion, model.ProtocolVersion),
+		}
+	default:
+		return model.User{}, model.WelcomePayload{}, &model.ErrorPayload{
+			Code:    model.ErrorCodeBadHandshake,
+			Message: fmt.Sprintf("expected %s, got %s", model.HelloType, envelope.Type),
+		}
+	}
+
+	payload, err := envelope.Decode()
+	if err != nil {
+		return model.User{}, model.WelcomePayload{}, &model.ErrorPayload{Code: model.ErrorCodeBadHandshake, Message: err.Error()}
+	}
+	hello := payload.(*model.HelloPayload)
+
+	welcome, err := hello.Negotiate(serverFeatures, suites, encodings)
+	if err != nil {
+		return model.User{}, model.WelcomePayload{}, err
+	}
+
+	return model.User{Username: hello.Username, DeviceID: hello.DeviceID}, welcome, nil
+}
+
+// refuse sends the structured error to the client before closing.
+func refuse(conn *websocket.Conn, refusal *model.ErrorPayload) {
+	conn.WriteJSON(model.WebsocketMessage{Type: model.ErrorType, Payload: refusal})
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, refusal.Code), time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// frameType is the WebSocket frame type carrying encoding.
+func frameType(encoding string) int {
+	if encoding == model.EncodingCBOR {
+		return websocket.BinaryMessage
+	}
+
+	return websocket.TextMessage
+}
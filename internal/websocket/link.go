@@ -0,0 +1,261 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+const (
+	linkCodeAlphabet = "ABCDEFGHJKMNPQRSTVWXYZ23456789"
+	linkCodeLength   = 10
+	linkCodeTimeout  = 5 * time.Minute
+)
+
+// linkState holds the one-time code of a device link in progress: the code
+// shown on the device holding the identity key, or the code typed on the new
+// device. It is guarded by sessionMu.
+type linkState struct {
+	code    string
+	expires time.Time
+}
+
+func newLinkCode() (string, error) {
+	code := make([]byte, 0, linkCodeLength)
+	for len(code) < linkCodeLength {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(linkCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code = append(code, linkCodeAlphabet[n.Int64()])
+	}
+
+	return string(code), nil
+}
+
+func normalizeLinkCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func formatLinkCode(code string) string {
+	return code[:linkCodeLength/2] + "-" + code[linkCodeLength/2:]
+}
+
+// LinkWith makes Run link this device to the account with the code shown on
+// a device that holds the identity key, instead of using its own key as the
+// identity.
+func (h *ClientHandler) LinkWith(code string) {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	h.link = linkState{code: normalizeLinkCode(code)}
+}
+
+func (h *ClientHandler) linking() bool {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	return h.link.code != "" && h.config.GetCertificate() == nil
+}
+
+func (h *ClientHandler) takeLinkCode() (string, bool) {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	code := h.link.code
+	h.link = linkState{}
+
+	return code, code != ""
+}
+
+func (h *ClientHandler) requestLink() error {
+	publicKey, err := h.config.GetRsaInstance().GetPublicKeyValue()
+	if err != nil {
+		return err
+	}
+
+	request := model.DeviceLinkRequestPayload{
+		UserID:    h.Conn.User.Username,
+		DeviceID:  h.Conn.User.DeviceID,
+		PublicKey: publicKey,
+	}
+
+	h.sessionMu.Lock()
+	request.Proof, err = model.LinkProof(h.link.code, request.ProofData())
+	h.sessionMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	h.notify(model.StatusMessage{Text: "waiting for your other device to confirm the link..."})
+
+	return h.sendMessage(model.WebsocketMessage{
+		Type:    model.DeviceLinkRequestType,
+		Payload: request,
+	})
+}
+
+func (h *ClientHandler) startLink() {
+	if h.config.GetCertificate() != nil {
+		h.notify(model.StatusMessage{Text: "only the device holding your identity key can link new devices"})
+		return
+	}
+
+	code, err := newLinkCode()
+	if err != nil {
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("could not create a link code: %v", err)})
+		return
+	}
+
+	h.sessionMu.Lock()
+	h.link = linkState{code: code, expires: time.Now().Add(linkCodeTimeout)}
+	h.sessionMu.Unlock()
+
+	h.notify(model.StatusMessage{Text: fmt.Sprintf("link code %s, start the new device with -link %s within %s", formatLinkCode(code), formatLinkCode(code), linkCodeTimeout)})
+}
+
+func (h *ClientHandler) handleLinkRequest(request model.DeviceLinkRequestPayload) {
+	if request.UserID != h.Conn.User.Username || request.DeviceID == h.Conn.User.DeviceID {
+		return
+	}
+
+	h.sessionMu.Lock()
+	link := h.link
+	h.sessionMu.Unlock()
+	if link.code == "" || link.expires.IsZero() {
+		return
+	}
+
+	// The code is spent on the first attempt, so it cannot be guessed online.
+	code, _ := h.takeLinkCode()
+	if time.Now().After(link.expires) {
+		h.notify(model.StatusMessage{Text: "the link code expired, run /link again"})
+		return
+	}
+	if !model.VerifyLinkProof(code, request.ProofData(), request.Proof) {
+		log.Warnf("Rejected a device link request for %s with a wrong code\n", request.DeviceID)
+		h.notify(model.StatusMessage{Text: "rejected a device link attempt with a wrong code, run /link again"})
+		return
+	}
+	if _, err := crypto.ParseRSAPublicKey(request.PublicKey); err != nil {
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("rejected a device link with an invalid key: %v", err)})
+		return
+	}
+
+	response := model.DeviceLinkResponsePayload{
+		Certificate: identity.DeviceCertificate{
+			UserID:    request.UserID,
+			DeviceID:  request.DeviceID,
+			DeviceKey: request.PublicKey,
+			Time:      time.Now().UTC(),
+		},
+	}
+	err := identity.SignDeviceCertificate(&response.Certificate, *h.config.GetRsaInstance())
+	if err == nil {
+		response.Proof, err = model.LinkProof(code, response.ProofData())
+	}
+	if err == nil {
+		err = h.sendMessage(model.WebsocketMessage{Type: model.DeviceLinkResponseType, Payload: response})
+	}
+	if err != nil {
+		log.Errorf("Error linking device %s: %v\n", request.DeviceID, err)
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("could not link device %s: %v", request.DeviceID, err)})
+		return
+	}
+
+	log.Infof("Linked device %s\n", request.DeviceID)
+	h.notify(model.StatusMessage{Text: fmt.Sprintf("linked device %s, fingerprint %s", request.DeviceID, crypto.Fingerprint(request.PublicKey))})
+}
+
+func (h *ClientHandler) handleLinkResponse(response model.DeviceLinkResponsePayload) {
+	certificate := response.Certificate
+	if certificate.UserID != h.Conn.User.Username || certificate.DeviceID != h.Conn.User.DeviceID || !h.linking() {
+		return
+	}
+
+	h.sessionMu.Lock()
+	code := h.link.code
+	h.sessionMu.Unlock()
+	if !model.VerifyLinkProof(code, response.ProofData(), response.Proof) {
+		log.Warn("Ignoring a device link response with a wrong code")
+		return
+	}
+
+	publicKey, err := h.config.GetRsaInstance().GetPublicKeyValue()
+	if err != nil {
+		return
+	}
+	identityKey, err := identity.VerifyDeviceCertificate(&certificate, h.Conn.User.Username, h.Conn.User.DeviceID, publicKey)
+	if err != nil {
+		log.Warnf("Ignoring an invalid device certificate: %v\n", err)
+		return
+	}
+
+	if err := h.config.SetCertificate(&certificate); err != nil {
+		log.Errorf("Error saving the device certificate: %v\n", err)
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("could not save the device certificate: %v", err)})
+		return
+	}
+	h.takeLinkCode()
+
+	log.Info("Device linked")
+	h.notify(model.StatusMessage{Text: fmt.Sprintf("this device is now linked, identity fingerprint %s", crypto.Fingerprint(identityKey))})
+
+	if err := h.announcePublicKey(true); err != nil {
+		log.Errorf("Error announcing public key: %v\n", err)
+	}
+}
+
+func (h *ClientHandler) showDevices(args []string) {
+	userID := h.Conn.User.Username
+	if len(args) > 0 {
+		userID = args[0]
+	}
+
+	h.sessionMu.Lock()
+	online := map[string]model.DeviceInfo{}
+	for _, device := range h.deviceLists[userID] {
+		online[device.DeviceID] = device
+	}
+	h.sessionMu.Unlock()
+
+	// Only certified devices of contacts are listed, the server list is not
+	// authenticated and only says which of them are connected.
+	deviceIDs := []string{}
+	if userID == h.Conn.User.Username {
+		for deviceID := range online {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	} else {
+		for deviceID := range h.config.GetDevices(userID) {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("no devices known for %s", userID)})
+		return
+	}
+	slices.Sort(deviceIDs)
+
+	descriptions := make([]string, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		_, connected := online[deviceID]
+		state := "offline"
+		switch {
+		case deviceID == h.Conn.User.DeviceID && userID == h.Conn.User.Username:
+			state = "this device"
+		case connected:
+			state = "online"
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", deviceID, state))
+	}
+
+	h.notify(model.StatusMessage{Text: fmt.Sprintf("devices of %s: %s", userID, strings.Join(descriptions, ", "))})
+}
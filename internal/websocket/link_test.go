@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+var testKeys = crypto.NewKeyPool(1024, 4)
+
+func newTestClient(t *testing.T, username string) *ClientHandler {
+	t.Helper()
+
+	cfg, err := config.New(context.Background(), "", testKeys)
+	if err != nil {
+		t.Fatalf("config.New() error = %v", err)
+	}
+
+	user := model.User{Username: username, DeviceID: cfg.GetDeviceID()}
+	handler := NewClientHandler(NewConnection(user), cfg, testKeys, config.ClientSettings{})
+	handler.externalMsgChan = make(chan tea.Msg, 100)
+
+	return handler
+}
+
+// deliver hands every frame sent by from to the handlers, like the server does.
+func deliver(from *ClientHandler, to ...*ClientHandler) {
+	for {
+		select {
+		case frame := <-from.Conn.GetSendChan():
+			for _, handler := range to {
+				handler.handleMessage(frame)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func frameTypes(t *testing.T, h *ClientHandler) []string {
+	t.Helper()
+
+	types := []string{}
+	for {
+		select {
+		case frame := <-h.Conn.GetSendChan():
+			var message model.WebsocketMessage
+			json.Unmarshal(frame, &message)
+			types = append(types, message.Type)
+		default:
+			return types
+		}
+	}
+}
+
+func incoming(h *ClientHandler) []model.IncomingMessage {
+	messages := []model.IncomingMessage{}
+	for {
+		select {
+		case msg := <-h.externalMsgChan:
+			if message, ok := msg.(model.IncomingMessage); ok {
+				messages = append(messages, message)
+			}
+		default:
+			return messages
+		}
+	}
+}
+
+func TestDeviceLinking(t *testing.T) {
+	workstation := newTestClient(t, "alice")
+	laptop := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+
+	workstation.startLink()
+	laptop.LinkWith(formatLinkCode(workstation.link.code))
+
+	if err := laptop.announcePublicKey(true); err != nil {
+		t.Fatalf("announcePublicKey() error = %v", err)
+	}
+	if types := frameTypes(t, laptop); len(types) != 0 {
+		t.Fatalf("device announced %v before it was linked", types)
+	}
+
+	if err := laptop.requestLink(); err != nil {
+		t.Fatalf("requestLink() error = %v", err)
+	}
+	deliver(laptop, workstation)
+	deliver(workstation, laptop)
+
+	certificate := laptop.config.GetCertificate()
+	if certificate == nil {
+		t.Fatalf("laptop was not linked")
+	}
+	identityKey, _ := workstation.config.GetRsaInstance().GetPublicKeyValue()
+	if linkedIdentity, _ := laptop.config.GetIdentityKey(); string(linkedIdentity) != string(identityKey) {
+		t.Errorf("laptop identity is not the identity key of the workstation")
+	}
+
+	// The laptop announced itself once linked, the workstation announces now.
+	deliver(laptop, bob)
+	workstation.announcePublicKey(false)
+	deliver(workstation, bob)
+
+	if contact, _ := bob.config.GetContact("alice"); string(contact.PublicKey) != string(identityKey) {
+		t.Errorf("bob does not trust the identity key of alice")
+	}
+	if devices := bob.config.GetDevices("alice"); len(devices) != 2 {
+		t.Fatalf("bob knows %d devices of alice, want 2", len(devices))
+	}
+
+	bob.sendText(model.TextMessagePayload{MessageID: "message-1", Content: "hello both"})
+	frames := [][]byte{}
+	for len(bob.Conn.GetSendChan()) > 0 {
+		frames = append(frames, <-bob.Conn.GetSendChan())
+	}
+	for _, frame := range frames {
+		workstation.handleMessage(frame)
+		laptop.handleMessage(frame)
+	}
+
+	for name, device := range map[string]*ClientHandler{"workstation": workstation, "laptop": laptop} {
+		messages := incoming(device)
+		if len(messages) != 1 || messages[0].Message.Content != "hello both" {
+			t.Errorf("%s received %+v, want one copy of the message", name, messages)
+		}
+	}
+}
+
+func TestDeviceLinking_WrongCode(t *testing.T) {
+	workstation := newTestClient(t, "alice")
+	laptop := newTestClient(t, "alice")
+
+	workstation.startLink()
+	laptop.LinkWith("WRONG-CODE0")
+	laptop.requestLink()
+	deliver(laptop, workstation)
+
+	if types := frameTypes(t, workstation); len(types) != 0 {
+		t.Errorf("workstation answered a wrong code with %v", types)
+	}
+	if workstation.link.code != "" {
+		t.Errorf("link code was not spent by the failed attempt")
+	}
+
+	laptop.LinkWith(formatLinkCode("ABCDEFGHJK"))
+	workstation.link = linkState{code: "ABCDEFGHJK", expires: time.Now().Add(-time.Second)}
+	laptop.requestLink()
+	deliver(laptop, workstation)
+	if types := frameTypes(t, workstation); len(types) != 0 {
+		t.Errorf("workstation answered an expired code with %v", types)
+	}
+}
@@ -0,0 +1,201 @@
+package websocket
+
+import (
+	"slices"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+const maxPresenceContacts = 1000
+
+// userPresence is what the server knows about the presence of a user. It is
+// kept after the user disconnects to answer with the last-seen time.
+type userPresence struct {
+	contacts     []string
+	hideLastSeen bool
+	lastSeen     time.Time
+}
+
+// presenceRegistry is guarded by clientsMu, like the client map.
+type presenceRegistry map[string]*userPresence
+
+// updatePresence applies the presence a client announced and pushes it and
+// the devices of the user to its contacts.
+func (h *ServerHandler) updatePresence(frameID string, update model.PresenceUpdatePayload) {
+	if update.State != model.PresenceOnline && update.State != model.PresenceAway {
+		h.sendError(frameID, model.ErrorCodeInvalidFrame, "unknown presence state %q", update.State)
+		return
+	}
+	if len(update.Contacts) > maxPresenceContacts {
+		h.sendError(frameID, model.ErrorCodeInvalidFrame, "more than %d contacts in the presence update", maxPresenceContacts)
+		return
+	}
+	contacts := make([]string, 0, len(update.Contacts))
+	for _, contact := range update.Contacts {
+		if err := identity.ValidateUsername(contact); err != nil {
+			h.sendError(frameID, model.ErrorCodeInvalidFrame, "invalid contact %q: %v", contact, err)
+			return
+		}
+		if contact != h.Conn.User.Username && !slices.Contains(contacts, contact) {
+			contacts = append(contacts, contact)
+		}
+	}
+
+	h.server.clientsMu.Lock()
+	defer h.server.clientsMu.Unlock()
+
+	h.presence = update.State
+	presence := h.server.presence.get(h.Conn.User.Username)
+	presence.contacts = contacts
+	presence.hideLastSeen = update.HideLastSeen
+	h.server.broadcastPresence(h.Conn.User.Username)
+	if _, ok := h.server.devices[h.Conn.User.Username]; ok {
+		h.server.broadcastDevices(h.Conn.User.Username)
+	}
+}
+
+func (r presenceRegistry) get(username string) *userPresence {
+	presence, ok := r[username]
+	if !ok {
+		presence = &userPresence{}
+		r[username] = presence
+	}
+
+	return presence
+}
+
+// presenceOf is online while any device of the user is online, away while
+// all of them are away, and offline when none is connected. The caller must
+// hold clientsMu.
+func (s *Server) presenceOf(username string) model.PresencePayload {
+	payload := model.PresencePayload{UserID: username, State: model.PresenceOffline}
+	for _, client := range s.clients {
+		if client.Conn.User.Username != username || client.presence == "" {
+			continue
+		}
+		if payload.State != model.PresenceOnline {
+			payload.State = client.presence
+		}
+	}
+
+	presence := s.presence[username]
+	if payload.State == model.PresenceOffline && presence != nil && !presence.hideLastSeen && !presence.lastSeen.IsZero() {
+		lastSeen := presence.lastSeen
+		payload.LastSeen = &lastSeen
+	}
+
+	return payload
+}
+
+// broadcastPresence sends the presence of username to the connected devices
+// of its contacts. The caller must hold clientsMu.
+func (s *Server) broadcastPresence(username string) {
+	presence, ok := s.presence[username]
+	if !ok {
+		return
+	}
+
+	frame := messageFrame(model.WebsocketMessage{Type: model.PresenceType, Payload: s.presenceOf(username)})
+	for _, client := range s.clients {
+		if client.protocol.Has(model.FeaturePresence) && slices.Contains(presence.contacts, client.Conn.User.Username) {
+			client.queue(frame)
+		}
+	}
+}
+
+// sendPresences sends a client that just connected the presence of every
+// user that has it as a contact. The caller must hold clientsMu.
+func (s *Server) sendPresences(h *ServerHandler) {
+	if !h.protocol.Has(model.FeaturePresence) {
+		return
+	}
+
+	for username, presence := range s.presence {
+		if username != h.Conn.User.Username && slices.Contains(presence.contacts, h.Conn.User.Username) {
+			h.queue(messageFrame(model.WebsocketMessage{Type: model.PresenceType, Payload: s.presenceOf(username)}))
+		}
+	}
+}
+
+// leavePresence records when the user was last seen and pushes its presence
+// once its last device disconnected. The caller must hold clientsMu.
+func (s *Server) leavePresence(username string, now time.Time) {
+	presence, ok := s.presence[username]
+	if !ok {
+		return
+	}
+
+	presence.lastSeen = now.UTC()
+	s.broadcastPresence(username)
+}
+
+// sendPresence tells the server the presence of the user and who may see it
+// and its devices: the contacts the user accepted or verified, never those
+// only trusted on first use.
+func (h *ClientHandler) sendPresence(state string) {
+	if !h.protocol.Has(model.FeaturePresence) {
+		return
+	}
+
+	h.sessionMu.Lock()
+	h.presence = state
+	h.sessionMu.Unlock()
+
+	contacts := h.config.GetAcceptedUserIDs()
+	if len(contacts) > maxPresenceContacts {
+		contacts = contacts[:maxPresenceContacts]
+	}
+	err := h.sendMessage(model.WebsocketMessage{
+		Type: model.PresenceUpdateType,
+		Payload: model.PresenceUpdatePayload{
+			State:        state,
+			Contacts:     contacts,
+			HideLastSeen: h.settings.HideLastSeen,
+		},
+	})
+	if err != nil {
+		log.Errorf("Error sending presence: %v\n", err)
+	}
+}
+
+// resendPresence sends the presence again after the contacts allowed to see
+// it changed.
+func (h *ClientHandler) resendPresence() {
+	if state := h.currentPresence(); state != "" {
+		h.sendPresence(state)
+	}
+}
+
+func (h *ClientHandler) currentPresence() string {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	return h.presence
+}
+
+func (h *ClientHandler) handlePresence(payload model.PresencePayload) {
+	h.sessionMu.Lock()
+	h.contactPresence[payload.UserID] = payload.State
+	h.sessionMu.Unlock()
+
+	if payload.State != model.PresenceOffline {
+		h.sendHeldReads(payload.UserID)
+	}
+
+	presence := model.PresenceMessage{UserID: payload.UserID, State: payload.State}
+	if payload.LastSeen != nil {
+		presence.LastSeen = *payload.LastSeen
+	}
+	h.notify(presence)
+}
+
+// knownOffline reports whether the server said userID is offline. Signals to
+// it would only be refused.
+func (h *ClientHandler) knownOffline(userID string) bool {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	return h.contactPresence[userID] == model.PresenceOffline
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+func TestPresenceOnlyToAcceptedContacts(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+	carol := newTestClient(t, "carol")
+	alice.protocol.Features = []string{model.FeaturePresence}
+
+	// Both are trusted on first use by merely connecting.
+	bob.announcePublicKey(true)
+	carol.announcePublicKey(true)
+	deliver(bob, alice)
+	deliver(carol, alice)
+	drainFrames(alice)
+
+	presenceContacts := func() []string {
+		t.Helper()
+		var message struct {
+			Type    string                      `json:"type"`
+			Payload model.PresenceUpdatePayload `json:"payload"`
+		}
+		for _, frame := range drainFrames(alice) {
+			if json.Unmarshal(frame, &message) == nil && message.Type == model.PresenceUpdateType {
+				return message.Payload.Contacts
+			}
+		}
+		t.Fatal("no presence update was sent")
+		return nil
+	}
+
+	alice.sendPresence(model.PresenceOnline)
+	if got := presenceContacts(); len(got) != 0 {
+		t.Errorf("presence shared with %v, want nobody", got)
+	}
+
+	alice.handleCommand(model.Command{Name: "accept", Args: []string{"bob"}})
+	if got := presenceContacts(); !slices.Equal(got, []string{"bob"}) {
+		t.Errorf("presence shared with %v, want [bob]", got)
+	}
+}
+
+func drainFrames(h *ClientHandler) [][]byte {
+	frames := [][]byte{}
+	for {
+		select {
+		case frame := <-h.Conn.GetSendChan():
+			frames = append(frames, frame)
+		default:
+			return frames
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package websocket
+
+import "time"
+
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow implements a token bucket whose rate and burst are read on every call,
+// so reloaded limits apply to connections that are already open.
+func (r *rateLimiter) allow(rate, burst int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	capacity := float64(rate + burst)
+	if r.last.IsZero() {
+		r.tokens = capacity
+	} else {
+		r.tokens += now.Sub(r.last).Seconds() * float64(rate)
+		if r.tokens > capacity {
+			r.tokens = capacity
+		}
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+
+	return true
+}
@@ -0,0 +1,47 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	start := time.Unix(0, 0)
+
+	tests := []struct {
+		name        string
+		rate, burst int
+		sends       []time.Duration
+		want        []bool
+	}{
+		{
+			name:  "Disabled limit allows everything",
+			rate:  0,
+			sends: []time.Duration{0, 0, 0},
+			want:  []bool{true, true, true},
+		},
+		{
+			name:  "Burst is spent before refusing",
+			rate:  1,
+			burst: 1,
+			sends: []time.Duration{0, 0, 0},
+			want:  []bool{true, true, false},
+		},
+		{
+			name:  "Tokens refill over time",
+			rate:  1,
+			sends: []time.Duration{0, 0, time.Second},
+			want:  []bool{true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := rateLimiter{}
+			for i, offset := range tt.sends {
+				if got := limiter.allow(tt.rate, tt.burst, start.Add(offset)); got != tt.want[i] {
+					t.Errorf("rateLimiter.allow() call %d = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
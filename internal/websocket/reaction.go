@@ -0,0 +1,54 @@
+package websocket
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+// sendReaction sends a reaction of the user to every contact and records it
+// in the history.
+func (h *ClientHandler) sendReaction(reaction model.ReactionMessage) {
+	content := model.Content{Kind: model.ContentReaction, Target: reaction.MessageID, Text: reaction.Emoji, Remove: reaction.Removed}
+
+	h.sendToContacts(content, "")
+	h.applyReaction(h.Conn.User.Username, content)
+}
+
+func (h *ClientHandler) handleReaction(senderID string, content model.Content) {
+	if content.Target == "" || content.Text == "" || len(content.Text) > model.MaxReactionLength || strings.ContainsAny(content.Text, " \t\r\n") {
+		log.Warnf("Ignoring an invalid reaction from %s\n", senderID)
+		return
+	}
+
+	h.applyReaction(senderID, content)
+	h.notify(model.ReactionMessage{UserID: senderID, MessageID: content.Target, Emoji: content.Text, Removed: content.Remove})
+}
+
+// applyReaction records who reacted with what. Adding and removing are
+// explicit, so a reaction received twice changes nothing.
+func (h *ClientHandler) applyReaction(userID string, content model.Content) {
+	if h.history == nil {
+		return
+	}
+
+	_, err := h.history.UpdateMessage(content.Target, func(entry *config.HistoryEntry) {
+		users := slices.DeleteFunc(entry.Reactions[content.Text], func(user string) bool { return user == userID })
+		if !content.Remove {
+			users = append(users, userID)
+		}
+
+		if entry.Reactions == nil {
+			entry.Reactions = map[string][]string{}
+		}
+		entry.Reactions[content.Text] = users
+		if len(users) == 0 {
+			delete(entry.Reactions, content.Text)
+		}
+	})
+	if err != nil {
+		log.Errorf("Error saving a reaction to the history: %v\n", err)
+	}
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+func TestReactions(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+	alice.history = config.OpenHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+
+	alice.announcePublicKey(true)
+	exchange(alice, bob)
+	alice.sendText(model.TextMessagePayload{MessageID: "message-1", Content: "lunch?"})
+	exchange(alice, bob)
+
+	tests := []struct {
+		name     string
+		reaction model.ReactionMessage
+		want     map[string][]string
+	}{
+		{name: "Adds a reaction", reaction: model.ReactionMessage{MessageID: "message-1", Emoji: "👍"}, want: map[string][]string{"👍": {"alice", "bob"}}},
+		{name: "Adding twice changes nothing", reaction: model.ReactionMessage{MessageID: "message-1", Emoji: "👍"}, want: map[string][]string{"👍": {"alice", "bob"}}},
+		{name: "Removes a reaction", reaction: model.ReactionMessage{MessageID: "message-1", Emoji: "👍", Removed: true}, want: map[string][]string{"👍": {"alice"}}},
+	}
+	alice.sendReaction(model.ReactionMessage{MessageID: "message-1", Emoji: "👍"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bob.sendReaction(tt.reaction)
+			exchange(alice, bob)
+
+			received := []model.ReactionMessage{}
+			for len(alice.externalMsgChan) > 0 {
+				if reaction, ok := (<-alice.externalMsgChan).(model.ReactionMessage); ok {
+					received = append(received, reaction)
+				}
+			}
+			tt.reaction.UserID = "bob"
+			if len(received) != 1 || received[0] != tt.reaction {
+				t.Errorf("alice received %+v, want %+v", received, tt.reaction)
+			}
+
+			entries, _ := alice.history.Load()
+			if len(entries) != 1 || len(entries[0].Reactions) != len(tt.want) {
+				t.Fatalf("history = %+v, want reactions %v", entries, tt.want)
+			}
+			for emoji, users := range tt.want {
+				got := slices.Sorted(slices.Values(entries[0].Reactions[emoji]))
+				if !slices.Equal(got, users) {
+					t.Errorf("%s reactions = %v, want %v", emoji, got, users)
+				}
+			}
+		})
+	}
+}
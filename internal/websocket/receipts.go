@@ -0,0 +1,200 @@
+package websocket
+
+import (
+	"slices"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+const (
+	maxOutgoingMessages = 1000
+	maxHeldReads        = 1000
+)
+
+// outgoingMessage tracks a sent message until every recipient confirmed it.
+// reached holds the furthest state confirmed by each recipient, or failed
+// when the server refused its copy.
+type outgoingMessage struct {
+	created    time.Time
+	state      string
+	recipients []string
+	reached    map[string]string
+}
+
+func (h *ClientHandler) trackOutgoing(messageID string) {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	if len(h.outgoing) >= maxOutgoingMessages {
+		oldestID := ""
+		for id, message := range h.outgoing {
+			if oldestID == "" || message.created.Before(h.outgoing[oldestID].created) {
+				oldestID = id
+			}
+		}
+		delete(h.outgoing, oldestID)
+	}
+	h.outgoing[messageID] = &outgoingMessage{created: time.Now(), state: model.DeliverySent, reached: map[string]string{}}
+}
+
+func (h *ClientHandler) forgetOutgoing(messageID string) {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	delete(h.outgoing, messageID)
+}
+
+func (h *ClientHandler) setRecipients(messageID string, recipients []string) {
+	h.sessionMu.Lock()
+	if message, ok := h.outgoing[messageID]; ok {
+		message.recipients = recipients
+	}
+	h.sessionMu.Unlock()
+
+	// Receipts may arrive before the recipients are known.
+	h.checkProgress(messageID)
+}
+
+// handleAck records that the server accepted a copy of a message.
+func (h *ClientHandler) handleAck(messageID string) {
+	h.sessionMu.Lock()
+	message, ok := h.outgoing[messageID]
+	stored := ok && message.state == model.DeliverySent
+	if stored {
+		message.state = model.DeliveryStored
+	}
+	h.sessionMu.Unlock()
+
+	if stored {
+		h.notify(model.DeliveryMessage{MessageID: messageID, State: model.DeliveryStored})
+	}
+}
+
+// handleReceipt records that a device of userID received or read the
+// messages.
+func (h *ClientHandler) handleReceipt(userID string, messageIDs []string, state string) {
+	for _, messageID := range messageIDs {
+		h.sessionMu.Lock()
+		message, ok := h.outgoing[messageID]
+		if ok && message.reached[userID] != model.DeliveryFailed && deliveryRank(state) > deliveryRank(message.reached[userID]) {
+			message.reached[userID] = state
+		}
+		h.sessionMu.Unlock()
+
+		if ok {
+			h.checkProgress(messageID)
+		}
+	}
+}
+
+// checkProgress notifies the state every recipient still reachable reached,
+// and stops tracking the message once nothing more can be confirmed. The
+// message fails when it could not reach any recipient.
+func (h *ClientHandler) checkProgress(messageID string) {
+	h.sessionMu.Lock()
+	message, ok := h.outgoing[messageID]
+	if !ok || len(message.recipients) == 0 {
+		h.sessionMu.Unlock()
+		return
+	}
+
+	reached := deliveryRank(model.DeliveryRead)
+	reachable := 0
+	for _, userID := range message.recipients {
+		if message.reached[userID] == model.DeliveryFailed {
+			continue
+		}
+		reachable++
+		reached = min(reached, deliveryRank(message.reached[userID]))
+	}
+	if reachable == 0 {
+		delete(h.outgoing, messageID)
+		h.sessionMu.Unlock()
+		h.notify(model.DeliveryMessage{MessageID: messageID, State: model.DeliveryFailed})
+		return
+	}
+	advanced := reached > deliveryRank(message.state)
+	if advanced {
+		message.state = model.DeliveryStates[reached]
+	}
+	last := model.DeliveryDelivered
+	if h.settings.ReadReceipts {
+		last = model.DeliveryRead
+	}
+	if reached >= deliveryRank(last) {
+		delete(h.outgoing, messageID)
+	}
+	state := message.state
+	h.sessionMu.Unlock()
+
+	if advanced {
+		h.notify(model.DeliveryMessage{MessageID: messageID, State: state})
+	}
+}
+
+func deliveryRank(state string) int {
+	return slices.Index(model.DeliveryStates, state)
+}
+
+// sendReceipt confirms a message to the device that sent it.
+func (h *ClientHandler) sendReceipt(textMsg model.TextMessagePayload) {
+	if textMsg.MessageID == "" {
+		return
+	}
+
+	receipt := model.Content{Kind: model.ContentReceipt, MessageIDs: []string{textMsg.MessageID}}
+	if err := h.sendContent(textMsg.SenderID, textMsg.SenderDevice, receipt, ""); err != nil {
+		log.Errorf("Error sending a receipt to %s: %v\n", identity.DeviceAddress(textMsg.SenderID, textMsg.SenderDevice), err)
+	}
+}
+
+// sendRead tells the device that sent the messages they were shown. Nothing
+// is sent when read receipts are turned off, and receipts to an offline
+// sender are held until it comes back.
+func (h *ClientHandler) sendRead(read model.ReadMessage) {
+	if !h.settings.ReadReceipts || len(read.MessageIDs) == 0 {
+		return
+	}
+	if h.knownOffline(read.UserID) {
+		h.holdRead(read)
+		return
+	}
+
+	receipt := model.Content{Kind: model.ContentRead, MessageIDs: read.MessageIDs}
+	if err := h.sendContent(read.UserID, read.DeviceID, receipt, ""); err != nil {
+		log.Errorf("Error sending a read receipt to %s: %v\n", identity.DeviceAddress(read.UserID, read.DeviceID), err)
+	}
+}
+
+// holdRead keeps the read receipts for an offline device, up to the last
+// maxHeldReads messages.
+func (h *ClientHandler) holdRead(read model.ReadMessage) {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	device := identity.Device{UserID: read.UserID, DeviceID: read.DeviceID}
+	held := append(h.heldReads[device], read.MessageIDs...)
+	if len(held) > maxHeldReads {
+		held = held[len(held)-maxHeldReads:]
+	}
+	h.heldReads[device] = held
+}
+
+// sendHeldReads sends the read receipts held while userID was offline.
+func (h *ClientHandler) sendHeldReads(userID string) {
+	var reads []model.ReadMessage
+	h.sessionMu.Lock()
+	for device, messageIDs := range h.heldReads {
+		if device.UserID == userID {
+			reads = append(reads, model.ReadMessage{UserID: userID, DeviceID: device.DeviceID, MessageIDs: messageIDs})
+			delete(h.heldReads, device)
+		}
+	}
+	h.sessionMu.Unlock()
+
+	for _, read := range reads {
+		h.sendRead(read)
+	}
+}
@@ -0,0 +1,232 @@
+package websocket
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+// exchange delivers frames between the handlers until both are quiet.
+func exchange(a, b *ClientHandler) {
+	for len(a.Conn.GetSendChan()) > 0 || len(b.Conn.GetSendChan()) > 0 {
+		deliver(a, b)
+		deliver(b, a)
+	}
+}
+
+func deliveryStates(h *ClientHandler, messageID string) []string {
+	states := []string{}
+	for {
+		select {
+		case msg := <-h.externalMsgChan:
+			if delivery, ok := msg.(model.DeliveryMessage); ok && delivery.MessageID == messageID {
+				states = append(states, delivery.State)
+			}
+		default:
+			return states
+		}
+	}
+}
+
+func TestDeliveryReceipts(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+
+	alice.announcePublicKey(true)
+	exchange(alice, bob)
+
+	alice.sendText(model.TextMessagePayload{MessageID: "message-1", Content: "hello"})
+	alice.handleAck("message-1")
+	alice.handleAck("message-1")
+	exchange(alice, bob)
+
+	if messages := incoming(bob); len(messages) != 1 || messages[0].Message.MessageID != "message-1" {
+		t.Fatalf("bob received %+v, want message-1", messages)
+	}
+
+	want := []string{model.DeliverySent, model.DeliveryStored, model.DeliveryDelivered}
+	if got := deliveryStates(alice, "message-1"); !slices.Equal(got, want) {
+		t.Errorf("delivery states = %v, want %v", got, want)
+	}
+	if len(alice.outgoing) != 0 {
+		t.Errorf("%d delivered messages are still tracked", len(alice.outgoing))
+	}
+}
+
+func TestDeliveryReceipts_NoRecipients(t *testing.T) {
+	alice := newTestClient(t, "alice")
+
+	alice.sendText(model.TextMessagePayload{MessageID: "message-1", Content: "hello"})
+
+	if got := deliveryStates(alice, "message-1"); len(got) != 1 || got[0] != model.DeliveryFailed {
+		t.Errorf("delivery states = %v, want [failed]", got)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	tests := []struct {
+		name       string
+		senderOn   bool
+		readerOn   bool
+		offline    bool
+		wantStates []string
+	}{
+		{name: "Both enabled", senderOn: true, readerOn: true, wantStates: []string{model.DeliveryDelivered, model.DeliveryRead}},
+		{name: "Reader disabled", senderOn: true, readerOn: false, wantStates: []string{model.DeliveryDelivered}},
+		{name: "Sender disabled", senderOn: false, readerOn: true, wantStates: []string{model.DeliveryDelivered}},
+		{name: "Sender offline", senderOn: true, readerOn: true, offline: true, wantStates: []string{model.DeliveryDelivered, model.DeliveryRead}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestClient(t, "alice")
+			bob := newTestClient(t, "bob")
+			alice.settings.ReadReceipts = tt.senderOn
+			bob.settings.ReadReceipts = tt.readerOn
+
+			alice.announcePublicKey(true)
+			exchange(alice, bob)
+			alice.sendText(model.TextMessagePayload{MessageID: "message-1", Content: "hello"})
+			exchange(alice, bob)
+			incoming(bob)
+
+			if tt.offline {
+				bob.handlePresence(model.PresencePayload{UserID: "alice", State: model.PresenceOffline})
+			}
+			bob.sendRead(model.ReadMessage{UserID: "alice", DeviceID: alice.Conn.User.DeviceID, MessageIDs: []string{"message-1"}})
+			if tt.offline {
+				if sent := len(bob.Conn.GetSendChan()); sent != 0 {
+					t.Errorf("bob sent %d frames to offline alice, want 0", sent)
+				}
+				bob.handlePresence(model.PresencePayload{UserID: "alice", State: model.PresenceOnline})
+			}
+			exchange(alice, bob)
+
+			states := deliveryStates(alice, "message-1")
+			if got := states[1:]; !slices.Equal(got, tt.wantStates) {
+				t.Errorf("delivery states after sent = %v, want %v", got, tt.wantStates)
+			}
+		})
+	}
+}
+
+func TestDeliveryReceipts_ServerError(t *testing.T) {
+	tests := []struct {
+		name       string
+		track      bool
+		refused    []string
+		delivered  []string
+		wantStates []string
+		wantStatus bool
+	}{
+		{name: "Whole message refused", track: true, refused: []string{""}, wantStates: []string{model.DeliveryFailed}, wantStatus: true},
+		{name: "Every recipient refused", track: true, refused: []string{"bob", "carol"}, wantStates: []string{model.DeliveryFailed}, wantStatus: true},
+		{
+			name:       "One recipient refused",
+			track:      true,
+			refused:    []string{"bob"},
+			delivered:  []string{"carol"},
+			wantStates: []string{model.DeliveryDelivered},
+			wantStatus: true,
+		},
+		{name: "Untracked frame refused", refused: []string{"bob"}, wantStates: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestClient(t, "alice")
+
+			if tt.track {
+				alice.trackOutgoing("message-1")
+				alice.setRecipients("message-1", []string{"bob", "carol"})
+			}
+			for _, recipient := range tt.refused {
+				alice.handleError(model.ErrorPayload{Code: model.ErrorCodeUnknownRecipient, Message: "no client is connected", CorrelationID: "message-1", RecipientID: recipient})
+			}
+			for _, recipient := range tt.delivered {
+				alice.handleReceipt(recipient, []string{"message-1"}, model.DeliveryDelivered)
+			}
+
+			status := false
+			states := []string{}
+			for len(alice.externalMsgChan) > 0 {
+				switch msg := (<-alice.externalMsgChan).(type) {
+				case model.StatusMessage:
+					status = true
+				case model.DeliveryMessage:
+					states = append(states, msg.State)
+				}
+			}
+			if !slices.Equal(states, tt.wantStates) {
+				t.Errorf("delivery states = %v, want %v", states, tt.wantStates)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status shown = %v, want %v", status, tt.wantStatus)
+			}
+			if len(alice.outgoing) != 0 {
+				t.Errorf("%d finished messages are still tracked", len(alice.outgoing))
+			}
+		})
+	}
+}
+
+// outerFields returns the fields of a frame the server can see, with the
+// length of the ciphertext.
+func outerFields(t *testing.T, frame []byte) (keys []string, size int) {
+	t.Helper()
+
+	var message struct {
+		ID      string                     `json:"id"`
+		Payload map[string]json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(frame, &message); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if message.ID == "" {
+		keys = append(keys, "<no id>")
+	}
+	for key := range message.Payload {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys, len(message.Payload["ciphertext"])
+}
+
+// nextTextFrame delivers the frames sent by from to to until it finds a text
+// frame, which it returns.
+func nextTextFrame(t *testing.T, from, to *ClientHandler) []byte {
+	t.Helper()
+
+	for {
+		select {
+		case frame := <-from.Conn.GetSendChan():
+			to.handleMessage(frame)
+			var message model.WebsocketMessage
+			if err := json.Unmarshal(frame, &message); err == nil && message.Type == model.TextMessageType {
+				return frame
+			}
+		default:
+			t.Fatal("no text frame was sent")
+			return nil
+		}
+	}
+}
+
+func TestReceiptsLookLikeMessages(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+
+	alice.announcePublicKey(true)
+	exchange(alice, bob)
+
+	alice.sendText(model.TextMessagePayload{MessageID: "message-1", Content: "hi"})
+	text := nextTextFrame(t, alice, bob)
+	receipt := nextTextFrame(t, bob, alice)
+
+	textKeys, textSize := outerFields(t, text)
+	receiptKeys, receiptSize := outerFields(t, receipt)
+	if !slices.Equal(textKeys, receiptKeys) || textSize != receiptSize {
+		t.Errorf("receipt fields = %v (%d bytes), message fields = %v (%d bytes)", receiptKeys, receiptSize, textKeys, textSize)
+	}
+}
@@ -0,0 +1,180 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/osmancadc/go-encrypted-chat/config"
+)
+
+var hotReloadable = map[string]bool{
+	"log.level":              true,
+	"server.rate_limit":      true,
+	"server.rate_burst":      true,
+	"server.banned_users":    true,
+	"server.banned_ips":      true,
+	"server.allowed_origins": true,
+}
+
+type certificateStore struct {
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func (s *certificateStore) load(certFile, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certificate = &certificate
+
+	return nil
+}
+
+func (s *certificateStore) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.certificate, nil
+}
+
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	allowed := s.Settings().AllowedOrigins
+
+	return origin == "" || len(allowed) == 0 || slices.Contains(allowed, origin)
+}
+
+func isBanned(settings *config.ServerSettings, username, remoteAddr string) bool {
+	if slices.Contains(settings.BannedUsers, username) {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	return slices.Contains(settings.BannedIPs, host)
+}
+
+func (s *Server) WatchReload(settings *config.Settings, reload func() (*config.Settings, error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		s.log.Info("SIGHUP received, reloading configuration")
+
+		updated, err := reload()
+		if err != nil {
+			s.log.Errorf("Configuration reload failed, keeping the current settings: %v\n", err)
+			continue
+		}
+
+		settings = s.applyReload(settings, updated)
+	}
+}
+
+func (s *Server) applyReload(previous, updated *config.Settings) *config.Settings {
+	applied, needsRestart := []string{}, []string{}
+
+	for _, key := range previous.Changed(updated) {
+		switch {
+		case hotReloadable[key]:
+			applied = append(applied, key)
+		case strings.HasPrefix(key, "server.tls_") && previous.Server.TLSCert != "" && updated.Server.TLSCert != "":
+			applied = append(applied, key)
+		case strings.HasPrefix(key, "server."):
+			needsRestart = append(needsRestart, key)
+		}
+	}
+
+	effective := updated.Server
+	effective.Address = previous.Server.Address
+	if (previous.Server.TLSCert == "") != (updated.Server.TLSCert == "") {
+		effective.TLSCert, effective.TLSKey = previous.Server.TLSCert, previous.Server.TLSKey
+	}
+
+	if effective.TLSCert != "" {
+		if err := s.certificates.load(effective.TLSCert, effective.TLSKey); err != nil {
+			s.log.Errorf("Error reloading TLS certificate, keeping the current one: %v\n", err)
+			effective.TLSCert, effective.TLSKey = previous.Server.TLSCert, previous.Server.TLSKey
+			applied = slices.DeleteFunc(applied, func(key string) bool { return strings.HasPrefix(key, "server.tls_") })
+		} else {
+			s.log.Info("TLS certificate reloaded")
+		}
+	}
+
+	s.log.SetLevel(updated.Log.Level)
+	s.settings.Store(&effective)
+	disconnected := s.disconnectBanned(&effective)
+
+	if len(applied) > 0 {
+		s.log.Infof("Configuration reloaded, applied: %s\n", strings.Join(applied, ", "))
+	} else {
+		s.log.Info("Configuration reloaded, no live settings changed")
+	}
+	if len(needsRestart) > 0 {
+		s.log.Warnf("Changes that need a restart to take effect: %s\n", strings.Join(needsRestart, ", "))
+	}
+	if disconnected > 0 {
+		s.log.Infof("Disconnected %d banned client(s)\n", disconnected)
+	}
+
+	result := *updated
+	result.Server = effective
+
+	return &result
+}
+
+func (s *Server) disconnectBanned(settings *config.ServerSettings) int {
+	s.clientsMu.Lock()
+	banned := []*ServerHandler{}
+	for _, client := range s.clients {
+		if isBanned(settings, client.Conn.User.Username, client.RemoteAddr) {
+			banned = append(banned, client)
+		}
+	}
+	s.clientsMu.Unlock()
+
+	for _, client := range banned {
+		s.log.Infof("Disconnecting banned client %s\n", client.Conn.User.Username)
+		conn := client.Conn.GetConn()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "banned"), time.Now().Add(time.Second))
+		conn.Close()
+	}
+
+	return len(banned)
+}
+
+func (s *Server) ListenAndServe() error {
+	settings := s.Settings()
+	server := &http.Server{
+		Addr:    settings.Address,
+		Handler: s.mux,
+	}
+
+	if settings.TLSCert == "" {
+		return server.ListenAndServe()
+	}
+
+	if err := s.certificates.load(settings.TLSCert, settings.TLSKey); err != nil {
+		return fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	server.TLSConfig = &tls.Config{GetCertificate: s.certificates.get}
+
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,34 @@
+package websocket
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+func TestReplies(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+
+	alice.announcePublicKey(true)
+	exchange(alice, bob)
+	incoming(bob)
+
+	alice.sendText(model.TextMessagePayload{MessageID: "message-2", Content: "me too", ReplyTo: "message-1", ThreadRoot: "message-0"})
+	for len(alice.Conn.GetSendChan()) > 0 {
+		frame := <-alice.Conn.GetSendChan()
+		if bytes.Contains(frame, []byte("message-0")) || bytes.Contains(frame, []byte("replyTo")) {
+			t.Errorf("the thread of a reply is sent in the clear: %s", frame)
+		}
+		bob.handleMessage(frame)
+	}
+
+	messages := incoming(bob)
+	if len(messages) != 1 {
+		t.Fatalf("bob received %d messages, want 1", len(messages))
+	}
+	if got := messages[0].Message; got.ReplyTo != "message-1" || got.ThreadRoot != "message-0" {
+		t.Errorf("bob received a reply to %q in thread %q, want message-1 in message-0", got.ReplyTo, got.ThreadRoot)
+	}
+}
@@ -0,0 +1,78 @@
+package websocket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+const maxRevocations = 10000
+
+// revocationStore keeps published revocations in memory so clients that
+// connect later still learn about them.
+type revocationStore struct {
+	mu          sync.Mutex
+	revocations map[string]model.WebsocketMessage
+}
+
+func (s *revocationStore) publish(revocation model.KeyRevocationPayload, now time.Time) (model.WebsocketMessage, error) {
+	if err := model.VerifyKeyRevocation(&revocation); err != nil {
+		return model.WebsocketMessage{}, fmt.Errorf("invalid revocation of %s: %w", revocation.UserID, err)
+	}
+
+	fingerprint := crypto.Fingerprint(revocation.PublicKey)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.revocations[fingerprint]; ok {
+		return stored, nil
+	}
+	if len(s.revocations) >= maxRevocations {
+		return model.WebsocketMessage{}, fmt.Errorf("revocation store is full")
+	}
+
+	revocation.PublishedAt = now.UTC()
+	message := model.WebsocketMessage{Type: model.KeyRevocationType, Payload: revocation}
+	if s.revocations == nil {
+		s.revocations = map[string]model.WebsocketMessage{}
+	}
+	s.revocations[fingerprint] = message
+
+	return message, nil
+}
+
+func (s *revocationStore) all() []model.WebsocketMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]model.WebsocketMessage, 0, len(s.revocations))
+	for _, message := range s.revocations {
+		messages = append(messages, message)
+	}
+
+	return messages
+}
+
+// PublishRevocation sends a revocation certificate to the server at url.
+func PublishRevocation(url string, revocation model.KeyRevocationPayload) error {
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %w", url, err)
+	}
+	defer conn.Close()
+
+	if _, err := clientHandshake(conn, model.User{Username: revocation.UserID}, model.EncodingJSON); err != nil {
+		return err
+	}
+	err = conn.WriteJSON(model.WebsocketMessage{Type: model.KeyRevocationType, Payload: revocation})
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
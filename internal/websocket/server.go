@@ -1,93 +1,155 @@
 package websocket
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/osmancadc/go-encrypted-chat/config"
 	"github.com/osmancadc/go-encrypted-chat/internal/model"
+	"github.com/osmancadc/go-encrypted-chat/pkg/logger"
 )
 
-var (
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
-	}
-	clients   = make(map[string]*ServerHandler)
-	clientsMu sync.Mutex
-)
+type Server struct {
+	upgrader     websocket.Upgrader
+	mux          *http.ServeMux
+	clients      map[string]*ServerHandler
+	clientsMu    sync.Mutex
+	settings     atomic.Pointer[config.ServerSettings]
+	certificates certificateStore
+	revocations  revocationStore
+	devices      deviceRegistry
+	presence     presenceRegistry
+	log          *logger.Logger
+}
 
 type ServerHandler struct {
-	Conn *Connection
+	Conn       *Connection
+	RemoteAddr string
+	server     *Server
+	limiter    rateLimiter
+	protocol   model.WelcomePayload
+	presence   string
 }
 
-func NewServerHandler(conn *Connection) *ServerHandler {
-	return &ServerHandler{Conn: conn}
+func NewServer(settings config.ServerSettings) *Server {
+	server := &Server{
+		mux:      http.NewServeMux(),
+		clients:  make(map[string]*ServerHandler),
+		devices:  deviceRegistry{},
+		presence: presenceRegistry{},
+		// Each server reloads its own log level, starting from the package one.
+		log: logger.NewLogger(log.Level()),
+	}
+	server.upgrader = websocket.Upgrader{CheckOrigin: server.checkOrigin, EnableCompression: true}
+	server.settings.Store(&settings)
+	server.mux.HandleFunc("/ws", server.handleConnections)
+
+	return server
 }
 
-func ServeWs() {
-	port := ":8080"
-	http.HandleFunc("/ws", handleConnections)
-	log.Infof("Server started on %s\n", port)
+func NewServerHandler(server *Server, conn *Connection, remoteAddr string) *ServerHandler {
+	return &ServerHandler{Conn: conn, RemoteAddr: remoteAddr, server: server}
+}
+
+// ServeWs runs the server used by the command line until it fails, reloading
+// its settings on SIGHUP.
+func ServeWs(settings *config.Settings, reload func() (*config.Settings, error)) {
+	server := NewServer(settings.Server)
+	go server.WatchReload(settings, reload)
 
-	err := http.ListenAndServe(port, nil)
+	server.log.Infof("Server started on %s\n", settings.Server.Address)
+
+	err := server.ListenAndServe()
 	if err != nil {
-		log.Fatalf("ListenAndServe: %v\n", err)
+		server.log.Fatalf("ListenAndServe: %v\n", err)
 	}
 }
 
-func handleConnections(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+func (s *Server) Settings() *config.ServerSettings {
+	return s.settings.Load()
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Errorf("Error upgrading connection: %v\n", err)
+		s.log.Errorf("Error upgrading connection: %v\n", err)
 		return
 	}
-	log.Debug("Connection upgraded successfully")
-
-	user := setNewUser(conn)
+	s.log.Debug("Connection upgraded successfully")
 
-	clientConnection := NewConnection(user)
-	log.Debugf("New connection created with Username: %s\n", clientConnection.User.Username)
+	user, welcome, err := readHello(conn)
+	if err != nil {
+		refusal, ok := err.(*model.ErrorPayload)
+		if !ok {
+			s.log.Warnf("Refusing client from %s: %v\n", r.RemoteAddr, err)
+			conn.Close()
+			return
+		}
+		refusal.CorrelationID = uuid.NewString()
+		s.log.Warnf("Refusing client from %s (%s): %v\n", r.RemoteAddr, refusal.CorrelationID, refusal)
+		refuse(conn, refusal)
+		return
+	}
 
-	log.Debugf("New connection created with ID: %s\n", clientConnection.User.Username)
+	if isBanned(s.Settings(), user.Username, r.RemoteAddr) {
+		s.log.Warnf("Refusing banned client %s from %s\n", user.Username, r.RemoteAddr)
+		conn.WriteJSON(model.WebsocketMessage{
+			Type:    model.ErrorType,
+			Payload: model.ErrorPayload{Code: model.ErrorCodeBanned, Message: "this user or address is banned from the server", CorrelationID: uuid.NewString()},
+		})
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "banned"), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
 
-	clientConnection.SetConn(conn)
+	if err := conn.WriteJSON(model.WebsocketMessage{Type: model.WelcomeType, Payload: welcome}); err != nil {
+		s.log.Errorf("Error welcoming client %s: %v\n", user.Username, err)
+		conn.Close()
+		return
+	}
+	conn.EnableWriteCompression(welcome.Has(model.FeatureCompression))
 
-	handler := NewServerHandler(clientConnection)
-	log.Debug("New ServerHandler created")
+	clientConnection := NewConnection(user)
+	s.log.Debugf("New connection created with Username: %s\n", clientConnection.User.Username)
 
-	clientsMu.Lock()
-	clients[clientConnection.ID] = handler
-	clientsMu.Unlock()
-	log.Debug("Client added to clients map")
+	s.log.Debugf("New connection created with ID: %s\n", clientConnection.User.Username)
 
-	go handler.Run()
-	log.Debug("handler.Run() called")
+	clientConnection.SetConn(conn)
 
-	log.Debug("handleConnections finished")
-}
+	handler := NewServerHandler(s, clientConnection, r.RemoteAddr)
+	handler.protocol = welcome
+	s.log.Debug("New ServerHandler created")
 
-func setNewUser(conn *websocket.Conn) model.User {
-	var msg model.WebsocketMessage
-	err := conn.ReadJSON(&msg)
-	if err != nil {
-		log.Fatal(err.Error())
+	for _, revocation := range s.revocations.all() {
+		handler.queue(messageFrame(revocation))
 	}
 
-	var usernameMsg model.UsernamePayload
-
-	usernameByte, err := json.Marshal(msg.Payload)
-	if err != nil {
-		log.Fatal(err.Error())
+	s.clientsMu.Lock()
+	s.sendDevices(handler)
+	s.sendPresences(handler)
+	s.clients[clientConnection.ID] = handler
+	if user.DeviceID != "" {
+		s.devices.connect(user.Username, user.DeviceID)
+		s.broadcastDevices(user.Username)
 	}
+	s.clientsMu.Unlock()
+	s.log.Debug("Client added to clients map")
 
-	usernameMsg.Unmarshal(usernameByte)
+	go handler.Run()
+	s.log.Debug("handler.Run() called")
 
-	log.Debug(usernameMsg.Username)
-	return model.User{
-		Username: usernameMsg.Username,
-	}
+	s.log.Debug("handleConnections finished")
 }
 
 func (h *ServerHandler) Run() {
@@ -98,46 +160,153 @@ func (h *ServerHandler) Run() {
 func (h *ServerHandler) readPump() {
 	defer func() {
 		h.Conn.Close()
-		clientsMu.Lock()
-		delete(clients, h.Conn.ID)
-		clientsMu.Unlock()
-		log.Infof("Client %s disconnected\n", h.Conn.ID)
+		h.server.clientsMu.Lock()
+		delete(h.server.clients, h.Conn.ID)
+		if h.Conn.User.DeviceID != "" {
+			h.server.devices.disconnect(h.Conn.User.Username, h.Conn.User.DeviceID)
+			h.server.broadcastDevices(h.Conn.User.Username)
+		}
+		h.server.leavePresence(h.Conn.User.Username, time.Now())
+		h.server.clientsMu.Unlock()
+		h.server.log.Infof("Client %s disconnected\n", h.Conn.ID)
 	}()
 
 	for {
 		_, message, err := h.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
-				log.Errorf("Reading error: %v\n", err)
+				h.server.log.Errorf("Reading error: %v\n", err)
 			}
 			break
 		}
 
-		log.Debugf("Message received from client %s\n", h.Conn.User.Username)
+		h.server.log.Debugf("Message received from client %s\n", h.Conn.User.Username)
 
-		clientsMu.Lock()
-		for _, client := range clients {
+		envelope, err := model.ParseEnvelope(message)
+		if err != nil {
+			code := model.ErrorCodeMalformedFrame
+			if errors.Is(err, model.ErrUnknownMessageType) {
+				code = model.ErrorCodeUnknownType
+			}
+			h.sendError("", code, "%v", err)
+			continue
+		}
+		if envelope.Type == model.AccountWipeType {
+			h.wipeAccount()
+			break
+		}
+
+		settings := h.server.Settings()
+		if !h.limiter.allow(settings.RateLimit, settings.RateBurst, time.Now()) {
+			h.sendError(envelope.ID, model.ErrorCodeRateLimited, "more than %d frames per second, the %s frame was dropped", settings.RateLimit, envelope.Type)
+			continue
+		}
+
+		frame, ok := h.routeMessage(envelope, message)
+		if !ok {
+			continue
+		}
+
+		h.server.clientsMu.Lock()
+		for _, client := range h.server.clients {
 			if client.Conn.ID != h.Conn.ID {
-				client.Conn.GetSendChan() <- message
+				client.queue(frame)
 			}
 		}
-		clientsMu.Unlock()
+		h.server.clientsMu.Unlock()
+
+		if envelope.ID != "" && h.protocol.Has(model.FeatureReceipts) {
+			h.queue(messageFrame(model.WebsocketMessage{Type: model.AckType, ID: envelope.ID}))
+		}
 	}
 }
 
 func (h *ServerHandler) writePump() {
 	defer h.Conn.Close()
 	for message := range h.Conn.GetSendChan() {
-		err := h.Conn.WriteMessage(websocket.TextMessage, message)
+		err := h.Conn.WriteMessage(frameType(h.protocol.Encoding), message)
 		if err != nil {
-			log.Errorf("write error: %v\n", err)
+			h.server.log.Errorf("write error: %v\n", err)
 			break
 		}
-		log.Debugf("Message sent to client %s\n", h.Conn.ID)
+		h.server.log.Debugf("Message sent to client %s\n", h.Conn.ID)
+	}
+}
+
+// routeMessage returns the frame to forward to the other clients, or false
+// when it must not be forwarded.
+func (h *ServerHandler) routeMessage(envelope model.Envelope, message []byte) (*wireFrame, bool) {
+	switch envelope.Type {
+	case model.UsernameMessageType, model.HelloType, model.WelcomeType, model.ErrorType, model.DeviceListType, model.AckType, model.PresenceType:
+		h.sendError(envelope.ID, model.ErrorCodeForbiddenFrame, "%s frames are only valid in the handshake or from the server", envelope.Type)
+		return nil, false
+	case model.KeyRevocationType:
+		payload, err := envelope.Decode()
+		if err != nil {
+			h.sendError(envelope.ID, model.ErrorCodeMalformedFrame, "%v", err)
+			return nil, false
+		}
+		published, err := h.server.revocations.publish(*payload.(*model.KeyRevocationPayload), time.Now())
+		if err != nil {
+			h.sendError(envelope.ID, model.ErrorCodeInvalidFrame, "revocation rejected: %v", err)
+			return nil, false
+		}
+		h.server.log.Infof("Published a key revocation for %s\n", h.Conn.User.Username)
+		return messageFrame(published), true
+	case model.PresenceUpdateType:
+		payload, err := envelope.Decode()
+		if err != nil {
+			h.sendError(envelope.ID, model.ErrorCodeMalformedFrame, "%v", err)
+			return nil, false
+		}
+		h.updatePresence(envelope.ID, *payload.(*model.PresenceUpdatePayload))
+		return nil, false
+	case model.PublicKeyExchangeType:
+		if !h.sentByClient(envelope) {
+			return nil, false
+		}
+		return relayedFrame(envelope, message), true
+	case model.TextMessageType, model.SymmetricKeyExchangeType:
+		if !h.sentByClient(envelope) {
+			return nil, false
+		}
+		// The server keeps nothing for later, frames to nobody are refused.
+		recipient, err := recipientOf(envelope)
+		if err != nil {
+			h.sendError(envelope.ID, model.ErrorCodeMalformedFrame, "%v", err)
+			return nil, false
+		}
+		if recipient != "" && !h.connected(recipient) {
+			h.queueError(envelope.ID, model.ErrorPayload{
+				Code:        model.ErrorCodeUnknownRecipient,
+				Message:     fmt.Sprintf("no client of %s is connected, the %s frame was not delivered", recipient, envelope.Type),
+				RecipientID: recipient,
+			})
+			return nil, false
+		}
+		return relayedFrame(envelope, message), true
+	default:
+		return relayedFrame(envelope, message), true
+	}
+}
+
+// sentByClient reports whether the sender a frame names is the device that
+// sent it, and refuses the frame otherwise.
+func (h *ServerHandler) sentByClient(envelope model.Envelope) bool {
+	username, deviceID, err := senderOf(envelope)
+	if err != nil {
+		h.sendError(envelope.ID, model.ErrorCodeMalformedFrame, "%v", err)
+		return false
 	}
+	if username != h.Conn.User.Username || deviceID != h.Conn.User.DeviceID {
+		h.sendError(envelope.ID, model.ErrorCodeForbiddenFrame, "the %s frame names %q on device %q as its sender, not the connected client", envelope.Type, username, deviceID)
+		return false
+	}
+
+	return true
 }
 
 func (h *ServerHandler) handleMessage(message []byte) error {
-	log.Debugf("Server received message: %s\n", message)
+	h.server.log.Debugf("Server received message: %s\n", message)
 	return nil
 }
@@ -0,0 +1,586 @@
+package websocket
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+func dialTestServer(t *testing.T, url, username string) *websocket.Conn {
+	t.Helper()
+
+	return dialTestDevice(t, url, model.User{Username: username})
+}
+
+func dialTestDevice(t *testing.T, url string, user model.User) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if _, err := clientHandshake(conn, user, model.EncodingJSON); err != nil {
+		t.Fatalf("clientHandshake() error = %v", err)
+	}
+
+	return conn
+}
+
+func waitForClients(t *testing.T, server *Server, count int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		server.clientsMu.Lock()
+		connected := len(server.clients)
+		server.clientsMu.Unlock()
+		if connected == count {
+			return
+		}
+	}
+	t.Fatalf("server did not register %d clients", count)
+}
+
+func TestServer_IndependentInstances(t *testing.T) {
+	first := NewServer(config.DefaultSettings().Server)
+	second := NewServer(config.DefaultSettings().Server)
+
+	firstHTTP := httptest.NewServer(first.Handler())
+	defer firstHTTP.Close()
+	secondHTTP := httptest.NewServer(second.Handler())
+	defer secondHTTP.Close()
+
+	alice := dialTestServer(t, firstHTTP.URL, "alice")
+	bob := dialTestServer(t, firstHTTP.URL, "bob")
+	mallory := dialTestServer(t, secondHTTP.URL, "mallory")
+	waitForClients(t, first, 2)
+	waitForClients(t, second, 1)
+
+	hello := `{"type":"textMessage","payload":{"senderID":"alice","content":"hello"}}`
+	if err := alice.WriteMessage(websocket.TextMessage, []byte(hello)); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, message, err := bob.ReadMessage(); err != nil || string(message) != hello {
+		t.Errorf("bob.ReadMessage() = %q, %v, want %s", message, err, hello)
+	}
+
+	mallory.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, message, err := mallory.ReadMessage(); err == nil {
+		t.Errorf("a client of another server received %q", message)
+	}
+
+	first.log.SetLevel("DEBUG")
+	if level := second.log.Level(); level == "DEBUG" {
+		t.Errorf("second.log.Level() = %s, the level of another server leaked", level)
+	}
+}
+
+func TestServer_PublishesRevocations(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	key, err := crypto.GenerateRSA(1024)
+	if err != nil {
+		t.Fatalf("GenerateRSA() error = %v", err)
+	}
+	revocation := model.KeyRevocationPayload{UserID: "alice", Reason: "stolen laptop"}
+	if err := model.SignKeyRevocation(&revocation, *key); err != nil {
+		t.Fatalf("SignKeyRevocation() error = %v", err)
+	}
+
+	forged := revocation
+	forged.Reason = "changed after signing"
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+	if err := PublishRevocation(wsURL, forged); err != nil {
+		t.Fatalf("PublishRevocation() error = %v", err)
+	}
+	if err := PublishRevocation(wsURL, revocation); err != nil {
+		t.Fatalf("PublishRevocation() error = %v", err)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); len(server.revocations.all()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bob := dialTestServer(t, httpServer.URL, "bob")
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	var frame struct {
+		Type    string                     `json:"type"`
+		Payload model.KeyRevocationPayload `json:"payload"`
+	}
+	if err := bob.ReadJSON(&frame); err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	if frame.Type != model.KeyRevocationType || frame.Payload.Reason != revocation.Reason {
+		t.Errorf("replayed frame = %+v, want the signed revocation", frame)
+	}
+	if frame.Payload.PublishedAt.IsZero() {
+		t.Errorf("revocation was not stamped with its publication time")
+	}
+	if err := model.VerifyKeyRevocation(&frame.Payload); err != nil {
+		t.Errorf("VerifyKeyRevocation() error = %v", err)
+	}
+
+	bob.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, message, err := bob.ReadMessage(); err == nil {
+		t.Errorf("unexpected frame %s, the forged revocation should be dropped", message)
+	}
+}
+
+func TestServer_ClientDisconnects(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	alice := dialTestServer(t, httpServer.URL, "alice")
+	waitForClients(t, server, 1)
+
+	alice.Close()
+	waitForClients(t, server, 0)
+
+	dialTestServer(t, httpServer.URL, "bob")
+	waitForClients(t, server, 1)
+}
+
+func TestServer_DropsInvalidFrames(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	alice := dialTestServer(t, httpServer.URL, "alice")
+	bob := dialTestServer(t, httpServer.URL, "bob")
+	waitForClients(t, server, 2)
+
+	frames := []string{
+		"hello",
+		`{"type":"bogus","payload":{}}`,
+		`{"type":"deviceList","payload":{"userID":"alice","devices":[]}}`,
+		`{"type":"textMessage","payload":{"senderID":"alice","content":"hello"}}`,
+	}
+	for _, frame := range frames {
+		if err := alice.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatalf("WriteMessage() error = %v", err)
+		}
+	}
+
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, message, err := bob.ReadMessage(); err != nil || string(message) != frames[3] {
+		t.Errorf("bob.ReadMessage() = %q, %v, want %s", message, err, frames[3])
+	}
+}
+
+func TestServer_RefusesUnversionedClients(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(model.WebsocketMessage{
+		Type:    model.UsernameMessageType,
+		Payload: model.UsernamePayload{Username: "alice"},
+	})
+	if err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var refusal struct {
+		Type    string             `json:"type"`
+		Payload model.ErrorPayload `json:"payload"`
+	}
+	if err := conn.ReadJSON(&refusal); err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	if refusal.Type != model.ErrorType || refusal.Payload.Code != model.ErrorCodeVersionMismatch {
+		t.Errorf("refusal = %+v, want a %s error", refusal, model.ErrorCodeVersionMismatch)
+	}
+	if refusal.Payload.CorrelationID == "" {
+		t.Error("refusal has no correlation ID")
+	}
+}
+
+func TestServer_SendsErrorFrames(t *testing.T) {
+	tests := []struct {
+		name            string
+		rateLimit       int
+		frames          []string
+		wantCode        string
+		wantCorrelation string
+		wantRecipient   string
+	}{
+		{name: "Malformed frame", frames: []string{"hello"}, wantCode: model.ErrorCodeMalformedFrame},
+		{name: "Unknown type", frames: []string{`{"type":"bogus","payload":{}}`}, wantCode: model.ErrorCodeUnknownType},
+		{
+			name:            "Server-only frame",
+			frames:          []string{`{"type":"welcome","id":"f1","payload":{}}`},
+			wantCode:        model.ErrorCodeForbiddenFrame,
+			wantCorrelation: "f1",
+		},
+		{
+			name:            "Invalid presence",
+			frames:          []string{`{"type":"presenceUpdate","id":"p1","payload":{"state":"asleep"}}`},
+			wantCode:        model.ErrorCodeInvalidFrame,
+			wantCorrelation: "p1",
+		},
+		{
+			name:            "Invalid presence contact",
+			frames:          []string{`{"type":"presenceUpdate","id":"p1","payload":{"state":"online","contacts":["bob/phone"]}}`},
+			wantCode:        model.ErrorCodeInvalidFrame,
+			wantCorrelation: "p1",
+		},
+		{
+			name:            "Too many presence contacts",
+			frames:          []string{`{"type":"presenceUpdate","id":"p1","payload":{"state":"online","contacts":[` + strings.Repeat(`"bob",`, maxPresenceContacts) + `"bob"]}}`},
+			wantCode:        model.ErrorCodeInvalidFrame,
+			wantCorrelation: "p1",
+		},
+		{
+			name:            "Text message from another user",
+			frames:          []string{`{"type":"textMessage","id":"m1","payload":{"senderID":"bob","messageID":"m1"}}`},
+			wantCode:        model.ErrorCodeForbiddenFrame,
+			wantCorrelation: "m1",
+		},
+		{
+			name:            "Text message from another device",
+			frames:          []string{`{"type":"textMessage","id":"m1","payload":{"senderID":"alice","senderDevice":"laptop","messageID":"m1"}}`},
+			wantCode:        model.ErrorCodeForbiddenFrame,
+			wantCorrelation: "m1",
+		},
+		{
+			name:            "Key exchange from another user",
+			frames:          []string{`{"type":"symmetricKeyExchange","id":"k1","payload":{"senderID":"bob","recipientID":"carol"}}`},
+			wantCode:        model.ErrorCodeForbiddenFrame,
+			wantCorrelation: "k1",
+		},
+		{
+			name:            "Public key of another user",
+			frames:          []string{`{"type":"publicKeyExchange","id":"p1","payload":{"userID":"bob","publicKey":"AQID"}}`},
+			wantCode:        model.ErrorCodeForbiddenFrame,
+			wantCorrelation: "p1",
+		},
+		{
+			name:            "Unknown recipient",
+			frames:          []string{`{"type":"textMessage","id":"m1","payload":{"senderID":"alice","recipientID":"nobody","messageID":"m1"}}`},
+			wantCode:        model.ErrorCodeUnknownRecipient,
+			wantCorrelation: "m1",
+			wantRecipient:   "nobody",
+		},
+		{
+			name:      "Rate limited",
+			rateLimit: 1,
+			frames: []string{
+				`{"type":"textMessage","id":"m1","payload":{"senderID":"alice","messageID":"m1"}}`,
+				`{"type":"textMessage","id":"m2","payload":{"senderID":"alice","messageID":"m2"}}`,
+			},
+			wantCode:        model.ErrorCodeRateLimited,
+			wantCorrelation: "m2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := config.DefaultSettings().Server
+			if tt.rateLimit > 0 {
+				settings.RateLimit, settings.RateBurst = tt.rateLimit, 0
+			}
+			server := NewServer(settings)
+			httpServer := httptest.NewServer(server.Handler())
+			defer httpServer.Close()
+
+			alice := dialTestServer(t, httpServer.URL, "alice")
+			waitForClients(t, server, 1)
+
+			for _, frame := range tt.frames {
+				if err := alice.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+					t.Fatalf("WriteMessage() error = %v", err)
+				}
+			}
+
+			alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for {
+				_, message, err := alice.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage() error = %v, want a %s error", err, tt.wantCode)
+				}
+				envelope, err := model.ParseEnvelope(message)
+				if err != nil {
+					t.Fatalf("ParseEnvelope() error = %v", err)
+				}
+				if envelope.Type != model.ErrorType {
+					continue
+				}
+				payload, err := envelope.Decode()
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				got := payload.(*model.ErrorPayload)
+				if got.Code != tt.wantCode {
+					t.Errorf("Code = %s, want %s", got.Code, tt.wantCode)
+				}
+				if tt.wantCorrelation != "" && got.CorrelationID != tt.wantCorrelation || got.CorrelationID == "" {
+					t.Errorf("CorrelationID = %q, want %q", got.CorrelationID, tt.wantCorrelation)
+				}
+				if got.RecipientID != tt.wantRecipient {
+					t.Errorf("RecipientID = %q, want %q", got.RecipientID, tt.wantRecipient)
+				}
+				return
+			}
+		})
+	}
+}
+
+func TestServer_TranscodesBetweenEncodings(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	dial := func(username, encoding string) *websocket.Conn {
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/ws", nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		welcome, err := clientHandshake(conn, model.User{Username: username}, encoding)
+		if err != nil || welcome.Encoding != encoding {
+			t.Fatalf("clientHandshake() = %+v, %v, want %s", welcome, err, encoding)
+		}
+		return conn
+	}
+	alice := dial("alice", model.EncodingCBOR)
+	bob := dial("bob", model.EncodingJSON)
+	waitForClients(t, server, 2)
+
+	tests := []struct {
+		name      string
+		from, to  *websocket.Conn
+		sender    string
+		recipient string
+		encoding  string
+		wantType  int
+	}{
+		{name: "CBOR to JSON", from: alice, to: bob, sender: "alice", recipient: "bob", encoding: model.EncodingCBOR, wantType: websocket.TextMessage},
+		{name: "JSON to CBOR", from: bob, to: alice, sender: "bob", recipient: "alice", encoding: model.EncodingJSON, wantType: websocket.BinaryMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := model.TextMessagePayload{SenderID: tt.sender, RecipientID: tt.recipient, Ciphertext: []byte{1, 2, 3}, SentAt: time.Now().UTC()}
+			data, err := model.EncodeMessage(tt.encoding, model.WebsocketMessage{Type: model.TextMessageType, Payload: sent})
+			if err != nil {
+				t.Fatalf("EncodeMessage() error = %v", err)
+			}
+			if err := tt.from.WriteMessage(frameType(tt.encoding), data); err != nil {
+				t.Fatalf("WriteMessage() error = %v", err)
+			}
+
+			tt.to.SetReadDeadline(time.Now().Add(2 * time.Second))
+			messageType, received, err := tt.to.ReadMessage()
+			if err != nil || messageType != tt.wantType {
+				t.Fatalf("ReadMessage() = %d, %v, want frame type %d", messageType, err, tt.wantType)
+			}
+			envelope, err := model.ParseEnvelope(received)
+			if err != nil {
+				t.Fatalf("ParseEnvelope() error = %v", err)
+			}
+			payload, err := envelope.Decode()
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if got := payload.(*model.TextMessagePayload); string(got.AuthData()) != string(sent.AuthData()) {
+				t.Errorf("received %+v, want %+v", got, sent)
+			}
+		})
+	}
+}
+
+func TestServer_AcksMessages(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	alice := dialTestServer(t, httpServer.URL, "alice")
+	bob := dialTestServer(t, httpServer.URL, "bob")
+	waitForClients(t, server, 2)
+
+	frame := `{"type":"textMessage","id":"message-1","payload":{"senderID":"alice","messageID":"message-1"}}`
+	if err := alice.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, message, err := bob.ReadMessage(); err != nil || string(message) != frame {
+		t.Errorf("bob.ReadMessage() = %q, %v, want %s", message, err, frame)
+	}
+
+	alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, message, err := alice.ReadMessage()
+	if err != nil {
+		t.Fatalf("alice.ReadMessage() error = %v", err)
+	}
+	if envelope, err := model.ParseEnvelope(message); err != nil || envelope.Type != model.AckType || envelope.ID != "message-1" {
+		t.Errorf("alice received %q, want an ack of message-1", message)
+	}
+}
+
+func TestServer_PushesPresenceToContacts(t *testing.T) {
+	tests := []struct {
+		name         string
+		hideLastSeen bool
+	}{
+		{name: "Shows last seen", hideLastSeen: false},
+		{name: "Hides last seen", hideLastSeen: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(config.DefaultSettings().Server)
+			httpServer := httptest.NewServer(server.Handler())
+			defer httpServer.Close()
+
+			alice := dialTestServer(t, httpServer.URL, "alice")
+			bob := dialTestServer(t, httpServer.URL, "bob")
+			carol := dialTestServer(t, httpServer.URL, "carol")
+			waitForClients(t, server, 3)
+
+			readPresence := func(conn *websocket.Conn) model.PresencePayload {
+				t.Helper()
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				var message struct {
+					Type    string                `json:"type"`
+					Payload model.PresencePayload `json:"payload"`
+				}
+				if err := conn.ReadJSON(&message); err != nil || message.Type != model.PresenceType {
+					t.Fatalf("ReadJSON() = %+v, %v, want a presence frame", message, err)
+				}
+				return message.Payload
+			}
+
+			update := model.WebsocketMessage{
+				Type:    model.PresenceUpdateType,
+				Payload: model.PresenceUpdatePayload{State: model.PresenceAway, Contacts: []string{"bob"}, HideLastSeen: tt.hideLastSeen},
+			}
+			if err := alice.WriteJSON(update); err != nil {
+				t.Fatalf("WriteJSON() error = %v", err)
+			}
+			if presence := readPresence(bob); presence.UserID != "alice" || presence.State != model.PresenceAway {
+				t.Errorf("bob received %+v, want alice away", presence)
+			}
+
+			alice.Close()
+			presence := readPresence(bob)
+			if presence.State != model.PresenceOffline || (presence.LastSeen != nil) == tt.hideLastSeen {
+				t.Errorf("bob received %+v, want alice offline with last seen hidden %v", presence, tt.hideLastSeen)
+			}
+
+			carol.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, message, err := carol.ReadMessage(); err == nil {
+				t.Errorf("carol, who is not a contact, received %q", message)
+			}
+		})
+	}
+}
+
+func TestServer_SendsDevicesToContacts(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	bob := dialTestServer(t, httpServer.URL, "bob")
+	carol := dialTestServer(t, httpServer.URL, "carol")
+	alice := dialTestDevice(t, httpServer.URL, model.User{Username: "alice", DeviceID: "laptop"})
+	waitForClients(t, server, 3)
+
+	readDevices := func(conn *websocket.Conn) model.DeviceListPayload {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var message struct {
+			Type    string                  `json:"type"`
+			Payload model.DeviceListPayload `json:"payload"`
+		}
+		if err := conn.ReadJSON(&message); err != nil || message.Type != model.DeviceListType {
+			t.Fatalf("ReadJSON() = %+v, %v, want a device list", message, err)
+		}
+		return message.Payload
+	}
+
+	if devices := readDevices(alice); devices.UserID != "alice" || len(devices.Devices) != 1 {
+		t.Errorf("alice received %+v, want its own laptop", devices)
+	}
+
+	update := model.WebsocketMessage{
+		Type:    model.PresenceUpdateType,
+		Payload: model.PresenceUpdatePayload{State: model.PresenceOnline, Contacts: []string{"bob"}},
+	}
+	if err := alice.WriteJSON(update); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var message struct {
+			Type    string                  `json:"type"`
+			Payload model.DeviceListPayload `json:"payload"`
+		}
+		if err := bob.ReadJSON(&message); err != nil {
+			t.Fatalf("bob did not receive the devices of alice: %v", err)
+		}
+		if message.Type == model.DeviceListType {
+			if message.Payload.UserID != "alice" || len(message.Payload.Devices) != 1 || message.Payload.Devices[0].DeviceID != "laptop" {
+				t.Errorf("bob received %+v, want the laptop of alice", message.Payload)
+			}
+			break
+		}
+	}
+
+	carol.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, message, err := carol.ReadMessage(); err == nil {
+		t.Errorf("carol, who is not a contact, received %q", message)
+	}
+}
+
+func TestServer_DisconnectsSlowClients(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	// alice never reads, so her frames pile up until her queue is full.
+	dialTestServer(t, httpServer.URL, "alice")
+	waitForClients(t, server, 1)
+
+	server.clientsMu.Lock()
+	var alice *ServerHandler
+	for _, client := range server.clients {
+		alice = client
+	}
+	server.clientsMu.Unlock()
+
+	frame := &wireFrame{encoded: map[string][]byte{model.EncodingJSON: make([]byte, 1<<20)}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 2 * cap(alice.Conn.GetSendChan()) {
+			server.clientsMu.Lock()
+			alice.queue(frame)
+			server.clientsMu.Unlock()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue() blocked on a client that stopped reading")
+	}
+	waitForClients(t, server, 0)
+}
@@ -0,0 +1,434 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+	"github.com/osmancadc/go-encrypted-chat/pkg/crypto"
+)
+
+const keyGenerationTimeout = time.Minute
+
+func (h *ClientHandler) announcePublicKey(needsPublicKey bool) error {
+	// Until it is linked the key of this device is not the identity of the user.
+	if h.linking() {
+		return nil
+	}
+
+	publicKey, err := h.config.GetRsaInstance().GetPublicKeyValue()
+	if err != nil {
+		return err
+	}
+
+	return h.sendMessage(model.WebsocketMessage{
+		Type: model.PublicKeyExchangeType,
+		Payload: model.PublicKeyExchangePayload{
+			PublicKey:      publicKey,
+			NeedsPublicKey: needsPublicKey,
+			UserID:         h.Conn.User.Username,
+			DeviceID:       h.Conn.User.DeviceID,
+			Certificate:    h.config.GetCertificate(),
+		},
+	})
+}
+
+func (h *ClientHandler) handlePublicKey(payload model.PublicKeyExchangePayload) {
+	if payload.UserID == h.Conn.User.Username {
+		return
+	}
+	if err := identity.ValidateDeviceAddress(payload.UserID, payload.DeviceID); err != nil {
+		log.Warnf("Ignoring public key: %v\n", err)
+		return
+	}
+
+	if _, err := crypto.ParseRSAPublicKey(payload.PublicKey); err != nil {
+		log.Errorf("Invalid public key from %s: %v\n", payload.UserID, err)
+		return
+	}
+
+	// Linked devices prove their key with a certificate from the identity key,
+	// the device holding the identity key announces the identity key itself.
+	identityKey := payload.PublicKey
+	if payload.Certificate != nil {
+		var err error
+		identityKey, err = identity.VerifyDeviceCertificate(payload.Certificate, payload.UserID, payload.DeviceID, payload.PublicKey)
+		if err != nil {
+			log.Warnf("Ignoring device %s of %s with an invalid certificate: %v\n", payload.DeviceID, payload.UserID, err)
+			return
+		}
+	}
+
+	// A peer asking for keys has just connected and lost any session we sent it.
+	if payload.NeedsPublicKey {
+		h.config.RemoveSymmetricKey(identity.Device{UserID: payload.UserID, DeviceID: payload.DeviceID})
+	}
+
+	status := h.config.AddPublicKey(payload.UserID, identityKey)
+	switch status {
+	case config.KeyNew:
+		h.notify(h.conversationMessage(payload.UserID))
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("new contact %s trusted on first use, fingerprint %s", payload.UserID, crypto.Fingerprint(identityKey))})
+	case config.KeyChanged:
+		log.Warnf("Public key of %s changed\n", payload.UserID)
+		h.notifyKeyChange(payload.UserID)
+	case config.KeyRevoked:
+		log.Warnf("Ignoring device %s of %s, its identity key was revoked\n", payload.DeviceID, payload.UserID)
+		return
+	case config.KeyUnchanged:
+		h.notify(h.conversationMessage(payload.UserID))
+	}
+
+	if status != config.KeyChanged {
+		added, err := h.config.AddDevice(payload.UserID, payload.DeviceID, payload.PublicKey)
+		if err != nil {
+			log.Warnf("Ignoring device %s of %s: %v\n", payload.DeviceID, payload.UserID, err)
+		} else if added && payload.Certificate != nil {
+			h.notify(model.StatusMessage{Text: fmt.Sprintf("%s linked device %s, fingerprint %s", payload.UserID, payload.DeviceID, crypto.Fingerprint(payload.PublicKey))})
+		}
+	}
+
+	if payload.NeedsPublicKey {
+		if err := h.announcePublicKey(false); err != nil {
+			log.Errorf("Error announcing public key: %v\n", err)
+		}
+	}
+}
+
+func (h *ClientHandler) notifyKeyChange(userID string) {
+	contact, ok := h.config.GetContact(userID)
+	if !ok || !contact.HasPendingKey() {
+		return
+	}
+
+	h.notify(model.KeyChangeMessage{
+		UserID:         userID,
+		OldFingerprint: crypto.Fingerprint(contact.PublicKey),
+		NewFingerprint: crypto.Fingerprint(contact.PendingKey),
+	})
+}
+
+func (h *ClientHandler) acceptKey(userID string) error {
+	err := h.config.AcceptPendingKey(userID)
+	if err != nil {
+		return err
+	}
+
+	// The sessions we sent were encrypted to the old key, and any session the
+	// contact sent while its key was pending was rejected, so ask for new ones.
+	h.notify(model.KeyAcceptedMessage{UserID: userID})
+	h.notify(h.conversationMessage(userID))
+	h.resendPresence()
+
+	return h.announcePublicKey(true)
+}
+
+func (h *ClientHandler) rotateIdentity() error {
+	ctx, cancel := context.WithTimeout(context.Background(), keyGenerationTimeout)
+	defer cancel()
+
+	newKey, err := h.keys.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	rotation, err := h.config.RotateIdentity(h.Conn.User.Username, newKey)
+	if err != nil {
+		return err
+	}
+
+	return h.sendMessage(model.WebsocketMessage{
+		Type:    model.KeyRotationType,
+		Payload: rotation,
+	})
+}
+
+func (h *ClientHandler) handleKeyRotation(payload identity.KeyRotation) {
+	if payload.UserID == h.Conn.User.Username {
+		return
+	}
+	if _, ok := h.config.GetContact(payload.UserID); !ok {
+		return
+	}
+
+	if err := identity.VerifyKeyRotation(&payload); err != nil {
+		log.Warnf("Ignoring invalid key rotation from %s: %v\n", payload.UserID, err)
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("ignored a key rotation for %s that was not signed by both keys", payload.UserID)})
+		return
+	}
+
+	applied, err := h.config.ApplyKeyRotation(payload.UserID, payload.OldPublicKey, payload.NewPublicKey)
+	if err != nil {
+		log.Warnf("Ignoring key rotation from %s: %v\n", payload.UserID, err)
+		return
+	}
+	if !applied {
+		return
+	}
+
+	log.Infof("Contact %s rotated its identity key\n", payload.UserID)
+	h.notify(model.KeyAcceptedMessage{UserID: payload.UserID})
+	h.notify(h.conversationMessage(payload.UserID))
+	h.notify(model.StatusMessage{Text: fmt.Sprintf("%s rotated its identity key, new fingerprint %s", payload.UserID, crypto.Fingerprint(payload.NewPublicKey))})
+}
+
+func (h *ClientHandler) handleKeyRevocation(payload model.KeyRevocationPayload) {
+	if err := model.VerifyKeyRevocation(&payload); err != nil {
+		log.Warnf("Ignoring invalid key revocation for %s: %v\n", payload.UserID, err)
+		return
+	}
+
+	if payload.UserID == h.Conn.User.Username {
+		publicKey, _ := h.config.GetRsaInstance().GetPublicKeyValue()
+		identityKey, _ := h.config.GetIdentityKey()
+		if bytes.Equal(publicKey, payload.PublicKey) || bytes.Equal(identityKey, payload.PublicKey) {
+			log.Warn("Your identity key was revoked")
+			h.notify(model.StatusMessage{Text: "your identity key was revoked, contacts will refuse to encrypt to it"})
+		}
+		return
+	}
+
+	at := payload.EffectiveTime()
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	applied, err := h.config.RevokeKey(payload.UserID, payload.PublicKey, at, payload.Reason)
+	if err != nil {
+		log.Debugf("Ignoring key revocation for %s: %v\n", payload.UserID, err)
+		return
+	}
+	if !applied {
+		return
+	}
+
+	log.Warnf("A key of %s was revoked\n", payload.UserID)
+	h.resendPresence()
+	h.notify(model.KeyAcceptedMessage{UserID: payload.UserID})
+	h.notifyKeyChange(payload.UserID)
+	h.notify(h.conversationMessage(payload.UserID))
+	text := fmt.Sprintf("%s revoked the key %s", payload.UserID, crypto.Fingerprint(payload.PublicKey))
+	if payload.Reason != "" {
+		text += fmt.Sprintf(" (%s)", payload.Reason)
+	}
+	h.notify(model.StatusMessage{Text: text})
+}
+
+// maxMessageDelay is how much earlier than its arrival a message may claim to
+// be sent. The server keeps nothing, so messages arrive as they are sent and
+// only clock skew separates the two.
+const maxMessageDelay = 5 * time.Minute
+
+// revocationWarning flags messages authenticated by a revoked key and sent
+// after the revocation time. The time a message claims to be sent at is
+// chosen by the sender, so it is not trusted further back than
+// maxMessageDelay before the message arrived.
+func (h *ClientHandler) revocationWarning(payload model.TextMessagePayload) string {
+	revokedAt, revoked := h.revokedAt(payload.SenderID, payload.SenderDevice)
+	if !revoked {
+		return ""
+	}
+
+	sentAt := payload.SentAt
+	if earliest := time.Now().Add(-maxMessageDelay); sentAt.Before(earliest) {
+		sentAt = earliest
+	}
+	if sentAt.Before(revokedAt) {
+		return ""
+	}
+
+	return fmt.Sprintf("signed by a key revoked on %s", revokedAt.Local().Format(time.DateTime))
+}
+
+// authMode returns the authentication mode of the conversation with userID,
+// signatures unless another mode was chosen.
+func (h *ClientHandler) authMode(userID string) string {
+	if mode := h.config.GetAuthMode(userID); mode != "" {
+		return mode
+	}
+
+	return model.AuthModeSignature
+}
+
+func (h *ClientHandler) conversationMessage(userID string) model.ConversationMessage {
+	contact, _ := h.config.GetContact(userID)
+
+	return model.ConversationMessage{
+		UserID:   userID,
+		AuthMode: h.authMode(userID),
+		Trust:    string(contact.State),
+	}
+}
+
+// revokedAt reports when the identity key of userID or the key of the device
+// was revoked.
+func (h *ClientHandler) revokedAt(userID, deviceID string) (time.Time, bool) {
+	if at, revoked := h.config.RevokedAt(userID, h.config.GetPublicKey(userID)); revoked {
+		return at, true
+	}
+
+	return h.config.RevokedAt(userID, h.config.GetDeviceKey(userID, deviceID))
+}
+
+func (h *ClientHandler) ensureSessionKey(userID, deviceID string) ([]byte, error) {
+	device := identity.Device{UserID: userID, DeviceID: deviceID}
+	if _, revoked := h.revokedAt(userID, deviceID); revoked {
+		return nil, fmt.Errorf("the key of %s was revoked", device)
+	}
+
+	if key := h.config.GetSymmetricKey(device); key != nil {
+		return key, nil
+	}
+
+	peerKey, err := crypto.ParseRSAPublicKey(h.config.GetDeviceKey(userID, deviceID))
+	if err != nil {
+		return nil, fmt.Errorf("no usable public key for %s: %w", device, err)
+	}
+
+	aesInstance, err := crypto.GenerateAES(32, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := model.EncryptRSA(aesInstance.GetKey(), *peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyExchange := model.SymmetricKeyExchangePayload{
+		SenderID:        h.Conn.User.Username,
+		SenderDevice:    h.Conn.User.DeviceID,
+		RecipientID:     userID,
+		RecipientDevice: deviceID,
+		EncryptedKey:    encryptedKey,
+	}
+	keyExchange.Signature, err = h.config.GetRsaInstance().Sign(keyExchange.SignedData())
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.sendMessage(model.WebsocketMessage{
+		Type:    model.SymmetricKeyExchangeType,
+		Payload: keyExchange,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.config.AddSymmetricKey(device, aesInstance.GetKey())
+
+	return aesInstance.GetKey(), nil
+}
+
+func (h *ClientHandler) handleSymmetricKey(payload model.SymmetricKeyExchangePayload) {
+	if payload.RecipientID != h.Conn.User.Username || payload.RecipientDevice != h.Conn.User.DeviceID {
+		return
+	}
+	if err := identity.ValidateDeviceAddress(payload.SenderID, payload.SenderDevice); err != nil {
+		log.Warnf("Ignoring session key: %v\n", err)
+		return
+	}
+
+	// Only devices certified by the accepted key of a contact may open a
+	// session, never a pending one.
+	senderKey, err := crypto.ParseRSAPublicKey(h.config.GetDeviceKey(payload.SenderID, payload.SenderDevice))
+	if err != nil {
+		log.Errorf("Ignoring session key from unknown device %s\n", identity.DeviceAddress(payload.SenderID, payload.SenderDevice))
+		return
+	}
+	if _, revoked := h.revokedAt(payload.SenderID, payload.SenderDevice); revoked {
+		log.Warnf("Ignoring session key from %s signed by a revoked key\n", payload.SenderID)
+		return
+	}
+	if err := senderKey.Verify(payload.SignedData(), payload.Signature); err != nil {
+		log.Errorf("Ignoring session key from %s with an invalid signature\n", payload.SenderID)
+		h.notify(model.StatusMessage{Text: fmt.Sprintf("rejected a session key from %s that was not signed with its accepted key", payload.SenderID)})
+		return
+	}
+
+	key, err := model.DecryptRSA(payload.EncryptedKey, *h.config.GetRsaInstance())
+	if err != nil {
+		log.Errorf("Error decrypting session key from %s: %v\n", payload.SenderID, err)
+		return
+	}
+
+	h.config.AddInboundKey(identity.Device{UserID: payload.SenderID, DeviceID: payload.SenderDevice}, key)
+}
+
+func (h *ClientHandler) nextSequence(device identity.Device) uint64 {
+	h.sessionMu.Lock()
+	defer h.sessionMu.Unlock()
+
+	h.sequences[device]++
+	return h.sequences[device]
+}
+
+func (h *ClientHandler) encryptFor(userID, deviceID string, content model.Content, messageID string) (payload model.TextMessagePayload, err error) {
+	plaintext, err := content.Marshal()
+	if err != nil {
+		return
+	}
+
+	key, err := h.ensureSessionKey(userID, deviceID)
+	if err != nil {
+		return
+	}
+
+	aesInstance, err := crypto.NewAES(key)
+	if err != nil {
+		return
+	}
+
+	envelope, err := model.SealEnvelope([]byte(plaintext), *aesInstance, crypto.KeyID(key), h.nextSequence(identity.Device{UserID: userID, DeviceID: deviceID}))
+	if err != nil {
+		return
+	}
+
+	payload = model.TextMessagePayload{
+		MessageID:       messageID,
+		SenderID:        h.Conn.User.Username,
+		SenderDevice:    h.Conn.User.DeviceID,
+		RecipientID:     userID,
+		RecipientDevice: deviceID,
+		SentAt:          time.Now().UTC(),
+		Ciphertext:      envelope,
+	}
+	err = model.AuthenticateMessage(&payload, h.authMode(userID), *h.config.GetRsaInstance(), key)
+
+	return
+}
+
+func (h *ClientHandler) decryptFrom(payload model.TextMessagePayload) (content string, err error) {
+	device := identity.Device{UserID: payload.SenderID, DeviceID: payload.SenderDevice}
+	key := h.config.GetInboundKey(device)
+	if key == nil {
+		return "", fmt.Errorf("no session key from %s", device)
+	}
+
+	senderKey, err := crypto.ParseRSAPublicKey(h.config.GetDeviceKey(payload.SenderID, payload.SenderDevice))
+	if err != nil {
+		return "", fmt.Errorf("no usable public key for %s: %w", device, err)
+	}
+
+	err = model.VerifyMessage(&payload, *senderKey, key)
+	if err != nil {
+		return "", fmt.Errorf("authentication failed: %w", err)
+	}
+
+	aesInstance, err := crypto.NewAES(key)
+	if err != nil {
+		return
+	}
+
+	_, plaintext, err := model.OpenEnvelope(payload.Ciphertext, *aesInstance)
+	if err != nil {
+		return
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+func TestRevokedKeyMessages(t *testing.T) {
+	tests := []struct {
+		name        string
+		revokedAt   time.Duration
+		sentAt      time.Duration
+		wantFlagged bool
+	}{
+		{name: "Sent after the revocation", revokedAt: -time.Hour, sentAt: 0, wantFlagged: true},
+		// The time a message was sent at is chosen by its sender.
+		{name: "Back-dated past the revocation", revokedAt: -time.Hour, sentAt: -365 * 24 * time.Hour, wantFlagged: true},
+		{name: "Sent just before the revocation", revokedAt: 0, sentAt: -time.Minute, wantFlagged: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := newTestClient(t, "alice")
+			bob := newTestClient(t, "bob")
+
+			alice.announcePublicKey(true)
+			exchange(alice, bob)
+			incoming(bob)
+
+			publicKey, _ := alice.config.GetRsaInstance().GetPublicKeyValue()
+			if _, err := bob.config.RevokeKey("alice", publicKey, time.Now().Add(tt.revokedAt), "stolen laptop"); err != nil {
+				t.Fatalf("RevokeKey() error = %v", err)
+			}
+
+			sent := model.TextMessagePayload{SenderID: "alice", SenderDevice: alice.Conn.User.DeviceID, SentAt: time.Now().Add(tt.sentAt)}
+			bob.handleContent(sent, model.Content{Kind: model.ContentText, Text: "trust me"})
+			if messages := incoming(bob); len(messages) != 1 || (messages[0].Warning != "") != tt.wantFlagged {
+				t.Errorf("bob received %+v, want flagged %v", messages, tt.wantFlagged)
+			}
+
+			bob.handleContent(sent, model.Content{Kind: model.ContentEdit, Target: "message-1", Text: "forged"})
+			bob.handleContent(sent, model.Content{Kind: model.ContentReaction, Target: "message-1", Text: "👍"})
+			applied := 0
+			for len(bob.externalMsgChan) > 0 {
+				switch (<-bob.externalMsgChan).(type) {
+				case model.EditMessage, model.ReactionMessage:
+					applied++
+				}
+			}
+			if wantApplied := map[bool]int{true: 0, false: 2}[tt.wantFlagged]; applied != wantApplied {
+				t.Errorf("bob applied %d edits and reactions, want %d", applied, wantApplied)
+			}
+		})
+	}
+}
+
+func TestSlashedUsernamesAreIgnored(t *testing.T) {
+	mallory := newTestClient(t, "alice/dev1")
+	bob := newTestClient(t, "bob")
+
+	mallory.announcePublicKey(true)
+	exchange(mallory, bob)
+
+	if contacts := bob.config.GetContacts(); len(contacts) != 0 {
+		t.Errorf("bob trusted %+v, want no contact", contacts)
+	}
+}
+
+func TestKeyChangeBlocksOnlyThatContact(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+	carol := newTestClient(t, "carol")
+
+	alice.announcePublicKey(true)
+	deliver(alice, bob, carol)
+	exchange(alice, bob)
+	exchange(alice, carol)
+	incoming(bob)
+	incoming(carol)
+
+	otherKey, _ := newTestClient(t, "mallory").config.GetRsaInstance().GetPublicKeyValue()
+	if status := alice.config.AddPublicKey("carol", otherKey); status != config.KeyChanged {
+		t.Fatalf("AddPublicKey() = %v, want a changed key", status)
+	}
+
+	alice.sendText(model.TextMessagePayload{MessageID: "message-1", Content: "hello"})
+	deliver(alice, bob, carol)
+
+	if messages := incoming(bob); len(messages) != 1 {
+		t.Errorf("bob received %d messages, want 1", len(messages))
+	}
+	if messages := incoming(carol); len(messages) != 0 {
+		t.Errorf("carol, whose key changed, received %d messages", len(messages))
+	}
+
+	statuses := []string{}
+	for len(alice.externalMsgChan) > 0 {
+		if status, ok := (<-alice.externalMsgChan).(model.StatusMessage); ok {
+			statuses = append(statuses, status.Text)
+		}
+	}
+	if !slices.ContainsFunc(statuses, func(text string) bool { return strings.Contains(text, "not sent to carol") }) {
+		t.Errorf("statuses = %q, want one naming carol", statuses)
+	}
+}
@@ -0,0 +1,26 @@
+package websocket
+
+import (
+	"github.com/osmancadc/go-encrypted-chat/internal/identity"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+// sendTyping tells every device of every contact whether the user is typing.
+// Signals are best effort, failures are only logged, and contacts known to be
+// offline or whose key changed are skipped.
+func (h *ClientHandler) sendTyping(typing bool) {
+	content := model.Content{Kind: model.ContentStopped}
+	if typing {
+		content.Kind = model.ContentTyping
+	}
+	for _, userID := range h.config.GetUserIDs() {
+		if h.knownOffline(userID) || h.config.HasPendingKey(userID) {
+			continue
+		}
+		for deviceID := range h.config.GetDevices(userID) {
+			if err := h.sendContent(userID, deviceID, content, ""); err != nil {
+				log.Debugf("Error sending a typing signal to %s: %v\n", identity.DeviceAddress(userID, deviceID), err)
+			}
+		}
+	}
+}
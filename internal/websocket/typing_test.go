@@ -0,0 +1,47 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+func TestTypingSignals(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+
+	alice.announcePublicKey(true)
+	exchange(alice, bob)
+	incoming(bob)
+
+	for _, typing := range []bool{true, false} {
+		alice.sendTyping(typing)
+		exchange(alice, bob)
+
+		signals := []model.TypingMessage{}
+		for len(bob.externalMsgChan) > 0 {
+			if signal, ok := (<-bob.externalMsgChan).(model.TypingMessage); ok {
+				signals = append(signals, signal)
+			}
+		}
+		want := model.TypingMessage{UserID: "alice", Typing: typing}
+		if len(signals) != 1 || signals[0] != want {
+			t.Errorf("bob received %+v, want %+v", signals, want)
+		}
+	}
+}
+
+func TestTypingSignals_OfflineContact(t *testing.T) {
+	alice := newTestClient(t, "alice")
+	bob := newTestClient(t, "bob")
+
+	alice.announcePublicKey(true)
+	exchange(alice, bob)
+
+	alice.handlePresence(model.PresencePayload{UserID: "bob", State: model.PresenceOffline})
+	alice.sendTyping(true)
+
+	if sent := len(alice.Conn.GetSendChan()); sent != 0 {
+		t.Errorf("alice sent %d signals to an offline contact", sent)
+	}
+}
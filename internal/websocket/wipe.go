@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+const wipeTimeout = 3 * time.Second
+
+// wipeAccount drops the frames still queued for the client. The server keeps
+// no messages for offline clients, so nothing else is held for the account;
+// its device is forgotten when the caller closes the connection.
+func (h *ServerHandler) wipeAccount() {
+	for dropped := true; dropped; {
+		select {
+		case <-h.Conn.GetSendChan():
+		default:
+			dropped = false
+		}
+	}
+
+	h.server.log.Infof("Client %s wiped its account\n", h.Conn.ID)
+}
+
+// RequestWipe asks the server at url to forget the device of user, waiting
+// until the server closes the connection.
+func RequestWipe(url string, user model.User) error {
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %w", url, err)
+	}
+	defer conn.Close()
+
+	if _, err := clientHandshake(conn, user, model.EncodingJSON); err != nil {
+		return err
+	}
+	if err := conn.WriteJSON(model.WebsocketMessage{Type: model.AccountWipeType}); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(wipeTimeout))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return fmt.Errorf("the server did not confirm the wipe: %w", err)
+		}
+	}
+}
+
+// panicWipe destroys the local state first, then tells the server and exits.
+// The terminal is cleared since it may still show the conversation.
+func (h *ClientHandler) panicWipe() {
+	wipeErr := h.wipeLocal()
+
+	h.sendMessage(model.WebsocketMessage{Type: model.AccountWipeType})
+	select {
+	case <-h.closed:
+	case <-time.After(wipeTimeout):
+	}
+
+	fmt.Print("\x1b[3J\x1b[H\x1b[2J")
+	if wipeErr != nil {
+		fmt.Printf("Error: the wipe is incomplete: %v\n", wipeErr)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// wipeLocal closes the history before destroying it, frames are still read
+// while the server confirms the wipe and must not write it again.
+func (h *ClientHandler) wipeLocal() error {
+	if h.history != nil {
+		h.history.Close()
+	}
+
+	return h.config.Wipe(h.settings.History)
+}
@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/osmancadc/go-encrypted-chat/config"
+	"github.com/osmancadc/go-encrypted-chat/internal/model"
+)
+
+func TestWipeLocal_StopsHistory(t *testing.T) {
+	bob := newTestClient(t, "bob")
+	bob.settings.History = filepath.Join(t.TempDir(), "history.jsonl")
+	bob.history = config.OpenHistory(bob.settings.History)
+
+	message := model.TextMessagePayload{SenderID: "alice", SenderDevice: "laptop", MessageID: "message-1"}
+	bob.handleContent(message, model.Content{Kind: model.ContentText, Text: "before"})
+	if err := bob.wipeLocal(); err != nil {
+		t.Fatalf("wipeLocal() error = %v", err)
+	}
+
+	// A message still in flight while the server confirms the wipe.
+	message.MessageID = "message-2"
+	bob.handleContent(message, model.Content{Kind: model.ContentText, Text: "after"})
+	bob.handleContent(message, model.Content{Kind: model.ContentReaction, Target: "message-1", Text: "👍"})
+
+	if _, err := os.Stat(bob.settings.History); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("history %s was written after the wipe", bob.settings.History)
+	}
+}
+
+func TestServer_WipeForgetsDevice(t *testing.T) {
+	server := NewServer(config.DefaultSettings().Server)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	dialTestDevice(t, httpServer.URL, model.User{Username: "bob", DeviceID: "phone"})
+	waitForClients(t, server, 1)
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+	if err := RequestWipe(url, model.User{Username: "alice", DeviceID: "laptop"}); err != nil {
+		t.Fatalf("RequestWipe() error = %v", err)
+	}
+	waitForClients(t, server, 1)
+
+	server.clientsMu.Lock()
+	defer server.clientsMu.Unlock()
+	if devices, ok := server.devices["alice"]; ok {
+		t.Errorf("devices of alice = %v, want none", devices)
+	}
+}
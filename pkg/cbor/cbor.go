@@ -0,0 +1,683 @@
+package cbor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The subset of CBOR (RFC 8949) used on the wire: definite lengths only,
+// struct fields keyed by their json tag, time.Time as a tag 0 string and
+// []byte as byte strings. Map keys are sorted so the encoding is
+// deterministic.
+const (
+	majorUnsigned byte = 0 << 5
+	majorNegative byte = 1 << 5
+	majorBytes    byte = 2 << 5
+	majorText     byte = 3 << 5
+	majorArray    byte = 4 << 5
+	majorMap      byte = 5 << 5
+	majorTag      byte = 6 << 5
+	majorSimple   byte = 7 << 5
+
+	simpleFalse   = 20
+	simpleTrue    = 21
+	simpleNull    = 22
+	simpleFloat32 = 26
+	simpleFloat64 = 27
+
+	tagDateTime = 0
+
+	maxDepth = 64
+)
+
+// RawMessage is an encoded CBOR item, kept as is by Marshal and Unmarshal.
+type RawMessage []byte
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(RawMessage(nil))
+
+	ErrMalformed = errors.New("cbor: malformed input")
+)
+
+func Marshal(v interface{}) ([]byte, error) {
+	var e encoder
+	if err := e.encode(reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+// Unmarshal decodes data into the value v points to. Unknown map keys are
+// skipped, like encoding/json does.
+func Unmarshal(data []byte, v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("cbor: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+
+	d := decoder{data: data}
+	if err := d.decode(target.Elem(), 0); err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformed, len(data)-d.pos)
+	}
+
+	return nil
+}
+
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map
+
+// fieldsOf lists the fields of a struct type as encoding/json names them.
+func fieldsOf(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	fields := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+		tag := structField.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = structField.Name
+		}
+		fields = append(fields, field{name: name, index: i, omitEmpty: strings.Contains(","+options+",", ",omitempty,")})
+	}
+
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, major|26), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, major|27), n)
+	}
+}
+
+func (e *encoder) text(s string) {
+	e.head(majorText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) encode(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("cbor: nesting deeper than %d", maxDepth)
+	}
+	if !v.IsValid() {
+		e.buf = append(e.buf, majorSimple|simpleNull)
+		return nil
+	}
+
+	switch v.Type() {
+	case timeType:
+		e.head(majorTag, tagDateTime)
+		e.text(v.Interface().(time.Time).Format(time.RFC3339Nano))
+		return nil
+	case rawType:
+		if v.Len() == 0 {
+			e.buf = append(e.buf, majorSimple|simpleNull)
+		} else {
+			e.buf = append(e.buf, v.Bytes()...)
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, majorSimple|simpleTrue)
+		} else {
+			e.buf = append(e.buf, majorSimple|simpleFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n >= 0 {
+			e.head(majorUnsigned, uint64(n))
+		} else {
+			e.head(majorNegative, uint64(-1-n))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.head(majorUnsigned, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, majorSimple|simpleFloat64), math.Float64bits(v.Float()))
+	case reflect.String:
+		e.text(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, majorSimple|simpleNull)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.head(majorBytes, uint64(v.Len()))
+			e.buf = append(e.buf, v.Bytes()...)
+			return nil
+		}
+		return e.array(v, depth)
+	case reflect.Array:
+		return e.array(v, depth)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cbor: unsupported map key type %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			e.buf = append(e.buf, majorSimple|simpleNull)
+			return nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		e.head(majorMap, uint64(len(keys)))
+		for _, key := range keys {
+			e.text(key.String())
+			if err := e.encode(v.MapIndex(key), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := []field{}
+		for _, f := range fieldsOf(v.Type()) {
+			if !f.omitEmpty || !isEmpty(v.Field(f.index)) {
+				fields = append(fields, f)
+			}
+		}
+		e.head(majorMap, uint64(len(fields)))
+		for _, f := range fields {
+			e.text(f.name)
+			if err := e.encode(v.Field(f.index), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, majorSimple|simpleNull)
+			return nil
+		}
+		return e.encode(v.Elem(), depth+1)
+	default:
+		return fmt.Errorf("cbor: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func (e *encoder) array(v reflect.Value, depth int) error {
+	e.head(majorArray, uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i), depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isEmpty follows the omitempty rules of encoding/json.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+
+	return false
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+// head reads the initial byte of an item and its argument, which is the
+// length, the value or, for floats, the bits.
+func (d *decoder) head() (major, info byte, n uint64, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, 0, fmt.Errorf("%w: unexpected end of input", ErrMalformed)
+	}
+	initial := d.data[d.pos]
+	d.pos++
+	major, info = initial&0xe0, initial&0x1f
+
+	size := 0
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	case info == 31:
+		return 0, 0, 0, fmt.Errorf("%w: indefinite lengths are not supported", ErrMalformed)
+	default:
+		return 0, 0, 0, fmt.Errorf("%w: reserved value %#x", ErrMalformed, initial)
+	}
+
+	argument, err := d.read(uint64(size))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, b := range argument {
+		n = n<<8 | uint64(b)
+	}
+
+	return major, info, n, nil
+}
+
+func (d *decoder) read(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end of input", ErrMalformed)
+	}
+	data := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+
+	return data, nil
+}
+
+// count checks that n items can still follow, each taking at least a byte,
+// before anything is allocated for them.
+func (d *decoder) count(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, fmt.Errorf("%w: %d items cannot fit in %d bytes", ErrMalformed, n, len(d.data)-d.pos)
+	}
+
+	return int(n), nil
+}
+
+func (d *decoder) text() (string, error) {
+	major, _, n, err := d.head()
+	if err != nil {
+		return "", err
+	}
+	if major != majorText {
+		return "", fmt.Errorf("%w: expected a text string", ErrMalformed)
+	}
+	data, err := d.read(n)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("%w: invalid UTF-8 in text string", ErrMalformed)
+	}
+
+	return string(data), nil
+}
+
+func (d *decoder) skip(depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%w: nesting deeper than %d", ErrMalformed, maxDepth)
+	}
+
+	major, _, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case majorBytes, majorText:
+		_, err = d.read(n)
+		return err
+	case majorArray, majorMap:
+		items, err := d.count(n)
+		if err != nil {
+			return err
+		}
+		if major == majorMap {
+			items *= 2
+		}
+		for i := 0; i < items; i++ {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	case majorTag:
+		return d.skip(depth + 1)
+	}
+
+	return nil
+}
+
+func (d *decoder) decode(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%w: nesting deeper than %d", ErrMalformed, maxDepth)
+	}
+
+	if v.Type() == rawType {
+		start := d.pos
+		if err := d.skip(depth); err != nil {
+			return err
+		}
+		v.SetBytes(append([]byte(nil), d.data[start:d.pos]...))
+		return nil
+	}
+	if d.pos < len(d.data) && d.data[d.pos] == majorSimple|simpleNull {
+		d.pos++
+		v.SetZero()
+		return nil
+	}
+	if v.Type() == timeType {
+		return d.decodeTime(v)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem(), depth+1)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("cbor: cannot decode into %s", v.Type())
+		}
+		value, err := d.generic(depth)
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	}
+
+	major, info, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	mismatch := func() error {
+		return fmt.Errorf("%w: cannot decode major type %d into %s", ErrMalformed, major>>5, v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if major != majorSimple || (info != simpleFalse && info != simpleTrue) {
+			return mismatch()
+		}
+		v.SetBool(info == simpleTrue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if (major != majorUnsigned && major != majorNegative) || n > math.MaxInt64 {
+			return mismatch()
+		}
+		value := int64(n)
+		if major == majorNegative {
+			value = -1 - value
+		}
+		if v.OverflowInt(value) {
+			return fmt.Errorf("%w: %d overflows %s", ErrMalformed, value, v.Type())
+		}
+		v.SetInt(value)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if major != majorUnsigned {
+			return mismatch()
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("%w: %d overflows %s", ErrMalformed, n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case major == majorSimple && info == simpleFloat64:
+			v.SetFloat(math.Float64frombits(n))
+		case major == majorSimple && info == simpleFloat32:
+			v.SetFloat(float64(math.Float32frombits(uint32(n))))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		if major != majorText {
+			return mismatch()
+		}
+		data, err := d.read(n)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(data) {
+			return fmt.Errorf("%w: invalid UTF-8 in text string", ErrMalformed)
+		}
+		v.SetString(string(data))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if major != majorBytes {
+				return mismatch()
+			}
+			data, err := d.read(n)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte{}, data...))
+			return nil
+		}
+		if major != majorArray {
+			return mismatch()
+		}
+		items, err := d.count(n)
+		if err != nil {
+			return err
+		}
+		slice := reflect.MakeSlice(v.Type(), items, items)
+		for i := 0; i < items; i++ {
+			if err := d.decode(slice.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Array:
+		if major != majorArray {
+			return mismatch()
+		}
+		items, err := d.count(n)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < items; i++ {
+			if i >= v.Len() {
+				if err := d.skip(depth + 1); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if major != majorMap || v.Type().Key().Kind() != reflect.String {
+			return mismatch()
+		}
+		items, err := d.count(n)
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), items))
+		}
+		for i := 0; i < items; i++ {
+			key, err := d.text()
+			if err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), value)
+		}
+	case reflect.Struct:
+		if major != majorMap {
+			return mismatch()
+		}
+		items, err := d.count(n)
+		if err != nil {
+			return err
+		}
+		fields := map[string]int{}
+		for _, f := range fieldsOf(v.Type()) {
+			fields[f.name] = f.index
+		}
+		for i := 0; i < items; i++ {
+			key, err := d.text()
+			if err != nil {
+				return err
+			}
+			index, ok := fields[key]
+			if !ok {
+				if err := d.skip(depth + 1); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Field(index), depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func (d *decoder) decodeTime(v reflect.Value) error {
+	major, _, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	if major != majorTag || n != tagDateTime {
+		return fmt.Errorf("%w: expected a date/time string", ErrMalformed)
+	}
+	text, err := d.text()
+	if err != nil {
+		return err
+	}
+	t, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	v.Set(reflect.ValueOf(t))
+
+	return nil
+}
+
+// generic decodes an item into the types encoding/json uses for interface{},
+// except that integers stay integers and byte strings stay []byte.
+func (d *decoder) generic(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: nesting deeper than %d", ErrMalformed, maxDepth)
+	}
+	if d.pos < len(d.data) && d.data[d.pos] == majorTag|tagDateTime {
+		var t time.Time
+		err := d.decodeTime(reflect.ValueOf(&t).Elem())
+		return t, err
+	}
+
+	start := d.pos
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case majorUnsigned:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case majorNegative:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: negative integer out of range", ErrMalformed)
+		}
+		return -1 - int64(n), nil
+	case majorBytes:
+		data, err := d.read(n)
+		return append([]byte{}, data...), err
+	case majorText:
+		d.pos = start
+		return d.text()
+	case majorArray:
+		items, err := d.count(n)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, items)
+		for i := range values {
+			if values[i], err = d.generic(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case majorMap:
+		items, err := d.count(n)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]interface{}, items)
+		for i := 0; i < items; i++ {
+			key, err := d.text()
+			if err != nil {
+				return nil, err
+			}
+			if values[key], err = d.generic(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case majorTag:
+		return d.generic(depth + 1)
+	}
+
+	switch info {
+	case simpleFalse, simpleTrue:
+		return info == simpleTrue, nil
+	case simpleNull:
+		return nil, nil
+	case simpleFloat32:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case simpleFloat64:
+		return math.Float64frombits(n), nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported simple value %d", ErrMalformed, info)
+}
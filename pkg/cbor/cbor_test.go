@@ -0,0 +1,138 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarshal_RFCVectors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "0", value: 0, want: "00"},
+		{name: "23", value: 23, want: "17"},
+		{name: "24", value: 24, want: "1818"},
+		{name: "1000", value: 1000, want: "1903e8"},
+		{name: "1000000000000", value: int64(1000000000000), want: "1b000000e8d4a51000"},
+		{name: "-1", value: -1, want: "20"},
+		{name: "-1000", value: -1000, want: "3903e7"},
+		{name: "false", value: false, want: "f4"},
+		{name: "true", value: true, want: "f5"},
+		{name: "null", value: nil, want: "f6"},
+		{name: "text", value: "IETF", want: "6449455446"},
+		{name: "bytes", value: []byte{1, 2, 3, 4}, want: "4401020304"},
+		{name: "array", value: []int{1, 2, 3}, want: "83010203"},
+		{name: "map", value: map[string]interface{}{"a": 1, "b": []int{2, 3}}, want: "a26161016162820203"},
+		{name: "date/time", value: time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC), want: "c074323031332d30332d32315432303a30343a30305a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("Marshal() = %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+type inner struct {
+	Name string `json:"name"`
+}
+
+type sample struct {
+	Text     string            `json:"text"`
+	Number   int               `json:"number"`
+	Negative int64             `json:"negative"`
+	Flag     bool              `json:"flag"`
+	Data     []byte            `json:"data"`
+	Time     time.Time         `json:"time"`
+	List     []inner           `json:"list"`
+	Pointer  *inner            `json:"pointer,omitempty"`
+	Labels   map[string]string `json:"labels"`
+	Skipped  string            `json:"-"`
+	Empty    string            `json:"empty,omitempty"`
+	Raw      RawMessage        `json:"raw"`
+	Any      interface{}       `json:"any"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	value := sample{
+		Text:     "héllo",
+		Number:   70000,
+		Negative: -5,
+		Flag:     true,
+		Data:     []byte{0, 1, 2},
+		Time:     time.Date(2026, 10, 19, 8, 30, 0, 123456789, time.UTC),
+		List:     []inner{{Name: "a"}, {Name: "b"}},
+		Pointer:  &inner{Name: "c"},
+		Labels:   map[string]string{"z": "1", "a": "2"},
+		Skipped:  "not encoded",
+		Raw:      RawMessage{0x83, 0x01, 0x02, 0x03},
+		Any:      map[string]interface{}{"n": int64(1), "s": "x"},
+	}
+
+	data, err := Marshal(value)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if bytes.Contains(data, []byte("not encoded")) || bytes.Contains(data, []byte("empty")) {
+		t.Errorf("Marshal() encoded a skipped or empty field")
+	}
+
+	var got sample
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	value.Skipped = ""
+	if !reflect.DeepEqual(got, value) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, value)
+	}
+
+	again, _ := Marshal(got)
+	if !bytes.Equal(again, data) {
+		t.Errorf("the encoding is not deterministic")
+	}
+}
+
+func TestUnmarshal_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "Empty input", data: ""},
+		{name: "Truncated text", data: "644945"},
+		{name: "Indefinite length", data: "9f01ff"},
+		{name: "Length beyond the input", data: "9b7fffffffffffffff"},
+		{name: "Trailing bytes", data: "a0a0"},
+		{name: "Invalid UTF-8", data: "a16474657874" + "61ff"},
+		{name: "Wrong type", data: "a164746578740f"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.data)
+			var got sample
+			if err := Unmarshal(data, &got); !errors.Is(err, ErrMalformed) {
+				t.Errorf("Unmarshal() error = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestUnmarshal_DeepNesting(t *testing.T) {
+	data, _ := hex.DecodeString(strings.Repeat("81", maxDepth+2) + "00")
+
+	var got interface{}
+	if err := Unmarshal(data, &got); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Unmarshal() error = %v, want ErrMalformed", err)
+	}
+}
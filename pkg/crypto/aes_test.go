@@ -161,6 +161,9 @@ func TestEncryptWithAESGCM(t *testing.T) {
 		},
 	}
 
+	systemReader := rand.Reader
+	defer func() { rand.Reader = systemReader }()
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a, _ := GenerateAES(tt.fields.size, tt.fields.reader)
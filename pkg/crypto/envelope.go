@@ -0,0 +1,191 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Envelope layout (all integers big endian), see docs/envelope.md:
+//
+//	version(1) | suite(1) | keyID(4) | sequence(8) | nonce(n) | ciphertext+tag
+//
+// The fixed header (version to sequence) is authenticated as additional data.
+const (
+	EnvelopeVersion1 byte = 0x01
+
+	SuiteAES128GCM byte = 0x01
+	SuiteAES256GCM byte = 0x02
+
+	EnvelopeHeaderSize = 14
+	MaxEnvelopeSize    = 1 << 20
+)
+
+type suiteParams struct {
+	keySize   int
+	nonceSize int
+	tagSize   int
+}
+
+var suites = map[byte]suiteParams{
+	SuiteAES128GCM: {keySize: 16, nonceSize: 12, tagSize: 16},
+	SuiteAES256GCM: {keySize: 32, nonceSize: 12, tagSize: 16},
+}
+
+type Envelope struct {
+	Version    byte
+	Suite      byte
+	KeyID      uint32
+	Sequence   uint64
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func SuiteForKey(key []byte) (byte, error) {
+	for id, params := range suites {
+		if params.keySize == len(key) {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no envelope suite for a %d byte key", len(key))
+}
+
+func (e *Envelope) Header() []byte {
+	header := make([]byte, EnvelopeHeaderSize)
+	header[0] = e.Version
+	header[1] = e.Suite
+	binary.BigEndian.PutUint32(header[2:6], e.KeyID)
+	binary.BigEndian.PutUint64(header[6:14], e.Sequence)
+
+	return header
+}
+
+func (e *Envelope) Marshal() ([]byte, error) {
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, EnvelopeHeaderSize+len(e.Nonce)+len(e.Ciphertext))
+	data = append(data, e.Header()...)
+	data = append(data, e.Nonce...)
+	data = append(data, e.Ciphertext...)
+
+	if len(data) > MaxEnvelopeSize {
+		return nil, fmt.Errorf("envelope of %d bytes exceeds the maximum of %d", len(data), MaxEnvelopeSize)
+	}
+
+	return data, nil
+}
+
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	if len(data) > MaxEnvelopeSize {
+		return nil, fmt.Errorf("envelope of %d bytes exceeds the maximum of %d", len(data), MaxEnvelopeSize)
+	}
+	if len(data) < EnvelopeHeaderSize {
+		return nil, fmt.Errorf("envelope too short: %d bytes", len(data))
+	}
+
+	envelope := &Envelope{
+		Version:  data[0],
+		Suite:    data[1],
+		KeyID:    binary.BigEndian.Uint32(data[2:6]),
+		Sequence: binary.BigEndian.Uint64(data[6:14]),
+	}
+	if envelope.Version != EnvelopeVersion1 {
+		return nil, fmt.Errorf("unsupported envelope version %d", envelope.Version)
+	}
+
+	params, ok := suites[envelope.Suite]
+	if !ok {
+		return nil, fmt.Errorf("unknown envelope suite %d", envelope.Suite)
+	}
+
+	body := data[EnvelopeHeaderSize:]
+	if len(body) < params.nonceSize+params.tagSize {
+		return nil, fmt.Errorf("envelope body too short for suite %d: %d bytes", envelope.Suite, len(body))
+	}
+
+	envelope.Nonce = append([]byte(nil), body[:params.nonceSize]...)
+	envelope.Ciphertext = append([]byte(nil), body[params.nonceSize:]...)
+
+	return envelope, nil
+}
+
+func (e *Envelope) validate() error {
+	if e.Version != EnvelopeVersion1 {
+		return fmt.Errorf("unsupported envelope version %d", e.Version)
+	}
+
+	params, ok := suites[e.Suite]
+	if !ok {
+		return fmt.Errorf("unknown envelope suite %d", e.Suite)
+	}
+	if len(e.Nonce) != params.nonceSize {
+		return fmt.Errorf("invalid nonce size %d for suite %d", len(e.Nonce), e.Suite)
+	}
+	if len(e.Ciphertext) < params.tagSize {
+		return fmt.Errorf("ciphertext shorter than the %d byte tag", params.tagSize)
+	}
+
+	return nil
+}
+
+func (a *AES) SealEnvelope(factory CipherFactory, randReader Reader, keyID uint32, sequence uint64, plaintext []byte) (data []byte, err error) {
+	suite, err := SuiteForKey(a.key)
+	if err != nil {
+		return
+	}
+
+	nonce, err := generateNonce(randReader)
+	if err != nil {
+		return
+	}
+
+	block, err := factory.newCipher(a.key)
+	if err != nil {
+		return
+	}
+
+	gcm, err := factory.newGCM(block)
+	if err != nil {
+		return
+	}
+
+	envelope := Envelope{
+		Version:  EnvelopeVersion1,
+		Suite:    suite,
+		KeyID:    keyID,
+		Sequence: sequence,
+		Nonce:    nonce,
+	}
+	envelope.Ciphertext = gcm.Seal(nil, nonce, plaintext, envelope.Header())
+
+	return envelope.Marshal()
+}
+
+func (a *AES) OpenEnvelope(factory CipherFactory, data []byte) (envelope *Envelope, plaintext []byte, err error) {
+	envelope, err = ParseEnvelope(data)
+	if err != nil {
+		return
+	}
+
+	if suites[envelope.Suite].keySize != len(a.key) {
+		return nil, nil, fmt.Errorf("key of %d bytes does not match envelope suite %d", len(a.key), envelope.Suite)
+	}
+
+	block, err := factory.newCipher(a.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gcm, err := factory.newGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err = gcm.Open(nil, envelope.Nonce, envelope.Ciphertext, envelope.Header())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
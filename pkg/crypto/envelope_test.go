@@ -0,0 +1,143 @@
+package crypto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSealAndOpenEnvelope(t *testing.T) {
+	tests := []struct {
+		name      string
+		keySize   int
+		wantSuite byte
+	}{
+		{
+			name:      "AES-128 key uses suite 1",
+			keySize:   16,
+			wantSuite: SuiteAES128GCM,
+		},
+		{
+			name:      "AES-256 key uses suite 2",
+			keySize:   32,
+			wantSuite: SuiteAES256GCM,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := GenerateAES(tt.keySize, &mockReader{})
+
+			data, err := a.SealEnvelope(&Encryptor{}, &mockReader{}, 7, 42, []byte("test_message"))
+			if err != nil {
+				t.Fatalf("AES.SealEnvelope() error = %v", err)
+			}
+
+			envelope, plaintext, err := a.OpenEnvelope(&Encryptor{}, data)
+			if err != nil {
+				t.Fatalf("AES.OpenEnvelope() error = %v", err)
+			}
+			if envelope.Suite != tt.wantSuite || envelope.KeyID != 7 || envelope.Sequence != 42 {
+				t.Errorf("AES.OpenEnvelope() header = %+v", envelope)
+			}
+			if !reflect.DeepEqual(plaintext, []byte("test_message")) {
+				t.Errorf("AES.OpenEnvelope() = %s, want test_message", plaintext)
+			}
+		})
+	}
+}
+
+func TestOpenEnvelopeRejectsTampering(t *testing.T) {
+	a, _ := GenerateAES(32, &mockReader{})
+	data, _ := a.SealEnvelope(&Encryptor{}, &mockReader{}, 1, 1, []byte("test_message"))
+
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+	}{
+		{
+			name:   "Modified key ID",
+			mutate: func(d []byte) []byte { d[5] ^= 0x01; return d },
+		},
+		{
+			name:   "Modified sequence",
+			mutate: func(d []byte) []byte { d[13] ^= 0x01; return d },
+		},
+		{
+			name:   "Modified ciphertext",
+			mutate: func(d []byte) []byte { d[len(d)-1] ^= 0x01; return d },
+		},
+		{
+			name:   "Downgraded suite",
+			mutate: func(d []byte) []byte { d[1] = SuiteAES128GCM; return d },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.mutate(append([]byte(nil), data...))
+			if _, _, err := a.OpenEnvelope(&Encryptor{}, tampered); err == nil {
+				t.Errorf("AES.OpenEnvelope() accepted a tampered envelope")
+			}
+		})
+	}
+}
+
+func TestParseEnvelope(t *testing.T) {
+	valid := append([]byte{EnvelopeVersion1, SuiteAES256GCM, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2}, make([]byte, 12+16)...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{
+			name:    "Parses a minimal valid envelope",
+			data:    valid,
+			wantErr: false,
+		},
+		{
+			name:    "Rejects empty input",
+			data:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "Rejects truncated header",
+			data:    valid[:EnvelopeHeaderSize-1],
+			wantErr: true,
+		},
+		{
+			name:    "Rejects missing tag",
+			data:    valid[:len(valid)-1],
+			wantErr: true,
+		},
+		{
+			name:    "Rejects unknown version",
+			data:    append([]byte{0x02}, valid[1:]...),
+			wantErr: true,
+		},
+		{
+			name:    "Rejects unknown suite",
+			data:    append([]byte{EnvelopeVersion1, 0x7f}, valid[2:]...),
+			wantErr: true,
+		},
+		{
+			name:    "Rejects oversized input",
+			data:    append(valid, make([]byte, MaxEnvelopeSize)...),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := ParseEnvelope(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseEnvelope() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if envelope == nil {
+				return
+			}
+			marshaled, err := envelope.Marshal()
+			if err != nil || !reflect.DeepEqual(marshaled, tt.data) {
+				t.Errorf("Envelope.Marshal() = %v, %v, want the parsed input back", marshaled, err)
+			}
+		})
+	}
+}
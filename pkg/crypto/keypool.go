@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrKeyPoolClosed = errors.New("key pool closed")
+
+// KeyPool generates RSA keys in the background once the first one is asked
+// for, and keeps up to size of them ready, so later callers only wait when the
+// pool has been drained.
+type KeyPool struct {
+	bits   int
+	keys   chan *RSA
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	start  sync.Once
+	once   sync.Once
+	err    error
+}
+
+func NewKeyPool(bits, size int) *KeyPool {
+	if size < 1 {
+		size = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := &KeyPool{
+		bits:   bits,
+		keys:   make(chan *RSA, size),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	return pool
+}
+
+func (p *KeyPool) fill(ctx context.Context) {
+	defer close(p.done)
+
+	for {
+		key, err := p.generate(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.err = err
+			return
+		}
+
+		select {
+		case p.keys <- key:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// generate returns as soon as ctx is done, leaving the key being generated
+// to be dropped.
+func (p *KeyPool) generate(ctx context.Context) (*RSA, error) {
+	type generated struct {
+		key *RSA
+		err error
+	}
+	result := make(chan generated, 1)
+	go func() {
+		key, err := GenerateRSA(p.bits)
+		result <- generated{key: key, err: err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.key, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Get returns a ready key, waiting for one to be generated if needed. Every
+// key is handed out once.
+func (p *KeyPool) Get(ctx context.Context) (*RSA, error) {
+	p.start.Do(func() { go p.fill(p.ctx) })
+
+	select {
+	case key := <-p.keys:
+		return key, nil
+	default:
+	}
+
+	select {
+	case key := <-p.keys:
+		return key, nil
+	case <-p.done:
+		select {
+		case key := <-p.keys:
+			return key, nil
+		default:
+		}
+		if p.err != nil {
+			return nil, p.err
+		}
+		return nil, ErrKeyPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the pool without waiting for the key being generated.
+func (p *KeyPool) Close() {
+	p.once.Do(p.cancel)
+	p.start.Do(func() { close(p.done) })
+	<-p.done
+}
@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeyPool_Get(t *testing.T) {
+	pool := NewKeyPool(1024, 2)
+	defer pool.Close()
+
+	first, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	second, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if first.privateKey.Equal(second.privateKey) {
+		t.Errorf("Get() handed out the same key twice")
+	}
+}
+
+func TestKeyPool_GetCancelled(t *testing.T) {
+	pool := NewKeyPool(4096, 1)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	if _, err := pool.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestKeyPool_CloseCancelsGeneration(t *testing.T) {
+	pool := NewKeyPool(8192, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	pool.Get(ctx)
+
+	start := time.Now()
+	pool.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close() took %v, want it to cancel the generation in progress", elapsed)
+	}
+}
+
+func TestKeyPool_Closed(t *testing.T) {
+	pool := NewKeyPool(1024, 1)
+	pool.Close()
+
+	for {
+		_, err := pool.Get(context.Background())
+		if errors.Is(err, ErrKeyPoolClosed) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Get() error = %v, want %v", err, ErrKeyPoolClosed)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const MACSize = sha256.Size
+
+// DeriveKey implements HKDF-SHA256 (RFC 5869).
+func DeriveKey(secret, salt []byte, info string, size int) ([]byte, error) {
+	if size <= 0 || size > 255*sha256.Size {
+		return nil, fmt.Errorf("invalid derived key size %d", size)
+	}
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(secret)
+	pseudoRandomKey := extractor.Sum(nil)
+
+	var (
+		derived []byte
+		block   []byte
+	)
+	for counter := byte(1); len(derived) < size; counter++ {
+		expander := hmac.New(sha256.New, pseudoRandomKey)
+		expander.Write(block)
+		expander.Write([]byte(info))
+		expander.Write([]byte{counter})
+		block = expander.Sum(nil)
+		derived = append(derived, block...)
+	}
+
+	return derived[:size], nil
+}
+
+// DerivePassphraseKey implements PBKDF2-HMAC-SHA256 (RFC 8018).
+func DerivePassphraseKey(passphrase, salt []byte, iterations, size int) ([]byte, error) {
+	if iterations <= 0 {
+		return nil, fmt.Errorf("invalid iteration count %d", iterations)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid derived key size %d", size)
+	}
+
+	prf := hmac.New(sha256.New, passphrase)
+	derived := make([]byte, 0, size+sha256.Size)
+	for blockIndex := uint32(1); len(derived) < size; blockIndex++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, blockIndex))
+		u := prf.Sum(nil)
+
+		block := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range block {
+				block[j] ^= u[j]
+			}
+		}
+		derived = append(derived, block...)
+	}
+
+	return derived[:size], nil
+}
+
+func ComputeMAC(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+
+	return mac.Sum(nil)
+}
+
+func VerifyMAC(key, message, tag []byte) bool {
+	return hmac.Equal(ComputeMAC(key, message), tag)
+}
+
+func KeyID(key []byte) uint32 {
+	digest := sha256.Sum256(key)
+
+	return binary.BigEndian.Uint32(digest[:4])
+}
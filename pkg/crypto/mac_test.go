@@ -0,0 +1,146 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	type args struct {
+		secret string
+		salt   string
+		info   string
+		size   int
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Matches RFC 5869 test case 1",
+			args: args{
+				secret: "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+				salt:   "000102030405060708090a0b0c",
+				info:   "f0f1f2f3f4f5f6f7f8f9",
+				size:   42,
+			},
+			want: "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			name: "Matches RFC 5869 test case 3 without salt",
+			args: args{
+				secret: "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+				size:   42,
+			},
+			want: "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+		{
+			name:    "Returns error on invalid size",
+			args:    args{secret: "00", size: 0},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, _ := hex.DecodeString(tt.args.secret)
+			salt, _ := hex.DecodeString(tt.args.salt)
+			info, _ := hex.DecodeString(tt.args.info)
+
+			got, err := DeriveKey(secret, salt, string(info), tt.args.size)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DeriveKey() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && hex.EncodeToString(got) != tt.want {
+				t.Errorf("DeriveKey() = %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyMAC(t *testing.T) {
+	key := []byte("shared secret")
+	tag := ComputeMAC(key, []byte("test_message"))
+
+	tests := []struct {
+		name    string
+		key     []byte
+		message []byte
+		want    bool
+	}{
+		{
+			name:    "Accepts matching tag",
+			key:     key,
+			message: []byte("test_message"),
+			want:    true,
+		},
+		{
+			name:    "Rejects modified message",
+			key:     key,
+			message: []byte("test_massage"),
+			want:    false,
+		},
+		{
+			name:    "Rejects different key",
+			key:     []byte("other secret"),
+			message: []byte("test_message"),
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyMAC(tt.key, tt.message, tag); got != tt.want {
+				t.Errorf("VerifyMAC() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDerivePassphraseKey(t *testing.T) {
+	type args struct {
+		passphrase string
+		salt       string
+		iterations int
+		size       int
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Matches PBKDF2-HMAC-SHA256 with one iteration",
+			args: args{passphrase: "password", salt: "salt", iterations: 1, size: 32},
+			want: "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+		},
+		{
+			name: "Matches PBKDF2-HMAC-SHA256 with 4096 iterations",
+			args: args{passphrase: "password", salt: "salt", iterations: 4096, size: 32},
+			want: "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a",
+		},
+		{
+			name: "Matches PBKDF2-HMAC-SHA256 across two blocks",
+			args: args{passphrase: "passwordPASSWORDpassword", salt: "saltSALTsaltSALTsaltSALTsaltSALTsalt", iterations: 4096, size: 40},
+			want: "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9",
+		},
+		{
+			name:    "Returns error on zero iterations",
+			args:    args{passphrase: "password", salt: "salt", iterations: 0, size: 32},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DerivePassphraseKey([]byte(tt.args.passphrase), []byte(tt.args.salt), tt.args.iterations, tt.args.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DerivePassphraseKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && hex.EncodeToString(got) != tt.want {
+				t.Errorf("DerivePassphraseKey() = %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
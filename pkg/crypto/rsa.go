@@ -1,9 +1,15 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
 )
 
 type RSA struct {
@@ -41,3 +47,80 @@ func (r *RSA) DecryptMessage(ciphertext []byte) (plaintext []byte, err error) {
 
 	return
 }
+
+func ParseRSAPublicKey(publicKey []byte) (*RSA, error) {
+	key, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+
+	return &RSA{publicKey: rsaKey}, nil
+}
+
+func (r *RSA) Sign(message []byte) (signature []byte, err error) {
+	if r.privateKey == nil {
+		return nil, fmt.Errorf("cannot sign without a private key")
+	}
+
+	digest := sha256.Sum256(message)
+	signature, err = rsa.SignPSS(rand.Reader, r.privateKey, crypto.SHA256, digest[:], nil)
+
+	return
+}
+
+func (r *RSA) Verify(message, signature []byte) error {
+	digest := sha256.Sum256(message)
+
+	return rsa.VerifyPSS(r.publicKey, crypto.SHA256, digest[:], signature, nil)
+}
+
+func (r *RSA) MarshalPrivateKey() ([]byte, error) {
+	if r.privateKey == nil {
+		return nil, fmt.Errorf("no private key to marshal")
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(r.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func ParseRSAPrivateKey(data []byte) (*RSA, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+
+	return &RSA{
+		publicKey:  &privateKey.PublicKey,
+		privateKey: privateKey,
+	}, nil
+}
+
+func Fingerprint(publicKey []byte) string {
+	digest := sha256.Sum256(publicKey)
+
+	groups := make([]string, 0, 8)
+	for i := 0; i < 16; i += 2 {
+		groups = append(groups, strings.ToUpper(hex.EncodeToString(digest[i:i+2])))
+	}
+
+	return strings.Join(groups, " ")
+}
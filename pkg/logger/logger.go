@@ -7,25 +7,37 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
 type Logger struct {
-	level   string
+	level   *atomic.Value
 	output  io.Writer
 	format  string
 	context map[string]interface{}
 }
 
 func NewLogger(level string) *Logger {
+	levelValue := &atomic.Value{}
+	levelValue.Store(level)
+
 	return &Logger{
-		level:   level,
+		level:   levelValue,
 		output:  os.Stdout,
 		format:  "text",
 		context: make(map[string]interface{}),
 	}
 }
 
+func (l *Logger) SetLevel(level string) {
+	l.level.Store(level)
+}
+
+func (l *Logger) Level() string {
+	return l.level.Load().(string)
+}
+
 func (l *Logger) SetOutput(output io.Writer) {
 	l.output = output
 }
@@ -131,7 +143,7 @@ func (l *Logger) formatMessage(timestamp, level, message string, fields ...map[s
 
 func (l *Logger) shouldLog(level string) bool {
 	levels := map[string]int{"DEBUG": 1, "INFO": 2, "WARN": 3, "ERROR": 4, "FATAL": 5, "CHAT": 6}
-	return levels[level] >= levels[l.level]
+	return levels[level] >= levels[l.Level()]
 }
 
 func extractContextFields(_ context.Context) map[string]interface{} {